@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/josephspurrier/gowebapp/app/shared/chat"
+	"github.com/josephspurrier/gowebapp/app/shared/session"
+	"github.com/josephspurrier/gowebapp/app/shared/view"
+
+	"github.com/josephspurrier/csrfbanana"
+)
+
+// AdminGET displays live chat state of this node
+func AdminGET(w http.ResponseWriter, r *http.Request) {
+	// Get session
+	sess := session.Instance(r)
+
+	// Display the view
+	v := view.New(r)
+	v.Name = "admin/chat"
+	v.Vars["token"] = csrfbanana.Token(w, r, sess)
+	v.Vars["rooms"] = chat.AdminRooms()
+	v.Vars["sessions"] = chat.AdminSessions()
+	v.Vars["users"] = chat.AdminUsers()
+	v.Vars["quota"] = chat.UPLOAD_USER_QUOTA
+	v.Vars["webhooks"] = chat.Webhooks("")
+	v.Vars["deliveries"] = chat.WebhookDeliveries("")
+	v.Vars["events"] = chat.WebhookEvents
+	v.Render(w)
+}
+
+// AdminRoomDeletePOST removes room with all members
+func AdminRoomDeletePOST(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, chat.AdminDeleteRoom, "Room deleted!")
+}
+
+// AdminSessionDisconnectPOST closes chat session
+func AdminSessionDisconnectPOST(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, chat.AdminDisconnectSession, "Session disconnected!")
+}
+
+// AdminUserResetPOST clears user rate limit and upload quota
+func AdminUserResetPOST(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, chat.AdminResetUser, "User limits reset!")
+}
+
+// AdminWebhookAddPOST registers webhook, secret is shown once in flash
+func AdminWebhookAddPOST(w http.ResponseWriter, r *http.Request) {
+	// Get session
+	sess := session.Instance(r)
+	email, _ := sess.Values["email"].(string)
+
+	// Validate with required fields
+	if validate, missingField := view.Validate(r, []string{"room", "url"}); !validate {
+		sess.AddFlash(view.Flash{Message: "Field missing: " + missingField, Class: view.FlashError})
+	} else if hook, err := chat.AdminAddWebhook(r.FormValue("room"), r.FormValue("url"), r.FormValue("events"), email); err != nil {
+		sess.AddFlash(view.Flash{Message: err.Error(), Class: view.FlashError})
+	} else {
+		sess.AddFlash(view.Flash{Message: "Webhook added! Signing secret (shown once): " + hook.Secret, Class: view.FlashSuccess})
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// AdminWebhookRemovePOST unregisters webhook
+func AdminWebhookRemovePOST(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, chat.RemoveWebhook, "Webhook removed!")
+}
+
+// adminAction calls action with form id and returns to admin page with result flash
+func adminAction(w http.ResponseWriter, r *http.Request, action func(id string) error, success string) {
+	// Get session
+	sess := session.Instance(r)
+
+	// Validate with required fields
+	if validate, missingField := view.Validate(r, []string{"id"}); !validate {
+		sess.AddFlash(view.Flash{Message: "Field missing: " + missingField, Class: view.FlashError})
+	} else if err := action(r.FormValue("id")); err != nil {
+		sess.AddFlash(view.Flash{Message: err.Error(), Class: view.FlashError})
+	} else {
+		sess.AddFlash(view.Flash{Message: success, Class: view.FlashSuccess})
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
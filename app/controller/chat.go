@@ -3,13 +3,31 @@ package controller
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/josephspurrier/gowebapp/app/shared/chat"
 	"github.com/josephspurrier/gowebapp/app/shared/session"
 	"github.com/josephspurrier/gowebapp/app/shared/view"
+
+	"github.com/gorilla/websocket"
 )
 
+// Max size of inbound websocket frame
+const WS_MAX_FRAME_SIZE = 64 * 1024
+
+// Deadline for frame writes, slow client is disconnected
+const WS_WRITE_TIMEOUT = 10 * time.Second
+
+// Default upgrader checks Origin header to be same as Host
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
 // IndexGET displays the home page
 func ChatGET(w http.ResponseWriter, r *http.Request) {
 	// Get session
@@ -39,16 +57,33 @@ func ChatJoinGET(w http.ResponseWriter, r *http.Request) {
 	name := session.Values["username"].(string)
 
 	user := chat.GetUser(id, name)
-	chatSession := user.NewSession()
+
+	// Reconnect with resume token returns same session with rooms and not acknowledged messages
+	var chatSession *chat.Session
+	if token := r.URL.Query().Get("resume"); token != "" {
+		ack, _ := strconv.ParseUint(r.URL.Query().Get("ack"), 10, 64)
+		resumed, err := user.ResumeSession(token, ack)
+		if err != nil {
+			body, _ := json.Marshal(chat.MessageSessionNotFound())
+			w.WriteHeader(404)
+			w.Write(body)
+			return
+		}
+		chatSession = resumed
+	} else {
+		chatSession = user.NewSession()
+	}
 
 	response := struct {
 		ID      string `json:"id"`
 		Name    string `json:"name"`
 		Session string `json:"session"`
+		Resume  string `json:"resume"`
 	}{
 		ID:      id,
 		Name:    name,
 		Session: chatSession.ID,
+		Resume:  chatSession.Token,
 	}
 
 	body, _ := json.Marshal(&response)
@@ -83,10 +118,15 @@ func ChatUpdateGET(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Client received messages up to ack, they are not needed for resume anymore
+	if ack, err := strconv.ParseUint(r.URL.Query().Get("ack"), 10, 64); err == nil {
+		chatSession.Ack(ack)
+	}
+
 	select {
-	// Client break request
+	// Client break request. Session is suspended by heartbeat timeout if client not returns
 	case <-ctx.Done():
-		chatSession.User.DeleteSession((chatSession))
+		return
 	// Session not active
 	case <-chatSession.Closed:
 		response := []*chat.Message{chat.MessageDisconnected()}
@@ -94,10 +134,7 @@ func ChatUpdateGET(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(599)
 		w.Write(body)
 	case <-chatSession.BufferAvailable:
-		chatSession.BufferMu.Lock()
-		body, _ := json.Marshal(chatSession.Buffer)
-		chatSession.Buffer = nil
-		chatSession.BufferMu.Unlock()
+		body, _ := json.Marshal(chatSession.Drain())
 
 		w.Header().Add("Content-Type", "application/json")
 		w.Write(body)
@@ -105,6 +142,191 @@ func ChatUpdateGET(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// ChatEventsGET streams chat session as Server-Sent Events.
+// Event name is message type, event id is message sequence number in session.
+// Stream disconnect not deletes session: EventSource reconnects with Last-Event-ID and receives missed messages.
+func ChatEventsGET(w http.ResponseWriter, r *http.Request) {
+	session := session.Instance(r)
+	ctx := r.Context()
+
+	if session.Values["id"] == nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := session.Values["id"].(string)
+	name := session.Values["username"].(string)
+	chatSessionID := r.URL.Query().Get("session")
+	if chatSessionID == "" || !chat.ValidateSessionID(chatSessionID) {
+		w.WriteHeader(401)
+		return
+	}
+
+	user := chat.GetUser(id, name)
+	chatSession, err := user.GetSession(chatSessionID)
+	if err != nil {
+		body, _ := json.Marshal(chat.MessageSessionNotFound())
+		w.WriteHeader(404)
+		w.Write(body)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		w.Write([]byte("streaming unsupported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Disable proxy buffering (nginx)
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	// Resend messages which client not received before reconnect
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		if seq, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+			chatSession.Ack(seq)
+			for _, message := range chatSession.Replay(seq) {
+				writeEvent(w, message)
+			}
+		}
+	}
+	for _, message := range chatSession.Drain() {
+		writeEvent(w, message)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(chat.HEART_BEAT_TIMEOUT / 2)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		// Client break stream
+		case <-ctx.Done():
+			return
+		// Session not active
+		case <-chatSession.Closed:
+			writeEvent(w, chat.MessageDisconnected())
+			flusher.Flush()
+			return
+		case <-chatSession.BufferAvailable:
+			for _, message := range chatSession.Drain() {
+				writeEvent(w, message)
+			}
+			flusher.Flush()
+		// Stream is alive while connection open, so keep session alive too
+		case <-keepalive.C:
+			chatSession.Touch()
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w io.Writer, message *chat.Message) {
+	body, _ := json.Marshal(message)
+	if message.Seq > 0 {
+		fmt.Fprintf(w, "id: %d\n", message.Seq)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", message.Type, body)
+}
+
+// ChatWebSocketGET binds chat session to websocket connection.
+// Buffered messages are pushed as separate frames, each inbound frame passed to message processor.
+func ChatWebSocketGET(w http.ResponseWriter, r *http.Request) {
+	session := session.Instance(r)
+
+	if session.Values["id"] == nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := session.Values["id"].(string)
+	name := session.Values["username"].(string)
+	chatSessionID := r.URL.Query().Get("session")
+	if chatSessionID == "" || !chat.ValidateSessionID(chatSessionID) {
+		w.WriteHeader(401)
+		return
+	}
+
+	user := chat.GetUser(id, name)
+	chatSession, err := user.GetSession(chatSessionID)
+	if err != nil {
+		body, _ := json.Marshal(chat.MessageSessionNotFound())
+		w.WriteHeader(404)
+		w.Write(body)
+		return
+	}
+
+	// Upgrader respond with error by itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WS: upgrade failed.", err)
+		return
+	}
+	defer conn.Close()
+
+	// Reader. Any frame from client (pong too) is heartbeat for session
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		conn.SetReadLimit(WS_MAX_FRAME_SIZE)
+		conn.SetPongHandler(func(string) error {
+			chatSession.Touch()
+			return nil
+		})
+
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			chatSession.Touch()
+
+			message := chat.Message{}
+			if err := json.Unmarshal(data, &message); err != nil {
+				log.Println("WS: unknown message format.", err)
+				continue
+			}
+			chat.ProcessMessage(&message, chatSession)
+		}
+	}()
+
+	ping := time.NewTicker(chat.HEART_BEAT_TIMEOUT / 2)
+	defer ping.Stop()
+
+	for {
+		select {
+		// Client close connection, it can resume session with token
+		case <-done:
+			chatSession.User.SuspendSession(chatSession)
+			return
+		// Session not active
+		case <-chatSession.Closed:
+			conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+			conn.WriteJSON(chat.MessageDisconnected())
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case <-chatSession.BufferAvailable:
+			// Not written messages stay not acknowledged, client gets them on resume
+			for _, message := range chatSession.Drain() {
+				conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+				if err := conn.WriteJSON(message); err != nil {
+					log.Println("WS: write failed.", err)
+					chatSession.User.SuspendSession(chatSession)
+					return
+				}
+			}
+		case <-ping.C:
+			conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_TIMEOUT))
+		}
+	}
+}
+
 func ChatSendPOST(w http.ResponseWriter, r *http.Request) {
 	session := session.Instance(r)
 
@@ -236,3 +458,181 @@ func ChatUploadAllowedGET(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(200)
 }
+
+// ChatSearchGET returns stored messages visible for user.
+// Query parameters: q - words, room - room ID, with - private peer ID, from - author ID,
+// since and until - RFC3339 time, limit - max messages count.
+func ChatSearchGET(w http.ResponseWriter, r *http.Request) {
+	session := session.Instance(r)
+
+	if session.Values["id"] == nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := session.Values["id"].(string)
+	name := session.Values["username"].(string)
+	user := chat.GetUser(id, name)
+
+	params := r.URL.Query()
+	query := &chat.SearchQuery{
+		Text: params.Get("q"),
+		Room: params.Get("room"),
+		With: params.Get("with"),
+		From: params.Get("from"),
+	}
+
+	var err error
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Bad since time"))
+			return
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Bad until time"))
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Bad limit"))
+			return
+		}
+	}
+
+	messages, err := chat.SearchMessages(user, query)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	body, _ := json.Marshal(&chat.SearchResult{Query: query, Messages: messages})
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// ChatExportGET returns transcript of room (room - room ID) or private conversation (with - user ID).
+// format is json (JSON lines, default), csv or html, zip=1 bundles transcript with attachment files.
+// since and until are RFC3339 time. Admins export any room.
+func ChatExportGET(w http.ResponseWriter, r *http.Request) {
+	session := session.Instance(r)
+
+	if session.Values["id"] == nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := session.Values["id"].(string)
+	name := session.Values["username"].(string)
+	email, _ := session.Values["email"].(string)
+	user := chat.GetUser(id, name)
+
+	params := r.URL.Query()
+	query := &chat.ExportQuery{
+		Room: params.Get("room"),
+		With: params.Get("with"),
+	}
+
+	var err error
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Bad since time"))
+			return
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Bad until time"))
+			return
+		}
+	}
+
+	var write func(io.Writer, *chat.Transcript) error
+	var contentType string
+	format := params.Get("format")
+	switch format {
+	case "", "json":
+		format, contentType, write = "jsonl", "application/x-ndjson", chat.WriteTranscriptJSON
+	case "csv":
+		contentType, write = "text/csv", chat.WriteTranscriptCSV
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		write = func(out io.Writer, t *chat.Transcript) error {
+			return renderTranscript(out, r, t)
+		}
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("Bad format"))
+		return
+	}
+
+	transcript, err := chat.ExportConversation(user, query, chat.IsAdmin(email))
+	if err == chat.ErrExportForbidden {
+		w.WriteHeader(403)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	filename := "transcript-" + transcript.Exported.Format("20060102-150405")
+	if params.Get("zip") == "1" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+		err = chat.WriteTranscriptZip(w, transcript, "transcript."+format, write)
+	} else {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+"."+format+`"`)
+		err = write(w, transcript)
+	}
+	if err != nil {
+		log.Println("Chat: failed to export transcript.", err)
+	}
+}
+
+// transcriptWriter lets view render into zip entry
+type transcriptWriter struct {
+	io.Writer
+	header http.Header
+	status int
+}
+
+func (tw *transcriptWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *transcriptWriter) WriteHeader(status int) {
+	tw.status = status
+}
+
+// renderTranscript renders self-contained html transcript (no layout, styles inline)
+func renderTranscript(out io.Writer, r *http.Request, t *chat.Transcript) error {
+	tw := &transcriptWriter{Writer: out, header: http.Header{}, status: 200}
+
+	v := view.New(r)
+	v.Name = "chat_export"
+	v.Vars["transcript"] = t
+	// Downloaded file is opened outside of site, so attachments are linked by absolute URL
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	v.Vars["origin"] = scheme + "://" + r.Host + v.BaseURI
+	v.RenderSingle(tw)
+
+	if tw.status != 200 {
+		return fmt.Errorf("Transcript render failed with status %d", tw.status)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package acl
 import (
 	"net/http"
 
+	"github.com/josephspurrier/gowebapp/app/shared/chat"
 	"github.com/josephspurrier/gowebapp/app/shared/session"
 )
 
@@ -37,3 +38,20 @@ func DisallowAnon(h http.Handler) http.Handler {
 		h.ServeHTTP(w, r)
 	})
 }
+
+// DisallowNonAdmin allows only chat admins (Chat.Admins emails in config) to access the page
+func DisallowNonAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get session
+		sess := session.Instance(r)
+
+		// If user is not admin, don't allow them to access the page
+		email, _ := sess.Values["email"].(string)
+		if sess.Values["id"] == nil || !chat.IsAdmin(email) {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -110,6 +110,26 @@ func routes() *httprouter.Router {
 		New(acl.DisallowAnon).
 		ThenFunc(pprofhandler.Handler)))
 
+	// Chat admin console, path must not match "/chat" excluded from CSRF check
+	r.GET("/admin", hr.Handler(alice.
+		New(acl.DisallowNonAdmin).
+		ThenFunc(controller.AdminGET)))
+	r.POST("/admin/room/delete", hr.Handler(alice.
+		New(acl.DisallowNonAdmin).
+		ThenFunc(controller.AdminRoomDeletePOST)))
+	r.POST("/admin/session/disconnect", hr.Handler(alice.
+		New(acl.DisallowNonAdmin).
+		ThenFunc(controller.AdminSessionDisconnectPOST)))
+	r.POST("/admin/user/reset", hr.Handler(alice.
+		New(acl.DisallowNonAdmin).
+		ThenFunc(controller.AdminUserResetPOST)))
+	r.POST("/admin/webhook/add", hr.Handler(alice.
+		New(acl.DisallowNonAdmin).
+		ThenFunc(controller.AdminWebhookAddPOST)))
+	r.POST("/admin/webhook/remove", hr.Handler(alice.
+		New(acl.DisallowNonAdmin).
+		ThenFunc(controller.AdminWebhookRemovePOST)))
+
 	// Chat
 	r.GET("/chat", hr.Handler(alice.
 		New(acl.DisallowAnon).
@@ -123,6 +143,14 @@ func routes() *httprouter.Router {
 		New(acl.DisallowAnon).
 		ThenFunc(controller.ChatUpdateGET)))
 
+	r.GET("/chat/events", hr.Handler(alice.
+		New(acl.DisallowAnon).
+		ThenFunc(controller.ChatEventsGET)))
+
+	r.GET("/chat/ws", hr.Handler(alice.
+		New(acl.DisallowAnon).
+		ThenFunc(controller.ChatWebSocketGET)))
+
 	r.POST("/chat/send", hr.Handler(alice.
 		New(acl.DisallowAnon).
 		ThenFunc(controller.ChatSendPOST)))
@@ -139,6 +167,14 @@ func routes() *httprouter.Router {
 		New(acl.DisallowAnon).
 		ThenFunc(controller.ChatUploadAllowedGET)))
 
+	r.GET("/chat/search", hr.Handler(alice.
+		New(acl.DisallowAnon).
+		ThenFunc(controller.ChatSearchGET)))
+
+	r.GET("/chat/export", hr.Handler(alice.
+		New(acl.DisallowAnon).
+		ThenFunc(controller.ChatExportGET)))
+
 	return r
 }
 
@@ -0,0 +1,220 @@
+package chat
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Emails of users allowed to open admin console, set from Config.Admins
+var ADMINS = map[string]bool{}
+
+// IsAdmin returns true if user with login email is chat admin
+func IsAdmin(email string) bool {
+	return email != "" && ADMINS[strings.ToLower(email)]
+}
+
+// AdminRoom is room state shown in admin console. Members are counted on all nodes, sessions on this node
+type AdminRoom struct {
+	ID        string
+	Name      string
+	Type      string
+	Permanent bool
+	Protected bool
+	Members   int
+	Sessions  int
+}
+
+// AdminSession is session state shown in admin console
+type AdminSession struct {
+	ID            string
+	UserID        string
+	UserName      string
+	Rooms         int
+	Buffered      int
+	Unacked       int
+	LastHeartbeat time.Time
+	Suspended     bool
+}
+
+// AdminUser is user limits state shown in admin console
+type AdminUser struct {
+	ID          string
+	Name        string
+	Presence    string
+	Sessions    int
+	Messages    int // Messages in current throttling window
+	UploadBytes int64
+}
+
+// AdminRooms returns rooms known by this node sorted by name
+func AdminRooms() []AdminRoom {
+	RoomStore.Mu.Lock()
+	rooms := make([]*Room, 0, len(RoomStore.Map))
+	for _, room := range RoomStore.Map {
+		rooms = append(rooms, room)
+	}
+	RoomStore.Mu.Unlock()
+
+	list := make([]AdminRoom, 0, len(rooms))
+	for _, room := range rooms {
+		room.SessionsMu.Lock()
+		sessions := len(room.Sessions)
+		room.SessionsMu.Unlock()
+
+		list = append(list, AdminRoom{
+			ID:        room.ID,
+			Name:      room.Name,
+			Type:      room.Type,
+			Permanent: room.Permanent,
+			Protected: room.Protected,
+			Members:   room.UserCount(),
+			Sessions:  sessions,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// AdminSessions returns sessions of this node, recently active first
+func AdminSessions() []AdminSession {
+	SessionStore.Mu.Lock()
+	sessions := make([]*Session, 0, len(SessionStore.Map))
+	for _, s := range SessionStore.Map {
+		sessions = append(sessions, s)
+	}
+	SessionStore.Mu.Unlock()
+
+	list := make([]AdminSession, 0, len(sessions))
+	for _, s := range sessions {
+		s.RoomsMu.Lock()
+		rooms := len(s.Rooms)
+		s.RoomsMu.Unlock()
+
+		s.BufferMu.Lock()
+		buffered, unacked := len(s.Buffer), len(s.Sent)
+		s.BufferMu.Unlock()
+
+		s.StateMu.Lock()
+		seen, suspended := s.LastSeen, s.Suspended
+		s.StateMu.Unlock()
+
+		list = append(list, AdminSession{
+			ID:            s.ID,
+			UserID:        s.User.ID,
+			UserName:      s.User.Name,
+			Rooms:         rooms,
+			Buffered:      buffered,
+			Unacked:       unacked,
+			LastHeartbeat: seen,
+			Suspended:     suspended,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastHeartbeat.After(list[j].LastHeartbeat) })
+	return list
+}
+
+// AdminUsers returns users known by this node sorted by name
+func AdminUsers() []AdminUser {
+	UserStore.Mu.Lock()
+	users := make([]*User, 0, len(UserStore.Map))
+	for _, u := range UserStore.Map {
+		users = append(users, u)
+	}
+	UserStore.Mu.Unlock()
+
+	list := make([]AdminUser, 0, len(users))
+	for _, u := range users {
+		u.SessionsMu.Lock()
+		sessions := len(u.Sessions)
+		u.SessionsMu.Unlock()
+
+		u.FixedWindowCounterMu.Lock()
+		messages := u.FixedWindowCounter
+		u.FixedWindowCounterMu.Unlock()
+
+		u.UploadBytesMu.Lock()
+		upload := u.UploadBytes
+		u.UploadBytesMu.Unlock()
+
+		list = append(list, AdminUser{
+			ID:          u.ID,
+			Name:        u.Name,
+			Presence:    u.GetPresence(),
+			Sessions:    sessions,
+			Messages:    messages,
+			UploadBytes: upload,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// AdminDeleteRoom removes room with members on all nodes, clients receive 'room.deleted'
+func AdminDeleteRoom(id string) error {
+	room, err := GetRoomByID(id)
+	if err != nil {
+		return err
+	}
+
+	// Private room not known by other clients, so notify members only
+	deleted := MessageRoomDeleted(room)
+	if room.Type == ROOM_PUBLIC {
+		PublishMessage("chat.broadcast", deleted)
+	} else {
+		for _, u := range room.GetUsers() {
+			PublishMessage(u.ID, deleted)
+		}
+	}
+
+	room.detachSessions()
+	DeleteRoom(room)
+	return nil
+}
+
+// AdminDisconnectSession closes session of this node, client receives 'disconnected'
+func AdminDisconnectSession(id string) error {
+	SessionStore.Mu.Lock()
+	s := SessionStore.Map[id]
+	SessionStore.Mu.Unlock()
+
+	if s == nil {
+		return errors.New("Session not found")
+	}
+	s.User.DeleteSession(s)
+	return nil
+}
+
+// AdminResetUser clears throttling window and upload quota of user
+func AdminResetUser(id string) error {
+	UserStore.Mu.Lock()
+	u := UserStore.Map[id]
+	UserStore.Mu.Unlock()
+
+	if u == nil {
+		return errors.New("User not found")
+	}
+
+	u.FixedWindowCounterMu.Lock()
+	u.FixedWindowCounter = 0
+	u.TypingWindowCounter = 0
+	u.FixedWindowCounterMu.Unlock()
+
+	u.UploadBytesMu.Lock()
+	u.UploadBytes = 0
+	u.UploadBytesMu.Unlock()
+	return nil
+}
+
+// AdminAddWebhook registers webhook of room or of all rooms (WEBHOOK_ALL_ROOMS).
+// Events are separated by comma or space, empty - all events.
+func AdminAddWebhook(roomID string, rawurl string, events string, createdBy string) (*Webhook, error) {
+	if roomID != WEBHOOK_ALL_ROOMS {
+		if _, err := GetRoomByID(roomID); err != nil {
+			return nil, err
+		}
+	}
+	list := strings.FieldsFunc(events, func(r rune) bool { return r == ',' || r == ' ' })
+	return AddWebhook(roomID, rawurl, list, createdBy)
+}
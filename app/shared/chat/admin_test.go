@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	ADMINS = map[string]bool{"admin@example.com": true}
+	defer func() { ADMINS = map[string]bool{} }()
+	if !IsAdmin("Admin@example.com") || IsAdmin("user@example.com") || IsAdmin("") {
+		t.Error("Unexpected admin check result")
+	}
+
+	owner := GetUser("admin-owner", "Owner")
+	member := GetUser("admin-member", "Member")
+	so := owner.NewSession()
+	su := member.NewSession()
+	defer owner.DeleteSession(so)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "admin-room"}}, so)
+	to := MessageUser{ID: RoomID("admin-room"), Name: "admin-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	for _, s := range []*Session{so, su} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+
+	found := false
+	for _, room := range AdminRooms() {
+		if room.ID == to.ID {
+			found = true
+			if room.Members != 2 || room.Sessions != 2 {
+				t.Errorf("Expected 2 members and sessions, got %d and %d", room.Members, room.Sessions)
+			}
+		}
+	}
+	if !found {
+		t.Error("Room not listed")
+	}
+
+	// Reset limits
+	member.UploadBytesMu.Lock()
+	member.UploadBytes = 100
+	member.UploadBytesMu.Unlock()
+	if err := AdminResetUser(member.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range AdminUsers() {
+		if u.ID == member.ID && u.UploadBytes != 0 {
+			t.Error("Upload quota not reset")
+		}
+	}
+
+	// Disconnect
+	if err := AdminDisconnectSession(su.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-su.Closed:
+	default:
+		t.Error("Session not closed")
+	}
+	for _, s := range AdminSessions() {
+		if s.ID == su.ID {
+			t.Error("Disconnected session listed")
+		}
+	}
+
+	// Delete room with members
+	if err := AdminDeleteRoom(to.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitMessage(t, so, "room.deleted")
+	if RoomExistsByID(to.ID) {
+		t.Error("Room not deleted")
+	}
+	so.RoomsMu.Lock()
+	rooms := len(so.Rooms)
+	so.RoomsMu.Unlock()
+	if rooms != 0 {
+		t.Error("Deleted room kept in session")
+	}
+	if err := AdminDeleteRoom(to.ID); err == nil {
+		t.Error("Deleted not existed room")
+	}
+}
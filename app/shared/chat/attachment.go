@@ -13,6 +13,7 @@ import (
 	"mime/multipart"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -25,8 +26,13 @@ type Attachment struct {
 	Hash         string    `json:"hash"`
 	OriginalPath string    `json:"original_url"`
 	MinifiedPath string    `json:"minified_url"`
+
+	claimed bool // Store entry is reference of stored message, not only upload
 }
 
+// AttachmentStoreType counts references to uploaded files: entry is added by upload and claimed by first
+// stored message with it, other messages with the same attachment add own entries.
+// Files are removed when the last entry pointing to them is removed.
 type AttachmentStoreType struct {
 	List []*Attachment
 	Mu   sync.Mutex
@@ -38,23 +44,49 @@ func (store *AttachmentStoreType) Add(a *Attachment) {
 	store.Mu.Unlock()
 }
 
-func (store *AttachmentStoreType) Remove(a *Attachment) {
+// Claim adds reference of stored message to attachment. Attachment comes from client, so only its ID is used.
+func (store *AttachmentStoreType) Claim(a *Attachment) {
 	store.Mu.Lock()
-	temp := store.List[:0]
-	last := true
+	defer store.Mu.Unlock()
+
+	var uploaded *Attachment
 	for _, attachment := range store.List {
-		if a.ID != attachment.ID {
-			temp = append(temp, attachment)
-			if a.Hash == attachment.Hash {
-				last = false
-			}
+		if attachment.ID != a.ID {
+			continue
+		}
+		if !attachment.claimed {
+			attachment.claimed = true
+			return
 		}
+		uploaded = attachment
 	}
-	store.List = temp
-	if last {
-		a.RemoveFiles()
+
+	ref := *a
+	if uploaded != nil {
+		ref = *uploaded
+	}
+	ref.claimed = true
+	store.List = append(store.List, &ref)
+}
+
+// Remove releases one reference to attachment, files are removed when no other entry references them
+func (store *AttachmentStoreType) Remove(a *Attachment) {
+	store.Mu.Lock()
+	defer store.Mu.Unlock()
+
+	for i, attachment := range store.List {
+		if attachment.ID != a.ID {
+			continue
+		}
+		store.List = append(store.List[:i], store.List[i+1:]...)
+		// File is shared by uploads with the same content and by messages with the same attachment
+		for _, file := range []string{attachment.OriginalPath, attachment.MinifiedPath} {
+			if InUploadDir(file) && !store.referenced(file) {
+				os.Remove(file)
+			}
+		}
+		return
 	}
-	store.Mu.Unlock()
 }
 
 var AttachmentStore = &AttachmentStoreType{
@@ -62,9 +94,62 @@ var AttachmentStore = &AttachmentStoreType{
 	Mu:   sync.Mutex{},
 }
 
-func (a *Attachment) RemoveFiles() {
-	os.Remove(a.OriginalPath)
-	os.Remove(a.MinifiedPath)
+// Referenced returns true if any attachment in store points to file
+func (store *AttachmentStoreType) Referenced(file string) bool {
+	store.Mu.Lock()
+	defer store.Mu.Unlock()
+
+	return store.referenced(file)
+}
+
+func (store *AttachmentStoreType) referenced(file string) bool {
+	file = filepath.Clean(file)
+	for _, a := range store.List {
+		if filepath.Clean(a.OriginalPath) == file || filepath.Clean(a.MinifiedPath) == file {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimAttachments adds references of stored message to its attachments
+func ClaimAttachments(msg *Message) {
+	for _, attachment := range msg.Attachments {
+		AttachmentStore.Claim(attachment)
+	}
+}
+
+// RemoveAttachments releases attachments of removed messages
+func RemoveAttachments(messages []*Message) {
+	for _, message := range messages {
+		for _, attachment := range message.Attachments {
+			AttachmentStore.Remove(attachment)
+		}
+	}
+}
+
+// ClaimFile adds reference of owner other than message (room avatar) to uploaded file.
+// Files outside of upload dir are not tracked.
+func ClaimFile(owner string, file string) {
+	if file == "" || !InUploadDir(file) {
+		return
+	}
+	AttachmentStore.Mu.Lock()
+	AttachmentStore.List = append(AttachmentStore.List, &Attachment{ID: owner, OriginalPath: file, MinifiedPath: file, claimed: true})
+	AttachmentStore.Mu.Unlock()
+}
+
+// ReleaseFile removes reference of owner, file is removed when nothing else references it
+func ReleaseFile(owner string, file string) {
+	if file == "" || !InUploadDir(file) {
+		return
+	}
+	AttachmentStore.Remove(&Attachment{ID: owner})
+}
+
+// Attachment paths came from client, so never touch files outside of upload dir
+func InUploadDir(file string) bool {
+	return filepath.Dir(filepath.Clean(file)) == filepath.Clean(UPLOAD_DIR)
 }
 
 func AttachmentUpload(dir string, fh *multipart.FileHeader) (*Attachment, bool, error) {
@@ -144,14 +229,19 @@ func AttachmentUpload(dir string, fh *multipart.FileHeader) (*Attachment, bool,
 	return attachment, false, nil
 }
 
-// Delete all attachments from upload folder
+// Delete attachments from upload folder which not referenced by any stored message.
+// AttachmentStore must be filled from history before call.
 func AttachmentsCleanup(dir string) error {
 	folder, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return err
 	}
 	for _, d := range folder {
-		os.Remove(path.Join([]string{dir, d.Name()}...))
+		file := path.Join([]string{dir, d.Name()}...)
+		if d.IsDir() || AttachmentStore.Referenced(file) {
+			continue
+		}
+		os.Remove(file)
 	}
 	return nil
 }
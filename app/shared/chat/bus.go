@@ -0,0 +1,34 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Bus delivers encoded messages between sessions by subject (session ID, room ID, user ID, chat.broadcast)
+type Bus interface {
+	// Publish sends data to all current subscribers of subject
+	Publish(subject string, data []byte) error
+	// Subscribe calls handler for each message published to subject.
+	// Handler calls of one subscription are sequential and in publish order.
+	Subscribe(subject string, handler func(data []byte)) (Subscription, error)
+	// Close releases bus, subscriptions stop receiving messages
+	Close() error
+}
+
+// Subscription is returned by Bus.Subscribe
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// ErrBusClosed returned when bus is used after Close
+var ErrBusClosed = errors.New("Bus closed.")
+
+// bus is the message bus used by chat, set in Init
+var bus Bus
+
+// PublishMessage encodes msg and publishes it to subject
+func PublishMessage(to string, msg *Message) error {
+	body, _ := json.Marshal(msg)
+	return bus.Publish(to, body)
+}
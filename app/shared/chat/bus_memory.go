@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"sync"
+)
+
+// MemoryBus delivers messages inside process. Enough for single node and tests, no external server needed.
+type MemoryBus struct {
+	Subscriptions map[string]map[*memorySubscription]bool
+	Mu            sync.Mutex
+	closed        bool
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		Subscriptions: map[string]map[*memorySubscription]bool{},
+		Mu:            sync.Mutex{},
+	}
+}
+
+// memorySubscription queues published data and calls handler from own goroutine,
+// so slow handler not blocks publisher and order is kept
+type memorySubscription struct {
+	bus     *MemoryBus
+	subject string
+	handler func(data []byte)
+	queue   [][]byte
+	mu      sync.Mutex
+	pending chan bool
+	done    chan bool
+	once    sync.Once
+}
+
+func (b *MemoryBus) Publish(subject string, data []byte) error {
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	for sub := range b.Subscriptions[subject] {
+		// Each subscriber gets own copy, publisher may reuse data
+		copied := make([]byte, len(data))
+		copy(copied, data)
+		sub.push(copied)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(subject string, handler func(data []byte)) (Subscription, error) {
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+
+	sub := &memorySubscription{
+		bus:     b,
+		subject: subject,
+		handler: handler,
+		queue:   [][]byte{},
+		pending: make(chan bool, 1),
+		done:    make(chan bool),
+	}
+	if b.Subscriptions[subject] == nil {
+		b.Subscriptions[subject] = map[*memorySubscription]bool{}
+	}
+	b.Subscriptions[subject][sub] = true
+
+	go sub.run()
+
+	return sub, nil
+}
+
+func (b *MemoryBus) Close() error {
+	b.Mu.Lock()
+	subscriptions := b.Subscriptions
+	b.Subscriptions = map[string]map[*memorySubscription]bool{}
+	b.closed = true
+	b.Mu.Unlock()
+
+	for _, subs := range subscriptions {
+		for sub := range subs {
+			sub.stop()
+		}
+	}
+	return nil
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.bus.Mu.Lock()
+	if subs := s.bus.Subscriptions[s.subject]; subs != nil {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(s.bus.Subscriptions, s.subject)
+		}
+	}
+	s.bus.Mu.Unlock()
+
+	s.stop()
+	return nil
+}
+
+func (s *memorySubscription) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *memorySubscription) push(data []byte) {
+	s.mu.Lock()
+	s.queue = append(s.queue, data)
+	s.mu.Unlock()
+
+	// Not block if consumer already notified
+	select {
+	case s.pending <- true:
+	default:
+	}
+}
+
+func (s *memorySubscription) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.pending:
+		}
+
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			data := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.handler(data)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBusOrder(t *testing.T) {
+	b := NewMemoryBus()
+	defer b.Close()
+
+	received := make(chan string, 100)
+	_, err := b.Subscribe("test", func(data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"1", "2", "3", "4", "5"}
+	for _, s := range expected {
+		if err := b.Publish("test", []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range expected {
+		select {
+		case got := <-received:
+			if got != s {
+				t.Errorf("Expected %s, got %s", s, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Message not delivered")
+		}
+	}
+}
+
+func TestMemoryBusUnsubscribe(t *testing.T) {
+	b := NewMemoryBus()
+	defer b.Close()
+
+	received := make(chan string, 100)
+	sub, err := b.Subscribe("test", func(data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := make(chan string, 100)
+	b.Subscribe("other", func(data []byte) {
+		other <- string(data)
+	})
+
+	sub.Unsubscribe()
+	b.Publish("test", []byte("lost"))
+	b.Publish("other", []byte("delivered"))
+
+	select {
+	case got := <-other:
+		if got != "delivered" {
+			t.Errorf("Expected delivered, got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message not delivered")
+	}
+
+	select {
+	case got := <-received:
+		t.Errorf("Message %s delivered after unsubscribe", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBusClosed(t *testing.T) {
+	b := NewMemoryBus()
+	b.Close()
+
+	if err := b.Publish("test", []byte("data")); err != ErrBusClosed {
+		t.Errorf("Expected ErrBusClosed, got %v", err)
+	}
+	if _, err := b.Subscribe("test", func(data []byte) {}); err != ErrBusClosed {
+		t.Errorf("Expected ErrBusClosed, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// NATSBus shares messages between chat nodes connected to the same NATS server
+type NATSBus struct {
+	Conn   *nats.Conn
+	Server *server.Server // Embedded server, stopped on Close
+}
+
+// DialNATS connects to NATS server by url, e.g. nats.DefaultURL
+func DialNATS(url string, options ...nats.Option) (*NATSBus, error) {
+	nc, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &NATSBus{Conn: nc}, nil
+}
+
+func (b *NATSBus) Publish(subject string, data []byte) error {
+	return b.Conn.Publish(subject, data)
+}
+
+// Subscribe uses async NATS subscription, its callbacks are called by one goroutine in order
+func (b *NATSBus) Subscribe(subject string, handler func(data []byte)) (Subscription, error) {
+	return b.Conn.Subscribe(subject, func(m *nats.Msg) {
+		handler(m.Data)
+	})
+}
+
+// Close sends pending messages and disconnects, then stops embedded server if any
+func (b *NATSBus) Close() error {
+	err := b.Conn.Flush()
+	b.Conn.Close()
+	if b.Server != nil {
+		b.Server.Shutdown()
+		b.Server.WaitForShutdown()
+	}
+	return err
+}
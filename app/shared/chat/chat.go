@@ -2,52 +2,59 @@ package chat
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
 	"time"
 
-	"github.com/nats-io/nats.go"
+	"github.com/josephspurrier/gowebapp/app/shared/database"
 )
 
-var nc *nats.Conn
+// Limits below are defaults, Init replaces them with values from Config (config.json Chat section)
 
-const HEART_BEAT_TIMEOUT = 30 * time.Second
+var HEART_BEAT_TIMEOUT = 30 * time.Second
 
 // Restrict message count/per interval
-const FIXED_WINDOW_MAX = 20
-const FIXED_WINDOW_INTERVAL = 10 * time.Second
+var FIXED_WINDOW_MAX = 20
+var FIXED_WINDOW_INTERVAL = 10 * time.Second
 
 // Body of message type = 'room.message' will be truncated to this limit
 // 0 - unlimited
-const MAX_TEXT_MESSAGE_LENGTH = 0
+var MAX_TEXT_MESSAGE_LENGTH = 0
 
 // Private rooms named as user1.UserID() + ":" + user2.UserID + ":" + str(10). UserID is 12bytes in hex representation. 64 is enough, 128 more than enough.
 const MAX_ROOM_NAME_LENGTH = 128
 
+// Room metadata limits (runes), avatar is URL or uploaded file path
+const MAX_ROOM_TOPIC_LENGTH = 256
+const MAX_ROOM_DESCRIPTION_LENGTH = 2048
+const MAX_ROOM_AVATAR_LENGTH = 1024
+
 // Maximum count of users (not Sessions in single room). After that - new client will recieve 'room.overfull' message when try to join
 // 0 - unlimited
-const MAX_ROOM_USERS = 100
+var MAX_ROOM_USERS = 100
 
 // Maximum number of rooms. If exceeded - clietn will recieve 'rooms.max_count' message when try to join to not exists room
 // 0 - unlimited
-const MAX_ROOM_COUNT = 100
+var MAX_ROOM_COUNT = 100
 
 // Maximum number of messages in room history. After that first item from slice will be truncated.
-const MAX_ROOM_HISTORY_MESSAGES = 200
+var MAX_ROOM_HISTORY_MESSAGES = 200
 
 const ROOM_PUBLIC = "public"
 const ROOM_PRIVATE = "private"
 
 // Upload dir.
-// WARNING: AttachmentsCleanup(UPLOAD_DIR) is called on startup, be careful to not delete smthing wrong!
-const UPLOAD_DIR = "static/upload"
+// WARNING: AttachmentsCleanup(UPLOAD_DIR) is called on startup and removes files not used in history, be careful to not delete smthing wrong!
+var UPLOAD_DIR = "static/upload"
 
 // Max uploaded bytes per UPLOAD_QUOTA_RESET
-const UPLOAD_USER_QUOTA = 1024 * 1024 * 100
+var UPLOAD_USER_QUOTA int64 = 1024 * 1024 * 100
 
 // Each interval quota - reseted
-const UPLOAD_QUOTA_RESET_TIMEOUT = 15 * time.Minute
+var UPLOAD_QUOTA_RESET_TIMEOUT = 15 * time.Minute
 
 // Dictionary of bad words wich will be replaced by map value or **** if no map value
 var BadWordsDictionary = map[*regexp.Regexp]string{
@@ -58,270 +65,673 @@ var BadWordsDictionary = map[*regexp.Regexp]string{
 
 var DefaultRooms []*Room
 
-func Init() {
-	var err error
-	nc, err = nats.Connect(nats.DefaultURL)
+// cluster shares rooms, members and users with other nodes on the same bus, set in Init
+var cluster *Cluster
+
+// Init validates config and starts chat on message bus: NATSBus for multiple nodes or MemoryBus for single node
+func Init(c Config, b Bus) error {
+	err := c.Validate()
 	if err != nil {
-		log.Fatalf("NATS: failed connect, %v\n", err)
+		return err
+	}
+	c.apply()
+	bus = b
+
+	// Rooms and users of other nodes become visible after state sync
+	cluster = NewCluster(c.NodeID, b)
+	cluster.OnRoomCreated = addClusterRoom
+	cluster.OnRoomDeleted = removeClusterRoom
+	cluster.OnRoomUpdated = updateClusterRoom
+	if err := cluster.Start(); err != nil {
+		return err
+	}
+	if _, local := b.(*MemoryBus); !local {
+		time.Sleep(CLUSTER_SYNC_WAIT)
 	}
 
-	// Create Default Rooms
-	defaultRoom, _ := CreateRoom("default", ROOM_PUBLIC)
-	marvelRoom, _ := CreateRoom("marvel", ROOM_PUBLIC)
-	dcRoom, _ := CreateRoom("dc", ROOM_PUBLIC)
+	History = NewHistoryStorage(database.ReadConfig())
+	if c.JetStream.Enabled {
+		nb, ok := b.(*NATSBus)
+		if !ok {
+			return errors.New("Chat: JetStream needs NATS bus")
+		}
+		History, err = NewJetStreamHistory(nb.Conn, c.JetStream, History)
+		if err != nil {
+			return err
+		}
+	}
+	State = NewStateStorage(database.ReadConfig())
+	Search = NewSearchIndex(database.ReadConfig())
 
-	defaultRoom.Permanent = true
-	marvelRoom.Permanent = true
-	dcRoom.Permanent = true
+	// Webhooks of all nodes are known to each node, events are delivered by node where they happen
+	if _, err := LoadWebhooks(b); err != nil {
+		return err
+	}
+	webhooks = NewWebhookDispatcher()
+	webhooks.Start(WEBHOOK_WORKERS)
 
-	DefaultRooms = []*Room{defaultRoom, marvelRoom, dcRoom}
+	// Create Default Rooms
+	DefaultRooms = []*Room{}
+	for _, name := range c.DefaultRooms {
+		room, err := CreateRoom(name, ROOM_PUBLIC, nil, "")
+		if room == nil {
+			return err
+		}
+		room.Permanent = true
+		cluster.AddRoom(room.ClusterRoom())
+		DefaultRooms = append(DefaultRooms, room)
+	}
 
-	// Clean upload folder on startup, because anyway we lose chat history on restart
+	// Restore attachments of stored messages, then remove files not referenced by history.
+	// Not permanent rooms not survive restart, so their history dropped. Room streams are shared by nodes
+	// and room can live on node not synced yet, so they are removed by room delete only.
+	// Bolt index survives restart, other indexes are rebuilt from history. Messages are indexed after Walk,
+	// because Bolt history walks in read transaction and index write transaction must not be opened inside it.
+	_, shared := History.(*JetStreamHistory)
+	rebuild := true
+	if idx, ok := Search.(*BoltSearchIndex); ok {
+		rebuild = !idx.Built()
+	}
+	stale := map[string]bool{}
+	type walked struct {
+		key string
+		msg *Message
+	}
+	indexed := []walked{}
+	err = History.Walk(func(key string, msg *Message) error {
+		if !shared && strings.HasPrefix(key, "room:") && !RoomExists(strings.TrimPrefix(key, "room:")) {
+			stale[key] = true
+			return nil
+		}
+		ClaimAttachments(msg)
+		if rebuild {
+			indexed = append(indexed, walked{key, msg})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Chat: failed to load attachments from history. %s\n", err)
+	}
+	for _, w := range indexed {
+		IndexMessage(w.key, w.msg)
+	}
+	for key := range stale {
+		if _, err := History.Drop(key); err != nil {
+			log.Printf("Chat: failed to drop history %s. %s\n", key, err)
+		}
+		if err := Search.Drop(key); err != nil {
+			log.Printf("Chat: failed to drop search index %s. %s\n", key, err)
+		}
+	}
 	err = AttachmentsCleanup(UPLOAD_DIR)
 	if err != nil {
 		fmt.Printf("Failed to cleanup upload folder '%s'. %s\n", UPLOAD_DIR, err)
 	}
+
+	return nil
 }
 
-func PublishMessage(to string, msg *Message) error {
-	body, _ := json.Marshal(msg)
-	return nc.Publish(to, body)
+// Close stops webhook deliveries, leaves cluster and closes bus (embedded NATS server stopped too)
+func Close() error {
+	if webhooks != nil {
+		webhooks.Stop()
+	}
+	if cluster != nil {
+		cluster.Stop()
+	}
+	if bus == nil {
+		return nil
+	}
+	return bus.Close()
 }
 
-func ProcessMessage(msg *Message, session *Session) {
-	switch msg.Type {
-	// Response to each heartbeat too, to avoid httphandler timeout to close session
-	case "heartbeat":
-		PublishMessage(session.ID, MessageHearbeat(session))
-	// Return list of default rooms in response to 'rooms'
-	case "rooms":
-		PublishMessage(session.ID, MessageRoomList(session))
-	// Assign client to existed or new room
-	case "room.create":
-		if !ValidateRoomName(msg.To.Name) {
-			PublishMessage(session.ID, MessageRoomBadName(session))
-			break
-		}
-		// If room limit is set - validate
-		if MAX_ROOM_COUNT > 0 && RoomCount() >= MAX_ROOM_COUNT {
-			PublishMessage(session.ID, MessageRoomsMaxCount(session))
-			break
-		}
+func init() {
+	RegisterHandler("heartbeat", HandlerFunc(handleHeartbeat))
+	RegisterHandler("rooms", HandlerFunc(handleRooms))
+	RegisterHandler("room.create", HandlerFunc(handleRoomCreate), CheckRoomName)
+	RegisterHandler("room.join", HandlerFunc(handleRoomJoin), CheckRoomName, RequireRoom)
+	RegisterHandler("room.leave", HandlerFunc(handleRoomLeave), CheckRoomName, RequireRoom, RequireRoomMember)
+	RegisterHandler("room.update", HandlerFunc(handleRoomUpdate), RequireRoom, RequireRoomModerator)
+	RegisterHandler("room.invite", HandlerFunc(handleRoomInvite), RequireRoom, RequireRoomMember)
+	for _, mtype := range []string{"room.kick", "room.ban", "room.unban", "room.promote"} {
+		RegisterHandler(mtype, HandlerFunc(handleRoomModeration), RequireRoom)
+	}
+	RegisterHandler("room.users", HandlerFunc(handleRoomUsers), RequireRoom, RequireRoomMember)
+	RegisterHandler("room.message", HandlerFunc(handleRoomMessage),
+		SlashCommands, CheckRoomName, RequireRoom, RequireRoomMember, Stamp, FilterContent, RateLimit)
+	RegisterHandler("room.thread", HandlerFunc(handleRoomThread), CheckRoomName, RequireRoom, RequireRoomMember)
+	RegisterHandler("room.replay", HandlerFunc(handleRoomReplay), CheckRoomName, RequireRoom, RequireRoomMember)
+	for _, mtype := range []string{"room.message.edit", "room.message.delete"} {
+		RegisterHandler(mtype, HandlerFunc(handleRoomMessageEdit), CheckRoomName, RequireRoom, RequireRoomMember, FilterContent)
+	}
+	RegisterHandler("private.message", HandlerFunc(handlePrivateMessage),
+		SlashCommands, RequirePeer, FilterContent, SkipMuted, Stamp, RateLimit)
+	for _, mtype := range []string{"private.message.edit", "private.message.delete"} {
+		RegisterHandler(mtype, HandlerFunc(handlePrivateMessageEdit), RequirePeer, FilterContent)
+	}
+	for _, mtype := range []string{"message.react", "message.unreact"} {
+		RegisterHandler(mtype, HandlerFunc(handleReaction))
+	}
+	for _, mtype := range []string{"typing.start", "typing.stop"} {
+		RegisterHandler(mtype, HandlerFunc(handleTyping))
+	}
+	RegisterHandler("private.read", HandlerFunc(handlePrivateRead), RequirePeer)
+	RegisterHandler("presence.set", HandlerFunc(handlePresenceSet))
+	RegisterHandler("presence.get", HandlerFunc(handlePresenceGet), RequirePeer)
+	RegisterHandler("mute", HandlerFunc(handleMute), RequirePeer, FilterContent)
+	RegisterHandler("unmute", HandlerFunc(handleUnmute), RequirePeer, FilterContent)
+	RegisterHandler("private.request", HandlerFunc(handlePrivateRequest), RequirePeer, FilterContent)
+	RegisterHandler("private.history", HandlerFunc(handlePrivateHistory), RequirePeer, FilterContent)
+	RegisterHandler("search", HandlerFunc(handleSearch))
+	RegisterHandler("webhook.add", HandlerFunc(handleWebhookAdd), RequireRoom, RequireRoomOwner)
+	RegisterHandler("webhook.remove", HandlerFunc(handleWebhookRemove), RequireRoom, RequireRoomOwner)
+	RegisterHandler("webhook.list", HandlerFunc(handleWebhookList), RequireRoom, RequireRoomOwner)
+}
 
-		room, err := CreateRoom(msg.To.Name, ROOM_PUBLIC)
-		if err != nil {
-			if _, ok := err.(*RoomSubscriptionError); ok {
-				PublishMessage(session.ID, MessageRoomBadName(session))
-				break
-			}
-			if _, ok := err.(*RoomAlreadyExistsError); ok {
-				PublishMessage(session.ID, MessageRoomAlreadyExists(session, room))
-				break
-			}
-		}
-	case "room.join":
-		if !ValidateRoomName(msg.To.Name) {
-			PublishMessage(session.ID, MessageRoomBadName(session))
-			break
-		}
+// Response to each heartbeat too, to avoid httphandler timeout to close session
+func handleHeartbeat(c *Context) {
+	PublishMessage(c.Session.ID, MessageHearbeat(c.Session))
+}
 
-		room, err := GetRoomByID(msg.To.ID)
-		if err != nil {
-			PublishMessage(session.ID, MessageRoomNotFound(session))
-			break
-		}
+// Return list of default rooms in response to 'rooms'
+func handleRooms(c *Context) {
+	PublishMessage(c.Session.ID, MessageRoomList(c.Session))
+}
 
-		// If user limit per room is set - validate
-		if !room.HasUser(session.User) && room.MaxUsers > 0 && room.UserCount() >= MAX_ROOM_USERS {
-			PublishMessage(session.ID, MessageRoomFull(session, room))
-			break
-		}
+// Assign client to existed or new room.
+// Body {"private": true} creates invite only room not shown in room list, {"password": "..."} creates protected room.
+func handleRoomCreate(c *Context) {
+	msg, session := c.Msg, c.Session
 
-		err = JoinRoom(room, session, true)
-		if err != nil {
+	// If room limit is set - validate
+	if MAX_ROOM_COUNT > 0 && TotalRoomCount() >= MAX_ROOM_COUNT {
+		PublishMessage(session.ID, MessageRoomsMaxCount(session))
+		return
+	}
+
+	options := struct {
+		Private  bool   `json:"private"`
+		Password string `json:"password"`
+	}{}
+	if msg.Body != "" {
+		json.Unmarshal([]byte(msg.Body), &options)
+	}
+	rtype := ROOM_PUBLIC
+	if options.Private {
+		rtype = ROOM_PRIVATE
+	}
+
+	room, err := CreateRoom(msg.To.Name, rtype, session.User, options.Password)
+	if err != nil {
+		if _, ok := err.(*RoomSubscriptionError); ok {
 			PublishMessage(session.ID, MessageRoomBadName(session))
-			DeleteRoom(room)
+			return
 		}
-	// Remome client session from room
-	case "room.leave":
-		if !ValidateRoomName(msg.To.Name) {
-			PublishMessage(session.ID, MessageRoomBadName(session))
-			break
+		if _, ok := err.(*RoomAlreadyExistsError); ok {
+			PublishMessage(session.ID, MessageRoomAlreadyExists(session, room))
+			return
 		}
+		log.Println("Chat: failed to create room.", err)
+		return
+	}
+	// Public room broadcasted to all, private one is known to creator only
+	if room.Type == ROOM_PRIVATE {
+		PublishMessage(session.ID, MessageNewRoomCreated(room))
+	}
+	EmitWebhook(WEBHOOK_EVENT_ROOM_CREATED, room, session.User, nil)
+}
 
-		room, err := GetRoomByID(msg.To.ID)
-		if err != nil {
-			PublishMessage(session.ID, MessageRoomNotFound(session))
+func handleRoomJoin(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	// Password of protected room in body {"password": "..."}
+	access := struct {
+		Password string `json:"password"`
+	}{}
+	json.Unmarshal([]byte(msg.Body), &access)
+	err := room.CheckAccess(session.User, access.Password)
+	if _, ok := err.(*RoomInviteRequiredError); ok {
+		PublishMessage(session.ID, MessageRoomInviteRequired(session, room))
+		return
+	}
+	if _, ok := err.(*RoomPasswordError); ok {
+		PublishMessage(session.ID, MessageRoomBadPassword(session, room))
+		return
+	}
+
+	// If user limit per room is set - validate
+	if !cluster.IsMember(room.ID, session.User.ID) && room.MaxUsers > 0 && room.UserCount() >= MAX_ROOM_USERS {
+		PublishMessage(session.ID, MessageRoomFull(session, room))
+		return
+	}
+
+	err = JoinRoom(room, session, true)
+	if _, ok := err.(*RoomBannedError); ok {
+		PublishMessage(session.ID, MessageRoomBanned(session, room))
+		return
+	}
+	if err != nil {
+		PublishMessage(session.ID, MessageRoomBadName(session))
+		DeleteRoom(room)
+	}
+}
+
+// Remome client session from room
+func handleRoomLeave(c *Context) {
+	c.Room.Leave(c.Session, true)
+}
+
+// Owner or moderator changes room metadata, body {"topic": ..., "description": ..., "avatar": ...}, missed fields not changed.
+// Public room change sent to 'chat.broadcast' (members receive it there too), private room change sent to members.
+func handleRoomUpdate(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	change := struct {
+		Topic       *string `json:"topic"`
+		Description *string `json:"description"`
+		Avatar      *string `json:"avatar"`
+	}{}
+	if err := json.Unmarshal([]byte(msg.Body), &change); err != nil {
+		PublishMessage(session.ID, MessageRoomBadMeta(session, room, err))
+		return
+	}
+	meta := room.GetMeta()
+	if change.Topic != nil {
+		meta.Topic = *change.Topic
+	}
+	if change.Description != nil {
+		meta.Description = *change.Description
+	}
+	if change.Avatar != nil {
+		meta.Avatar = *change.Avatar
+	}
+	if err := ValidateRoomMeta(&meta); err != nil {
+		PublishMessage(session.ID, MessageRoomBadMeta(session, room, err))
+		return
+	}
+
+	room.SetMeta(meta)
+	if room.Type == ROOM_PUBLIC {
+		PublishMessage("chat.broadcast", MessageRoomUpdated(session, room))
+	} else {
+		PublishMessage(room.ID, MessageRoomUpdated(session, room))
+	}
+}
+
+// Room member invites user from body {"user": ID}, invited user can join private room and skip password
+func handleRoomInvite(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	request := struct {
+		User string `json:"user"`
+	}{}
+	json.Unmarshal([]byte(msg.Body), &request)
+	if !UserExists(request.User) {
+		PublishMessage(session.ID, MessageUserNotFound(session, MessageUser{ID: request.User}))
+		return
+	}
+	target := GetUser(request.User, "")
+	if room.IsBanned(target) {
+		PublishMessage(session.ID, MessageRoomForbidden(session, room))
+		return
+	}
+
+	cluster.SetInvited(room.ID, target.ID, true)
+	PublishMessage(target.ID, MessagePrivateInvite(session, room, target))
+}
+
+// Moderation, body {"user": target user ID}, for 'room.promote' {"user": ID, "role": "moderator" or "member"}.
+// Kick and ban remove target sessions on all nodes from room, event broadcasted to room.
+func handleRoomModeration(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	request := struct {
+		User string `json:"user"`
+		Role string `json:"role"`
+	}{}
+	json.Unmarshal([]byte(msg.Body), &request)
+	if request.User == "" || request.User == session.User.ID {
+		PublishMessage(session.ID, MessageRoomForbidden(session, room))
+		return
+	}
+	// Don't create users from client supplied IDs. Banned user may be offline everywhere, so unban by room data.
+	var target *User
+	if UserExists(request.User) {
+		target = GetUser(request.User, "")
+	} else if msg.Type == "room.unban" && cluster.IsBanned(room.ID, request.User) {
+		target = &User{ID: request.User}
+	} else {
+		PublishMessage(session.ID, MessageUserNotFound(session, MessageUser{ID: request.User}))
+		return
+	}
+
+	switch msg.Type {
+	case "room.kick":
+		if !room.CanModerate(session.User, target.ID) {
+			PublishMessage(session.ID, MessageRoomForbidden(session, room))
 			break
 		}
-
-		if !room.HasUser(session.User) {
+		if !cluster.IsMember(room.ID, target.ID) {
 			PublishMessage(session.ID, MessageUserNotInRoom(session, room))
 			break
 		}
-		room.Leave(session, true)
-	// Return list of user in room
-	case "room.users":
-		if !RoomExistsByID(msg.To.ID) {
-			PublishMessage(session.ID, MessageRoomNotFound(session))
+		PublishMessage(room.ID, MessageRoomModeration(msg.Type, session, room, target, ""))
+	case "room.ban", "room.unban":
+		if !room.CanModerate(session.User, target.ID) {
+			PublishMessage(session.ID, MessageRoomForbidden(session, room))
 			break
 		}
-
-		room, err := GetRoomByID(msg.To.ID)
-		if err != nil {
-			PublishMessage(session.ID, MessageRoomNotFound(session))
-			break
+		cluster.SetBanned(room.ID, target.ID, msg.Type == "room.ban")
+		moderation := MessageRoomModeration(msg.Type, session, room, target, "")
+		PublishMessage(room.ID, moderation)
+		// Banned user not in room anymore, so notify directly about unban
+		if msg.Type == "room.unban" {
+			PublishMessage(target.ID, moderation)
 		}
-
-		if !room.HasUser(session.User) {
-			PublishMessage(session.ID, MessageUserNotInRoom(session, room))
-			break
+	case "room.promote":
+		if request.Role == "" {
+			request.Role = ROLE_MODERATOR
 		}
-
-		PublishMessage(session.ID, MessageRoomUsers(session, room))
-	// Process text messages inside room
-	//
-	case "room.message":
-		if !ValidateRoomName(msg.To.Name) {
-			PublishMessage(session.ID, MessageRoomBadName(session))
+		if room.Role(session.User) != ROLE_OWNER || (request.Role != ROLE_MODERATOR && request.Role != ROLE_MEMBER) {
+			PublishMessage(session.ID, MessageRoomForbidden(session, room))
 			break
 		}
+		cluster.SetRole(room.ID, target.ID, request.Role)
+		PublishMessage(room.ID, MessageRoomModeration(msg.Type, session, room, target, request.Role))
+	}
+}
 
-		room, err := GetRoomByID(msg.To.ID)
+// Return list of user in room
+func handleRoomUsers(c *Context) {
+	PublishMessage(c.Session.ID, MessageRoomUsers(c.Session, c.Room))
+}
+
+// Process text messages inside room, message is already stamped, filtered and counted by middleware
+func handleRoomMessage(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	// Check all attachments exists
+	StripMissingAttachments(msg)
+
+	// Thread reply must point to existed message
+	if msg.ParentID != "" {
+		parent, err := GetThreadParent(room, msg.ParentID)
 		if err != nil {
-			PublishMessage(session.ID, MessageRoomNotFound(session))
-			break
+			PublishMessage(session.ID, MessageNotFound(session, &Message{ID: msg.ParentID, To: msg.To}))
+			return
 		}
+		msg.ParentID = parent.ID
+	}
 
+	// save in history first, stream position (JetStream history) is sent to clients
+	AddToHistory(room, msg)
+	PublishMessage(room.ID, msg)
+	if msg.ParentID != "" {
+		AddThreadReply(room, msg)
+	}
+	EmitWebhook(WEBHOOK_EVENT_MESSAGE, room, session.User, msg)
+}
+
+// Return thread messages, msg.ID is thread parent message
+func handleRoomThread(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	parent, replies, err := GetRoomThread(room, msg.ID, session.User)
+	if err != nil {
+		PublishMessage(session.ID, MessageNotFound(session, msg))
+		return
+	}
+	PublishMessage(session.ID, MessageRoomThread(session, room, parent, replies))
+}
+
+// Return stored revisions after stream position, body {"seq": stream_seq} or {"since": timestamp}
+func handleRoomReplay(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	streams, ok := History.(*JetStreamHistory)
+	if !ok {
+		PublishMessage(session.ID, MessageRoomReplayUnavailable(session, room))
+		return
+	}
+
+	request := struct {
+		Seq   uint64    `json:"seq"`
+		Since time.Time `json:"since"`
+	}{}
+	if msg.Body != "" {
+		json.Unmarshal([]byte(msg.Body), &request)
+	}
+
+	replay, err := streams.Replay(RoomHistoryKey(room), request.Seq, request.Since, ROOM_REPLAY_LIMIT)
+	if err != nil {
+		log.Println("Chat: failed to replay room.", err)
+		return
+	}
+	replay.Messages = FilterMuted(replay.Messages, session.User)
+	PublishMessage(session.ID, MessageRoomReplay(session, room, replay))
+}
+
+// Change or remove own message in room, msg.ID is target message
+func handleRoomMessageEdit(c *Context) {
+	EditMessage(c.Session, c.Room, RoomHistoryKey(c.Room), c.Msg, c.Room.ID)
+}
+
+// Private text message, message is already stamped, filtered and counted by middleware
+func handlePrivateMessage(c *Context) {
+	msg, session, to := c.Msg, c.Session, c.Peer
+
+	// Threads only in rooms
+	msg.ParentID = ""
+
+	// Check all attachments exists
+	StripMissingAttachments(msg)
+
+	// Log private history
+	AddToPrivateHistory(session.User, to, msg)
+	session.User.AddPeer(to)
+	PublishMessage(msg.To.ID, msg)
+	PublishMessage(session.User.ID, MessagePrivateDelivered(session, msg, msg.To))
+}
+
+// Change or remove own private message, msg.ID is target message
+func handlePrivateMessageEdit(c *Context) {
+	EditMessage(c.Session, nil, PrivateHistoryKey(c.Session.User, c.Peer), c.Msg, c.Peer.ID, c.Session.User.ID)
+}
+
+// Add or remove reaction on stored message, msg.To is room or private chat user, msg.ID is target message
+func handleReaction(c *Context) {
+	msg, session := c.Msg, c.Session
+
+	if room, err := GetRoomByID(msg.To.ID); err == nil {
 		if !room.HasUser(session.User) {
 			PublishMessage(session.ID, MessageUserNotInRoom(session, room))
-			break
+			return
 		}
+		ReactMessage(session, RoomHistoryKey(room), msg, room.ID)
+		return
+	}
 
-		// Force set message from to session data, to prevent message fake
-		msg.From = MessageUser{
-			ID:   session.User.ID,
-			Name: session.User.Name,
-		}
+	RequirePeer(SkipMuted(HandlerFunc(func(c *Context) {
+		ReactMessage(c.Session, PrivateHistoryKey(c.Session.User, c.Peer), c.Msg, c.Peer.ID, c.Session.User.ID)
+	}))).Handle(c)
+}
 
-		// Set timestamp on message before route to room
-		msg.Timestamp = time.Now()
+// Typing indicator in room or private chat, not stored in history
+func handleTyping(c *Context) {
+	msg, session := c.Msg, c.Session
 
-		if !ValidateMessage(msg, session) {
-			break
-		}
+	if !session.User.AllowTyping() {
+		return
+	}
 
-		// Check all attachments exists
-		StripMissingAttachments(msg)
-
-		// Check user spam to fast
-		session.User.FixedWindowCounterMu.Lock()
-		if session.User.FixedWindowCounter <= FIXED_WINDOW_MAX {
-			session.User.FixedWindowCounter++
-			PublishMessage(room.ID, msg)
-			// save in history
-			AddToHistory(room, msg)
-		} else {
-			PublishMessage(session.ID, MessageToManyRequests(session, msg.To))
+	subject := ""
+	to := MessageUser{}
+	if room, err := GetRoomByID(msg.To.ID); err == nil {
+		if !room.HasUser(session.User) {
+			PublishMessage(session.ID, MessageUserNotInRoom(session, room))
+			return
 		}
-		session.User.FixedWindowCounterMu.Unlock()
-	case "private.message":
+		subject = room.ID
+		to = MessageUser{ID: room.ID, Name: room.Name}
+	} else {
 		if !UserExists(msg.To.ID) {
 			PublishMessage(session.ID, MessageUserNotFound(session, msg.To))
-			break
+			return
 		}
-		if !ValidateMessage(msg, session) {
-			break
+		peer := GetUser(msg.To.ID, "")
+		if check, _ := peer.CheckInMute(session.User); check == true {
+			return
 		}
+		subject = peer.ID
+		to = MessageUser{ID: peer.ID, Name: peer.Name}
+	}
 
-		// User try pm to muted user (unmute first!)
-		to := GetUser(msg.To.ID, "")
-		if check, _ := session.User.CheckInMute(to); check == true {
-			break
-		}
-		// Disable ability to recieve pm calls from muted
-		if check, _ := to.CheckInMute(session.User); check == true {
-			break
-		}
+	if msg.Type == "typing.start" {
+		StartTyping(session.User, subject, to)
+	} else {
+		StopTyping(session.User, subject, to)
+	}
+}
 
-		// Force set message from to session data, to prevent message fake
-		msg.From = MessageUser{
-			ID:   session.User.ID,
-			Name: session.User.Name,
+// Recipient read private messages up to message msg.ID (or msg.Timestamp if id not set)
+func handlePrivateRead(c *Context) {
+	msg, session, peer := c.Msg, c.Session, c.Peer
+
+	until := msg.Timestamp
+	if msg.ID != "" {
+		read, err := History.Get(PrivateHistoryKey(session.User, peer), msg.ID)
+		if err != nil {
+			PublishMessage(session.ID, MessageNotFound(session, msg))
+			return
 		}
+		until = read.Timestamp
+	}
 
-		// Set timestamp on message before route to room
-		msg.Timestamp = time.Now()
+	if !MarkRead(session.User, peer, until) {
+		return
+	}
+	// Notify sender and other sessions of reader
+	receipt := MessagePrivateRead(session.User, peer, until)
+	PublishMessage(peer.ID, receipt)
+	PublishMessage(session.User.ID, receipt)
+}
 
-		// Check all attachments exists
-		StripMissingAttachments(msg)
+// Explicit user state, body is 'online' or 'away'
+func handlePresenceSet(c *Context) {
+	if !ValidatePresence(c.Msg.Body) {
+		return
+	}
+	c.Session.User.SetPresence(c.Msg.Body)
+}
 
-		// Log private history
-		history := PrivateHistoryStore.Get(session.User, to)
-		history.Add(msg)
+// Return current state of user from msg.To
+func handlePresenceGet(c *Context) {
+	PublishMessage(c.Session.ID, MessagePresence(c.Peer))
+}
 
-		// Check user spam to fast
-		session.User.FixedWindowCounterMu.Lock()
-		if session.User.FixedWindowCounter <= FIXED_WINDOW_MAX {
-			session.User.FixedWindowCounter++
-			PublishMessage(msg.To.ID, msg)
-			PublishMessage(session.User.ID, MessagePrivateDelivered(session, msg, msg.To))
-		} else {
-			PublishMessage(session.ID, MessageToManyRequests(session, msg.To))
-		}
-		session.User.FixedWindowCounterMu.Unlock()
-	case "mute":
-		if !UserExists(msg.To.ID) {
-			PublishMessage(session.ID, MessageUserNotFound(session, msg.To))
-			break
-		}
-		if !ValidateMessage(msg, session) {
-			break
-		}
-		target := GetUser(msg.To.ID, "")
-		session.User.AddToMute(target)
-		PublishMessage(session.User.ID, MessageUserMuted(session, target))
-		PublishMessage(target.ID, MessageUserMutedBy(target, session.User))
-	case "unmute":
-		if !UserExists(msg.To.ID) {
-			PublishMessage(session.ID, MessageUserNotFound(session, msg.To))
-			break
-		}
-		if !ValidateMessage(msg, session) {
-			break
-		}
-		target := GetUser(msg.To.ID, "")
-		session.User.RemoveFromMute(target)
-		PublishMessage(session.User.ID, MessageUserUnmuted(session, target))
-		PublishMessage(target.ID, MessageUserUnmutedBy(target, session.User))
+func handleMute(c *Context) {
+	session, target := c.Session, c.Peer
 
-	case "private.request":
-		if !UserExists(msg.To.ID) {
-			PublishMessage(session.ID, MessageUserNotFound(session, msg.To))
-			break
-		}
-		if !ValidateMessage(msg, session) {
-			break
-		}
-		// User try pm to muted user (unmute first!)
-		to := GetUser(msg.To.ID, "")
-		if check, _ := session.User.CheckInMute(to); check == true {
-			break
-		}
-		PublishMessage(session.User.ID, MessagePrivateCreated(session, to))
-	case "private.history":
-		if !UserExists(msg.To.ID) {
-			PublishMessage(session.ID, MessageUserNotFound(session, msg.To))
-			break
-		}
-		if !ValidateMessage(msg, session) {
-			break
-		}
+	session.User.AddToMute(target)
+	PublishMessage(session.User.ID, MessageUserMuted(session, target))
+	PublishMessage(target.ID, MessageUserMutedBy(target, session.User))
+}
 
-		to := GetUser(msg.To.ID, "")
+func handleUnmute(c *Context) {
+	session, target := c.Session, c.Peer
 
-		history := PrivateHistoryStore.Get(session.User, to)
-		PublishMessage(session.ID, MessagePrivateHistory(session, history, to))
+	session.User.RemoveFromMute(target)
+	PublishMessage(session.User.ID, MessageUserUnmuted(session, target))
+	PublishMessage(target.ID, MessageUserUnmutedBy(target, session.User))
+}
+
+func handlePrivateRequest(c *Context) {
+	session, to := c.Session, c.Peer
 
+	// User try pm to muted user (unmute first!)
+	if check, _ := session.User.CheckInMute(to); check == true {
+		return
 	}
+	session.User.AddPeer(to)
+	PublishMessage(session.User.ID, MessagePrivateCreated(session, to))
+}
+
+func handlePrivateHistory(c *Context) {
+	msg, session, to := c.Msg, c.Session, c.Peer
+
+	// Optional body {"before": timestamp} requests older page
+	request := struct {
+		Before time.Time `json:"before"`
+	}{}
+	if msg.Body != "" {
+		json.Unmarshal([]byte(msg.Body), &request)
+	}
+
+	page := GetPrivateHistory(session.User, to, request.Before)
+	PublishMessage(session.ID, MessagePrivateHistory(session, page, to))
+}
+
+// Search stored room and private messages visible for user, body is SearchQuery
+func handleSearch(c *Context) {
+	msg, session := c.Msg, c.Session
+
+	query := &SearchQuery{}
+	if err := json.Unmarshal([]byte(msg.Body), query); err != nil {
+		PublishMessage(session.ID, MessageSearchBadQuery(session, err))
+		return
+	}
+
+	messages, err := SearchMessages(session.User, query)
+	if err != nil {
+		PublishMessage(session.ID, MessageSearchBadQuery(session, err))
+		return
+	}
+	PublishMessage(session.ID, MessageSearchResults(session, &SearchResult{Query: query, Messages: messages}))
+}
+
+// Register webhook of room, body {"url": "...", "events": ["message", ...]}, empty events - all.
+// Response has webhook secret, it is not shown again.
+func handleWebhookAdd(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	request := struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}{}
+	json.Unmarshal([]byte(msg.Body), &request)
+
+	hook, err := AddWebhook(room.ID, request.URL, request.Events, session.User.ID)
+	if err != nil {
+		PublishMessage(session.ID, MessageWebhookError(session, room, err))
+		return
+	}
+	PublishMessage(session.ID, MessageWebhookAdded(session, room, hook))
+}
+
+// Remove webhook of room, body {"id": "..."}
+func handleWebhookRemove(c *Context) {
+	msg, session, room := c.Msg, c.Session, c.Room
+
+	request := struct {
+		ID string `json:"id"`
+	}{}
+	json.Unmarshal([]byte(msg.Body), &request)
+
+	hook, err := GetWebhook(request.ID)
+	if err == nil && hook.RoomID != room.ID {
+		err = ErrWebhookNotFound
+	}
+	if err == nil {
+		err = RemoveWebhook(hook.ID)
+	}
+	if err != nil {
+		PublishMessage(session.ID, MessageWebhookError(session, room, err))
+		return
+	}
+	PublishMessage(session.ID, MessageWebhookRemoved(session, room, hook))
+}
+
+// Return webhooks of room and their recent deliveries on this node
+func handleWebhookList(c *Context) {
+	PublishMessage(c.Session.ID, MessageWebhookList(c.Session, c.Room, Webhooks(c.Room.ID), WebhookDeliveries(c.Room.ID)))
 }
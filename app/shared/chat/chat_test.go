@@ -0,0 +1,831 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Chat runs on memory bus and memory storages, no NATS server or database needed
+	err := Init(DefaultConfig(), NewMemoryBus())
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// waitMessage drains session until message of type received
+func waitMessage(t *testing.T, s *Session, mtype string) *Message {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		for _, m := range s.Drain() {
+			if m.Type == mtype {
+				return m
+			}
+		}
+		select {
+		case <-s.BufferAvailable:
+		case <-timeout:
+			t.Fatalf("Message %s not received by session %s", mtype, s.ID)
+			return nil
+		}
+	}
+}
+
+func TestRoomMessage(t *testing.T) {
+	alice := GetUser("room-alice", "Alice")
+	bob := GetUser("room-bob", "Bob")
+	s1 := alice.NewSession()
+	s2 := bob.NewSession()
+	defer alice.DeleteSession(s1)
+	defer bob.DeleteSession(s2)
+
+	room, err := GetRoom("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := MessageUser{ID: room.ID, Name: room.Name}
+
+	ProcessMessage(&Message{Type: "room.join", To: to}, s1)
+	waitMessage(t, s1, "room.join")
+	ProcessMessage(&Message{Type: "room.join", To: to}, s2)
+	waitMessage(t, s2, "room.join")
+
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "hello"}, s1)
+
+	m := waitMessage(t, s2, "room.message")
+	if m.Body != "hello" {
+		t.Errorf("Expected body hello, got %s", m.Body)
+	}
+	if m.From.ID != alice.ID {
+		t.Errorf("Expected message from %s, got %s", alice.ID, m.From.ID)
+	}
+	if m.ID == "" {
+		t.Error("Message ID not set")
+	}
+}
+
+func TestPrivateMessage(t *testing.T) {
+	alice := GetUser("private-alice", "Alice")
+	bob := GetUser("private-bob", "Bob")
+	s1 := alice.NewSession()
+	s2 := bob.NewSession()
+	defer alice.DeleteSession(s1)
+	defer bob.DeleteSession(s2)
+
+	ProcessMessage(&Message{Type: "private.message", To: MessageUser{ID: bob.ID}, Body: "hi"}, s1)
+
+	m := waitMessage(t, s2, "private.message")
+	if m.Body != "hi" {
+		t.Errorf("Expected body hi, got %s", m.Body)
+	}
+	waitMessage(t, s1, "private.delivered")
+}
+
+func TestMessageEdit(t *testing.T) {
+	alice := GetUser("edit-alice", "Alice")
+	bob := GetUser("edit-bob", "Bob")
+	sa := alice.NewSession()
+	sb := bob.NewSession()
+	defer alice.DeleteSession(sa)
+	defer bob.DeleteSession(sb)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "edit-room"}}, sa)
+	to := MessageUser{ID: RoomID("edit-room"), Name: "edit-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	for _, s := range []*Session{sa, sb} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "typo"}, sa)
+	m := waitMessage(t, sb, "room.message")
+
+	// Only author edits
+	ProcessMessage(&Message{Type: "room.message.edit", To: to, ID: m.ID, Body: "hacked"}, sb)
+	waitMessage(t, sb, "message.forbidden")
+	ProcessMessage(&Message{Type: "room.message.delete", To: to, ID: m.ID}, sb)
+	waitMessage(t, sb, "message.forbidden")
+	ProcessMessage(&Message{Type: "room.message.edit", To: to, ID: "no-such-id", Body: "fixed"}, sa)
+	waitMessage(t, sa, "message.not_found")
+
+	ProcessMessage(&Message{Type: "room.message.edit", To: to, ID: m.ID, Body: "fixed"}, sa)
+	if edited := waitMessage(t, sb, "room.message.edit"); edited.ID != m.ID || edited.Body != "fixed" || edited.EditedAt == nil {
+		t.Errorf("Expected edited message, got %+v", edited)
+	}
+	room, _ := GetRoomByID(to.ID)
+	if stored, err := History.Get(RoomHistoryKey(room), m.ID); err != nil || stored.Body != "fixed" {
+		t.Errorf("Edit not stored, got %+v. %v", stored, err)
+	}
+
+	// Edit without text ignored, attachments of edit not used
+	ProcessMessage(&Message{Type: "room.message.edit", To: to, ID: m.ID, Attachments: []*Attachment{{ID: "edit-upload"}}}, sa)
+	if stored, err := History.Get(RoomHistoryKey(room), m.ID); err != nil || stored.Body != "fixed" {
+		t.Errorf("Empty edit changed message, got %+v. %v", stored, err)
+	}
+
+	ProcessMessage(&Message{Type: "room.message.delete", To: to, ID: m.ID}, sa)
+	if deleted := waitMessage(t, sb, "room.message.delete"); deleted.ID != m.ID || deleted.Body != "" || !deleted.Deleted {
+		t.Errorf("Expected deleted message, got %+v", deleted)
+	}
+	ProcessMessage(&Message{Type: "room.message.edit", To: to, ID: m.ID, Body: "again"}, sa)
+	waitMessage(t, sa, "message.not_found")
+
+	// Private message changed for both users
+	ProcessMessage(&Message{Type: "private.message", To: MessageUser{ID: bob.ID}, Body: "secret"}, sa)
+	m = waitMessage(t, sb, "private.message")
+	ProcessMessage(&Message{Type: "private.message.edit", To: MessageUser{ID: alice.ID}, ID: m.ID, Body: "hacked"}, sb)
+	waitMessage(t, sb, "message.forbidden")
+	ProcessMessage(&Message{Type: "private.message.delete", To: MessageUser{ID: bob.ID}, ID: m.ID}, sa)
+	for _, s := range []*Session{sa, sb} {
+		if deleted := waitMessage(t, s, "private.message.delete"); deleted.ID != m.ID || !deleted.Deleted {
+			t.Errorf("Expected deleted private message, got %+v", deleted)
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	alice := GetUser("resume-alice", "Alice")
+	s := alice.NewSession()
+	defer alice.DeleteSession(s)
+
+	for _, body := range []string{"m1", "m2", "m3"} {
+		s.Push(&Message{Type: "room.message", Body: body})
+	}
+	sent := s.Drain()
+	s.Ack(sent[0].Seq)
+
+	alice.SuspendSession(s)
+	if _, err := alice.GetSession(s.ID); err == nil {
+		t.Error("Suspended session returned by GetSession")
+	}
+	s.Push(&Message{Type: "room.message", Body: "m4"})
+
+	if _, err := alice.ResumeSession("bad token", 0); err == nil {
+		t.Error("Session resumed with bad token")
+	}
+	resumed, err := alice.ResumeSession(s.Token, sent[1].Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != s {
+		t.Fatal("Resumed other session")
+	}
+
+	// m2 acknowledged on resume, m3 not acknowledged, m4 buffered while suspended
+	bodies := []string{}
+	for _, m := range s.Drain() {
+		bodies = append(bodies, m.Body)
+	}
+	if len(bodies) != 2 || bodies[0] != "m3" || bodies[1] != "m4" {
+		t.Errorf("Unexpected messages after resume %v", bodies)
+	}
+	if _, err := alice.GetSession(s.ID); err != nil {
+		t.Error("Resumed session not found")
+	}
+}
+
+func TestSessionResync(t *testing.T) {
+	alice := GetUser("resync-alice", "Alice")
+	s := alice.NewSession()
+	defer alice.DeleteSession(s)
+
+	for i := 0; i < SESSION_REPLAY_SIZE+5; i++ {
+		s.Push(&Message{Type: "room.message", Body: fmt.Sprint(i)})
+	}
+	s.Drain()
+
+	// Dropped not acknowledged messages are not replayed silently
+	replay := s.Replay(0)
+	if len(replay) != SESSION_REPLAY_SIZE+1 || replay[0].Type != "session.resync" || replay[1].Body != "5" {
+		t.Fatalf("Expected resync and last %d messages, got %d", SESSION_REPLAY_SIZE, len(replay))
+	}
+	if replay := s.Replay(replay[0].Seq); len(replay) != SESSION_REPLAY_SIZE || replay[0].Type == "session.resync" {
+		t.Errorf("Resync after lost messages acknowledged")
+	}
+
+	alice.SuspendSession(s)
+	if _, err := alice.ResumeSession(s.Token, 1); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.Drain(); len(m) != SESSION_REPLAY_SIZE+1 || m[0].Type != "session.resync" {
+		t.Errorf("Expected resync on resume, got %d messages", len(m))
+	}
+}
+
+func TestSessionResumeExpired(t *testing.T) {
+	grace := SESSION_RESUME_GRACE
+	SESSION_RESUME_GRACE = 50 * time.Millisecond
+	defer func() { SESSION_RESUME_GRACE = grace }()
+
+	alice := GetUser("expire-alice", "Alice")
+	s := alice.NewSession()
+	alice.SuspendSession(s)
+
+	select {
+	case <-s.Closed:
+	case <-time.After(time.Second):
+		t.Fatal("Suspended session not deleted after grace")
+	}
+	if _, err := alice.ResumeSession(s.Token, 0); err == nil {
+		t.Error("Expired session resumed")
+	}
+}
+
+func TestRoomModeration(t *testing.T) {
+	owner := GetUser("moderation-owner", "Owner")
+	mod := GetUser("moderation-mod", "Mod")
+	member := GetUser("moderation-member", "Member")
+	so := owner.NewSession()
+	sm := mod.NewSession()
+	su := member.NewSession()
+	defer owner.DeleteSession(so)
+	defer mod.DeleteSession(sm)
+	defer member.DeleteSession(su)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "moderation"}}, so)
+	room, err := GetRoom("moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.Role(owner) != ROLE_OWNER {
+		t.Fatalf("Expected owner role, got %s", room.Role(owner))
+	}
+	to := MessageUser{ID: room.ID, Name: room.Name}
+	for _, s := range []*Session{so, sm, su} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+
+	// Members can't moderate, only owner promotes
+	ProcessMessage(&Message{Type: "room.kick", To: to, Body: `{"user":"moderation-mod"}`}, su)
+	waitMessage(t, su, "room.forbidden")
+	ProcessMessage(&Message{Type: "room.promote", To: to, Body: `{"user":"moderation-mod"}`}, so)
+	waitMessage(t, sm, "room.promote")
+	if room.Role(mod) != ROLE_MODERATOR {
+		t.Fatalf("Expected moderator role, got %s", room.Role(mod))
+	}
+	ProcessMessage(&Message{Type: "room.kick", To: to, Body: `{"user":"moderation-owner"}`}, sm)
+	waitMessage(t, sm, "room.forbidden")
+
+	// Kick removes member sessions, member can join again
+	ProcessMessage(&Message{Type: "room.kick", To: to, Body: `{"user":"moderation-member"}`}, sm)
+	waitMessage(t, su, "room.kick")
+	eventually(t, func() bool { return !room.HasUser(member) }, "kicked member left room")
+	ProcessMessage(&Message{Type: "room.join", To: to}, su)
+	waitMessage(t, su, "room.join")
+
+	// Banned member can't join until unban
+	ProcessMessage(&Message{Type: "room.ban", To: to, Body: `{"user":"moderation-member"}`}, sm)
+	waitMessage(t, su, "room.ban")
+	eventually(t, func() bool { return !room.HasUser(member) }, "banned member left room")
+	ProcessMessage(&Message{Type: "room.join", To: to}, su)
+	waitMessage(t, su, "room.banned")
+
+	ProcessMessage(&Message{Type: "room.unban", To: to, Body: `{"user":"moderation-member"}`}, sm)
+	waitMessage(t, su, "room.unban")
+	ProcessMessage(&Message{Type: "room.join", To: to}, su)
+	waitMessage(t, su, "room.join")
+
+	// Unknown user is not created
+	ProcessMessage(&Message{Type: "room.ban", To: to, Body: `{"user":"moderation-ghost"}`}, sm)
+	waitMessage(t, sm, "user.not_found")
+	if UserExists("moderation-ghost") {
+		t.Error("Moderation created unknown user")
+	}
+
+	// Moderator deletes member message, not owner message, and can't edit it
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "spam"}, su)
+	spam := waitMessage(t, sm, "room.message")
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "rules"}, so)
+	rules := waitMessage(t, sm, "room.message")
+	ProcessMessage(&Message{Type: "room.message.edit", To: to, ID: spam.ID, Body: "fixed"}, sm)
+	waitMessage(t, sm, "message.forbidden")
+	ProcessMessage(&Message{Type: "room.message.delete", To: to, ID: rules.ID}, sm)
+	waitMessage(t, sm, "message.forbidden")
+	ProcessMessage(&Message{Type: "room.message.delete", To: to, ID: spam.ID}, sm)
+	if deleted := waitMessage(t, su, "room.message.delete"); deleted.ID != spam.ID || !deleted.Deleted {
+		t.Errorf("Expected deleted member message, got %+v", deleted)
+	}
+}
+
+func TestRoomAccess(t *testing.T) {
+	owner := GetUser("access-owner", "Owner")
+	guest := GetUser("access-guest", "Guest")
+	so := owner.NewSession()
+	sg := guest.NewSession()
+	defer owner.DeleteSession(so)
+	defer guest.DeleteSession(sg)
+
+	// Private room not listed and needs invite, counted by room limit only
+	public, total := RoomCount(), TotalRoomCount()
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "access-private"}, Body: `{"private": true}`}, so)
+	created := waitMessage(t, so, "room.created")
+	if strings.Contains(MessageRoomList(sg).Body, created.From.ID) {
+		t.Error("Private room in room list")
+	}
+	if RoomCount() != public || TotalRoomCount() != total+1 {
+		t.Errorf("Private room counted as public room")
+	}
+	private := MessageUser{ID: RoomID("access-private"), Name: "access-private"}
+	ProcessMessage(&Message{Type: "room.join", To: private}, so)
+	waitMessage(t, so, "room.join")
+
+	ProcessMessage(&Message{Type: "room.join", To: private}, sg)
+	waitMessage(t, sg, "room.invite_required")
+	ProcessMessage(&Message{Type: "room.invite", To: private, Body: `{"user":"access-guest"}`}, so)
+	invite := waitMessage(t, sg, "private.invite")
+	if invite.From.ID != owner.ID || invite.To.ID != guest.ID {
+		t.Errorf("Unexpected invite from %s to %s", invite.From.ID, invite.To.ID)
+	}
+	ProcessMessage(&Message{Type: "room.join", To: private}, sg)
+	waitMessage(t, sg, "room.join")
+
+	// Protected room needs password, hash stored instead of password
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "access-protected"}, Body: `{"password": "secret"}`}, so)
+	protected := MessageUser{ID: RoomID("access-protected"), Name: "access-protected"}
+	eventually(t, func() bool { return RoomExistsByID(protected.ID) }, "protected room created")
+	if cr := cluster.Room(protected.ID); cr == nil || cr.Password == "" || cr.Password == "secret" {
+		t.Error("Room password not hashed")
+	}
+
+	ProcessMessage(&Message{Type: "room.join", To: protected, Body: `{"password": "wrong"}`}, sg)
+	waitMessage(t, sg, "room.bad_password")
+	ProcessMessage(&Message{Type: "room.join", To: protected, Body: `{"password": "secret"}`}, sg)
+	waitMessage(t, sg, "room.join")
+}
+
+func TestRoomUpdate(t *testing.T) {
+	owner := GetUser("meta-owner", "Owner")
+	member := GetUser("meta-member", "Member")
+	so := owner.NewSession()
+	su := member.NewSession()
+	defer owner.DeleteSession(so)
+	defer member.DeleteSession(su)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "meta"}}, so)
+	to := MessageUser{ID: RoomID("meta"), Name: "meta"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	for _, s := range []*Session{so, su} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+
+	ProcessMessage(&Message{Type: "room.update", To: to, Body: `{"topic": "news"}`}, su)
+	waitMessage(t, su, "room.forbidden")
+	ProcessMessage(&Message{Type: "room.update", To: to, Body: `{"avatar": "/etc/passwd"}`}, so)
+	waitMessage(t, so, "room.bad_meta")
+
+	ProcessMessage(&Message{Type: "room.update", To: to, Body: `{"topic": "news", "avatar": "https://example.com/a.png"}`}, so)
+	updated := waitMessage(t, su, "room.updated")
+	meta := RoomMeta{}
+	json.Unmarshal([]byte(updated.Body), &meta)
+	if meta.Topic != "news" || meta.Avatar != "https://example.com/a.png" {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+
+	// Not set fields kept, metadata in room list
+	ProcessMessage(&Message{Type: "room.update", To: to, Body: `{"description": "daily news"}`}, so)
+	waitMessage(t, su, "room.updated")
+	list := MessageRoomList(su).Body
+	if !strings.Contains(list, `"topic":"news"`) || !strings.Contains(list, `"description":"daily news"`) {
+		t.Errorf("Metadata not in room list %s", list)
+	}
+}
+
+func TestRoomAvatarReference(t *testing.T) {
+	uploadDir := UPLOAD_DIR
+	UPLOAD_DIR = t.TempDir()
+	defer func() { UPLOAD_DIR = uploadDir }()
+
+	first := filepath.Join(UPLOAD_DIR, "first.png")
+	second := filepath.Join(UPLOAD_DIR, "second.png")
+	if err := ioutil.WriteFile(first, []byte("image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := GetUser("avatar-owner", "Owner")
+	so := owner.NewSession()
+	defer owner.DeleteSession(so)
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "avatar"}}, so)
+	to := MessageUser{ID: RoomID("avatar"), Name: "avatar"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	ProcessMessage(&Message{Type: "room.join", To: to}, so)
+	waitMessage(t, so, "room.join")
+	room, err := GetRoomByID(to.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]string{"avatar": first})
+	ProcessMessage(&Message{Type: "room.update", To: to, Body: string(body)}, so)
+	if room.GetMeta().Avatar != first {
+		t.Fatalf("Avatar not set, got %+v", room.GetMeta())
+	}
+
+	// Message with the same file released, cleanup on start
+	AttachmentStore.Claim(&Attachment{ID: "avatar-msg", OriginalPath: first, MinifiedPath: first})
+	AttachmentStore.Remove(&Attachment{ID: "avatar-msg"})
+	if err := AttachmentsCleanup(UPLOAD_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatal("Avatar file removed while room uses it")
+	}
+
+	if err := ioutil.WriteFile(second, []byte("image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	body, _ = json.Marshal(map[string]string{"avatar": second})
+	ProcessMessage(&Message{Type: "room.update", To: to, Body: string(body)}, so)
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Error("Replaced avatar file not removed")
+	}
+
+	DeleteRoom(room)
+	if _, err := os.Stat(second); !os.IsNotExist(err) {
+		t.Error("Avatar file of deleted room not removed")
+	}
+}
+
+// slowHistory yields after read, so concurrent read-modify-write interleaves even on one CPU
+type slowHistory struct {
+	HistoryStorage
+}
+
+func (h *slowHistory) Get(key string, id string) (*Message, error) {
+	msg, err := h.HistoryStorage.Get(key, id)
+	time.Sleep(time.Millisecond)
+	return msg, err
+}
+
+func TestReactions(t *testing.T) {
+	alice := GetUser("react-alice", "Alice")
+	bob := GetUser("react-bob", "Bob")
+	sa := alice.NewSession()
+	sb := bob.NewSession()
+	defer alice.DeleteSession(sa)
+	defer bob.DeleteSession(sb)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "react-room"}}, sa)
+	to := MessageUser{ID: RoomID("react-room"), Name: "react-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	for _, s := range []*Session{sa, sb} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "react here"}, sa)
+	m := waitMessage(t, sb, "room.message")
+
+	reactions := func(r *Message) string {
+		list := []string{}
+		for _, reaction := range r.Reactions {
+			list = append(list, fmt.Sprintf("%s:%d:%v", reaction.Emoji, reaction.Count, reaction.Users))
+		}
+		return fmt.Sprint(list)
+	}
+
+	// Both members receive changed message
+	react := func(s *Session, mtype string, expected string) {
+		t.Helper()
+		ProcessMessage(&Message{Type: mtype, To: to, ID: m.ID, Body: "👍"}, s)
+		for _, member := range []*Session{sa, sb} {
+			if r := waitMessage(t, member, mtype); reactions(r) != expected {
+				t.Errorf("Expected reactions %s, got %s", expected, reactions(r))
+			}
+		}
+	}
+	react(sb, "message.react", "[👍:1:[react-bob]]")
+	react(sa, "message.react", "[👍:2:[react-bob react-alice]]")
+
+	// Repeated reaction not counted, unreact toggles it off
+	ProcessMessage(&Message{Type: "message.react", To: to, ID: m.ID, Body: "👍"}, sb)
+	react(sb, "message.unreact", "[👍:1:[react-alice]]")
+	react(sa, "message.unreact", "[]")
+
+	ProcessMessage(&Message{Type: "message.react", To: to, ID: m.ID, Body: "two words"}, sb)
+	waitMessage(t, sb, "message.bad_reaction")
+	ProcessMessage(&Message{Type: "message.react", To: to, ID: "no-such-id", Body: "👍"}, sb)
+	waitMessage(t, sb, "message.not_found")
+
+	// Different reactions are limited, existing ones still can be added
+	msg := &Message{}
+	for i := 0; i < MAX_MESSAGE_REACTIONS; i++ {
+		if !msg.AddReaction(fmt.Sprintf("e%d", i), "u1") {
+			t.Fatalf("Reaction %d not added", i)
+		}
+	}
+	if msg.AddReaction("extra", "u1") || len(msg.Reactions) != MAX_MESSAGE_REACTIONS {
+		t.Errorf("Expected %d reactions at most, got %d", MAX_MESSAGE_REACTIONS, len(msg.Reactions))
+	}
+	if !msg.AddReaction("e0", "u2") || msg.Reactions[0].Count != 2 {
+		t.Error("Existing reaction not added over limit")
+	}
+	if ValidateReaction(strings.Repeat("x", MAX_REACTION_LENGTH+1)) {
+		t.Error("Long reaction is valid")
+	}
+}
+
+func TestThreads(t *testing.T) {
+	alice := GetUser("thread-alice", "Alice")
+	bob := GetUser("thread-bob", "Bob")
+	sa := alice.NewSession()
+	sb := bob.NewSession()
+	defer alice.DeleteSession(sa)
+	defer bob.DeleteSession(sb)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "thread-room"}}, sa)
+	to := MessageUser{ID: RoomID("thread-room"), Name: "thread-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	for _, s := range []*Session{sa, sb} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "question"}, sa)
+	parent := waitMessage(t, sa, "room.message")
+
+	// waitMessage drops rest of drained batch, so reply and parent update are read by different sessions
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "answer", ParentID: parent.ID}, sb)
+	reply := waitMessage(t, sb, "room.message")
+	if updated := waitMessage(t, sa, "room.thread.updated"); updated.ID != parent.ID || updated.Thread == nil ||
+		updated.Thread.ReplyCount != 1 || updated.Thread.LastReplyFrom.ID != bob.ID {
+		t.Errorf("Unexpected thread parent %+v", updated)
+	}
+
+	// Reply to reply goes to the same thread
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "thanks", ParentID: reply.ID}, sa)
+	if updated := waitMessage(t, sa, "room.thread.updated"); updated.Thread.ReplyCount != 2 || updated.Thread.LastReplyFrom.ID != alice.ID {
+		t.Errorf("Unexpected thread parent %+v", updated)
+	}
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "lost", ParentID: "no-such-id"}, sb)
+	waitMessage(t, sb, "message.not_found")
+
+	// Room history has parent with reply count only
+	room, _ := GetRoomByID(to.ID)
+	history := GetRoomHistory(room, bob)
+	if len(history) != 1 || history[0].ID != parent.ID || history[0].Thread.ReplyCount != 2 {
+		t.Errorf("Expected parent only in history, got %d messages", len(history))
+	}
+
+	ProcessMessage(&Message{Type: "room.thread", To: to, ID: reply.ID}, sb)
+	thread := struct {
+		Parent  *Message   `json:"parent"`
+		Replies []*Message `json:"replies"`
+	}{}
+	json.Unmarshal([]byte(waitMessage(t, sb, "room.thread").Body), &thread)
+	if thread.Parent == nil || thread.Parent.ID != parent.ID || len(thread.Replies) != 2 ||
+		thread.Replies[1].Body != "thanks" || thread.Replies[1].ParentID != parent.ID {
+		t.Fatalf("Unexpected thread %+v", thread)
+	}
+
+	// Deleted reply not counted, last reply is previous one. Bob can have unread update of the second reply.
+	ProcessMessage(&Message{Type: "room.message.delete", To: to, ID: thread.Replies[1].ID}, sa)
+	var updated *Message
+	timeout := time.After(time.Second)
+	for updated == nil {
+		for _, m := range sb.Drain() {
+			if m.Type == "room.thread.updated" && (m.Thread == nil || m.Thread.ReplyCount != 2) {
+				updated = m
+			}
+		}
+		if updated != nil {
+			break
+		}
+		select {
+		case <-sb.BufferAvailable:
+		case <-timeout:
+			t.Fatal("Thread parent update after delete not received")
+		}
+	}
+	if updated.Thread == nil || updated.Thread.ReplyCount != 1 || updated.Thread.LastReplyFrom.ID != bob.ID {
+		t.Errorf("Unexpected thread parent after delete %+v", updated.Thread)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	timeout := TYPING_TIMEOUT
+	TYPING_TIMEOUT = 50 * time.Millisecond
+	defer func() { TYPING_TIMEOUT = timeout }()
+
+	alice := GetUser("typing-alice", "Alice")
+	bob := GetUser("typing-bob", "Bob")
+	sa := alice.NewSession()
+	sb := bob.NewSession()
+	defer alice.DeleteSession(sa)
+	defer bob.DeleteSession(sb)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "typing-room"}}, sa)
+	to := MessageUser{ID: RoomID("typing-room"), Name: "typing-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	for _, s := range []*Session{sa, sb} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+
+	// Indicator expires without repeated start
+	ProcessMessage(&Message{Type: "typing.start", To: to}, sa)
+	if m := waitMessage(t, sb, "typing.start"); m.From.ID != alice.ID || m.To.ID != to.ID {
+		t.Errorf("Unexpected typing %+v", m)
+	}
+	started := time.Now()
+	waitMessage(t, sb, "typing.stop")
+	if time.Since(started) < TYPING_TIMEOUT/2 {
+		t.Error("Typing stopped before timeout")
+	}
+	eventually(t, func() bool {
+		TypingStore.Mu.Lock()
+		defer TypingStore.Mu.Unlock()
+		return TypingStore.Map[to.ID+"/"+alice.ID] == nil
+	}, "expired typing removed")
+
+	// Private indicator stopped by user, not stored
+	ProcessMessage(&Message{Type: "typing.start", To: MessageUser{ID: bob.ID}}, sa)
+	waitMessage(t, sb, "typing.start")
+	ProcessMessage(&Message{Type: "typing.stop", To: MessageUser{ID: bob.ID}}, sa)
+	if m := waitMessage(t, sb, "typing.stop"); m.From.ID != alice.ID {
+		t.Errorf("Unexpected typing %+v", m)
+	}
+	if page := GetPrivateHistory(alice, bob, time.Time{}); len(page.History) != 0 {
+		t.Errorf("Typing stored in history %+v", page.History)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	alice := GetUser("read-alice", "Alice")
+	bob := GetUser("read-bob", "Bob")
+	sa := alice.NewSession()
+	sb := bob.NewSession()
+	defer alice.DeleteSession(sa)
+	defer bob.DeleteSession(sb)
+
+	ProcessMessage(&Message{Type: "private.message", To: MessageUser{ID: bob.ID}, Body: "first"}, sa)
+	first := waitMessage(t, sb, "private.message")
+	ProcessMessage(&Message{Type: "private.message", To: MessageUser{ID: bob.ID}, Body: "second"}, sa)
+	second := waitMessage(t, sb, "private.message")
+
+	receipt := struct {
+		User  string    `json:"user"`
+		Until time.Time `json:"until"`
+	}{}
+	ProcessMessage(&Message{Type: "private.read", To: MessageUser{ID: alice.ID}, ID: second.ID}, sb)
+	json.Unmarshal([]byte(waitMessage(t, sa, "private.read").Body), &receipt)
+	if receipt.User != bob.ID || !receipt.Until.Equal(second.Timestamp) {
+		t.Errorf("Unexpected receipt %+v", receipt)
+	}
+
+	// Watermark doesn't move back, unknown message not read
+	ProcessMessage(&Message{Type: "private.read", To: MessageUser{ID: alice.ID}, ID: first.ID}, sb)
+	ProcessMessage(&Message{Type: "private.read", To: MessageUser{ID: alice.ID}, ID: "no-such-id"}, sb)
+	waitMessage(t, sb, "message.not_found")
+	if until := GetReadReceipts(alice, bob)[bob.ID]; !until.Equal(second.Timestamp) {
+		t.Errorf("Expected stored watermark %v, got %v", second.Timestamp, until)
+	}
+
+	// History of both sides has watermark
+	for _, s := range []*Session{sa, sb} {
+		peer := MessageUser{ID: bob.ID}
+		if s == sb {
+			peer = MessageUser{ID: alice.ID}
+		}
+		ProcessMessage(&Message{Type: "private.history", To: peer}, s)
+		page := PrivateHistoryPage{}
+		json.Unmarshal([]byte(waitMessage(t, s, "private.history").Body), &page)
+		if !page.Read[bob.ID].Equal(second.Timestamp) || !page.Read[alice.ID].IsZero() {
+			t.Errorf("Unexpected read watermarks %v", page.Read)
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	grace := PRESENCE_OFFLINE_GRACE
+	PRESENCE_OFFLINE_GRACE = 50 * time.Millisecond
+	defer func() { PRESENCE_OFFLINE_GRACE = grace }()
+
+	alice := GetUser("presence-alice", "Alice")
+	bob := GetUser("presence-bob", "Bob")
+	sa := alice.NewSession()
+	sb := bob.NewSession()
+	defer bob.DeleteSession(sb)
+
+	if alice.GetPresence() != PRESENCE_ONLINE {
+		t.Fatalf("Expected online user with session, got %s", alice.GetPresence())
+	}
+
+	// Private conversation peers receive changes
+	ProcessMessage(&Message{Type: "private.message", To: MessageUser{ID: bob.ID}, Body: "hi"}, sa)
+	waitMessage(t, sb, "private.message")
+	ProcessMessage(&Message{Type: "presence.set", Body: "busy"}, sa)
+	ProcessMessage(&Message{Type: "presence.set", Body: PRESENCE_AWAY}, sa)
+	if m := waitMessage(t, sb, "presence"); m.Body != PRESENCE_AWAY || m.From.ID != alice.ID {
+		t.Errorf("Expected away presence, got %+v", m)
+	}
+	ProcessMessage(&Message{Type: "presence.get", To: MessageUser{ID: alice.ID}}, sb)
+	if m := waitMessage(t, sb, "presence"); m.Body != PRESENCE_AWAY {
+		t.Errorf("Expected away state, got %s", m.Body)
+	}
+
+	// Quick reconnect not visible, offline after grace
+	alice.DeleteSession(sa)
+	sa = alice.NewSession()
+	time.Sleep(2 * PRESENCE_OFFLINE_GRACE)
+	if alice.GetPresence() == PRESENCE_OFFLINE {
+		t.Error("User offline while reconnected")
+	}
+	alice.DeleteSession(sa)
+	if m := waitMessage(t, sb, "presence"); m.Body != PRESENCE_OFFLINE || m.From.ID != alice.ID {
+		t.Errorf("Expected offline presence, got %+v", m)
+	}
+}
+
+func TestConcurrentReactions(t *testing.T) {
+	history := History
+	History = &slowHistory{history}
+	defer func() { History = history }()
+
+	key := "room:reaction-race"
+	if _, err := History.Append(key, &Message{ID: "target", Type: "room.message", Body: "vote"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer History.Drop(key)
+
+	// Each user reacts once at the same time, no reaction lost
+	const users = 20
+	start := make(chan bool)
+	wg := sync.WaitGroup{}
+	for i := 0; i < users; i++ {
+		u := GetUser(fmt.Sprintf("reaction-race-%d", i), "Voter")
+		s := u.NewSession()
+		defer u.DeleteSession(s)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			ReactMessage(s, key, &Message{Type: "message.react", ID: "target", Body: "+1"})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	stored, err := History.Get(key, "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Reactions) != 1 || stored.Reactions[0].Count != users {
+		t.Errorf("Expected %d reactions, got %+v", users, stored.Reactions)
+	}
+}
+
+func TestAttachmentReferences(t *testing.T) {
+	uploadDir := UPLOAD_DIR
+	UPLOAD_DIR = t.TempDir()
+	defer func() { UPLOAD_DIR = uploadDir }()
+
+	original := filepath.Join(UPLOAD_DIR, "abc.png")
+	minified := filepath.Join(UPLOAD_DIR, "abc.min.jpeg")
+	for _, file := range []string{original, minified} {
+		if err := ioutil.WriteFile(file, []byte("image"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uploaded := &Attachment{ID: "alice-upload", Hash: "abc", OriginalPath: original, MinifiedPath: minified}
+	AttachmentStore.Add(uploaded)
+
+	alice := GetUser("attachment-alice", "Alice")
+	bob := GetUser("attachment-bob", "Bob")
+	sa := alice.NewSession()
+	sb := bob.NewSession()
+	defer alice.DeleteSession(sa)
+	defer bob.DeleteSession(sb)
+	key := PrivateHistoryKey(alice, bob)
+	defer History.Drop(key)
+
+	// Bob reuses attachment of Alice (with other hash) and deletes own message
+	own := *uploaded
+	AddToPrivateHistory(alice, bob, &Message{ID: "alice-msg", From: MessageUser{ID: alice.ID}, Attachments: []*Attachment{&own}})
+	forged := *uploaded
+	forged.Hash = "forged"
+	AddToPrivateHistory(alice, bob, &Message{ID: "bob-msg", From: MessageUser{ID: bob.ID}, Attachments: []*Attachment{&forged}})
+
+	EditMessage(sb, nil, key, &Message{Type: "private.message.delete", ID: "bob-msg"})
+	if _, err := os.Stat(original); err != nil {
+		t.Fatal("File of other user removed by delete")
+	}
+
+	EditMessage(sa, nil, key, &Message{Type: "private.message.delete", ID: "alice-msg"})
+	if _, err := os.Stat(original); !os.IsNotExist(err) {
+		t.Error("File not removed with last reference")
+	}
+	if AttachmentStore.Referenced(minified) {
+		t.Error("Attachment still referenced")
+	}
+}
@@ -0,0 +1,703 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster replicates room registry, room membership and online users between chat nodes over the bus.
+// Each node owns facts about own sessions and publishes changes to CLUSTER_SUBJECT,
+// queries merge facts of all alive nodes. Messages itself already shared by bus subjects.
+//
+// Events: 'node.sync' asks nodes (or node 'to') to publish 'node.state' with known rooms and own facts,
+// 'node.heartbeat' keeps node alive (silent nodes dropped with their facts after NodeTimeout), 'node.leave'
+// drops node at once, 'room.create', 'room.update', 'room.delete', 'member.join', 'member.leave', 'user.set', 'user.remove' are changes.
+// 'room.create' of known room keeps its roles, bans, invites, password and metadata, they are changed by 'room.update' only.
+// 'room.update' carries clusterRoomOp with changed fields, so concurrent changes of other fields on other nodes are kept.
+const CLUSTER_SUBJECT = "chat.cluster"
+
+const CLUSTER_HEARTBEAT_INTERVAL = 5 * time.Second
+const CLUSTER_NODE_TIMEOUT = 3 * CLUSTER_HEARTBEAT_INTERVAL
+
+// Time to collect state of running nodes on start
+const CLUSTER_SYNC_WAIT = 500 * time.Millisecond
+
+// ClusterRoom is shared between nodes as immutable value, changes replace it
+type ClusterRoom struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Permanent bool              `json:"permanent"`
+	Roles     map[string]string `json:"roles,omitempty"`    // user ID -> ROLE_OWNER or ROLE_MODERATOR, others are members
+	Banned    map[string]bool   `json:"banned,omitempty"`   // by user ID
+	Invited   map[string]bool   `json:"invited,omitempty"`  // by user ID, can join private room and skip password
+	Password  string            `json:"password,omitempty"` // passhash of room password, empty - no password
+	Meta      RoomMeta          `json:"meta"`
+}
+
+// copy returns room with own roles and bans maps
+func (r *ClusterRoom) copy() *ClusterRoom {
+	c := *r
+	c.Roles = map[string]string{}
+	for id, role := range r.Roles {
+		c.Roles[id] = role
+	}
+	c.Banned = map[string]bool{}
+	for id := range r.Banned {
+		c.Banned[id] = true
+	}
+	c.Invited = map[string]bool{}
+	for id := range r.Invited {
+		c.Invited[id] = true
+	}
+	return &c
+}
+
+type ClusterUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Presence string `json:"presence"`
+}
+
+// clusterNodeState is facts owned by one node: users with sessions on node and their rooms
+type clusterNodeState struct {
+	Users   map[string]*ClusterUser    `json:"users"`   // by user ID
+	Members map[string]map[string]bool `json:"members"` // room ID -> user IDs
+}
+
+// clusterRoomOp sets changed fields of room to absolute values, applying it again doesn't change room
+type clusterRoomOp struct {
+	User        string  `json:"user,omitempty"` // Target of role, banned and invited
+	Role        *string `json:"role,omitempty"`
+	Banned      *bool   `json:"banned,omitempty"`
+	Invited     *bool   `json:"invited,omitempty"`
+	Topic       *string `json:"topic,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Avatar      *string `json:"avatar,omitempty"`
+}
+
+// apply changes room copy
+func (op *clusterRoomOp) apply(room *ClusterRoom) {
+	if op.Role != nil {
+		if *op.Role == ROLE_MEMBER {
+			delete(room.Roles, op.User)
+		} else {
+			room.Roles[op.User] = *op.Role
+		}
+	}
+	if op.Banned != nil {
+		if *op.Banned {
+			room.Banned[op.User] = true
+		} else {
+			delete(room.Banned, op.User)
+		}
+	}
+	if op.Invited != nil {
+		if *op.Invited {
+			room.Invited[op.User] = true
+		} else {
+			delete(room.Invited, op.User)
+		}
+	}
+	if op.Topic != nil {
+		room.Meta.Topic = *op.Topic
+	}
+	if op.Description != nil {
+		room.Meta.Description = *op.Description
+	}
+	if op.Avatar != nil {
+		room.Meta.Avatar = *op.Avatar
+	}
+}
+
+type clusterEvent struct {
+	Type  string            `json:"type"`
+	Node  string            `json:"node"`
+	To    string            `json:"to,omitempty"`
+	Room  *ClusterRoom      `json:"room,omitempty"`
+	Op    *clusterRoomOp    `json:"op,omitempty"`
+	User  *ClusterUser      `json:"user,omitempty"`
+	Rooms []*ClusterRoom    `json:"rooms,omitempty"`
+	State *clusterNodeState `json:"state,omitempty"`
+}
+
+type Cluster struct {
+	NodeID            string
+	HeartbeatInterval time.Duration
+	NodeTimeout       time.Duration
+	OnRoomCreated     func(room *ClusterRoom) // Room created by other node
+	OnRoomDeleted     func(room *ClusterRoom) // Room deleted by other node or left empty by dropped node
+	OnRoomUpdated     func(room *ClusterRoom) // Room settings or metadata changed by other node
+
+	bus   Bus
+	sub   Subscription
+	rooms map[string]*ClusterRoom      // by room ID
+	nodes map[string]*clusterNodeState // by node ID, own node included
+	seen  map[string]time.Time         // last event of other nodes
+	mu    sync.Mutex
+	done  chan bool
+}
+
+func NewCluster(nodeID string, b Bus) *Cluster {
+	if nodeID == "" {
+		nodeID = RandomString(16)
+	}
+	c := &Cluster{
+		NodeID:            nodeID,
+		HeartbeatInterval: CLUSTER_HEARTBEAT_INTERVAL,
+		NodeTimeout:       CLUSTER_NODE_TIMEOUT,
+		bus:               b,
+		rooms:             map[string]*ClusterRoom{},
+		nodes:             map[string]*clusterNodeState{},
+		seen:              map[string]time.Time{},
+		mu:                sync.Mutex{},
+		done:              make(chan bool),
+	}
+	c.nodes[nodeID] = newClusterNodeState()
+	return c
+}
+
+func newClusterNodeState() *clusterNodeState {
+	return &clusterNodeState{
+		Users:   map[string]*ClusterUser{},
+		Members: map[string]map[string]bool{},
+	}
+}
+
+// Start subscribes to cluster events and asks running nodes for their state
+func (c *Cluster) Start() error {
+	sub, err := c.bus.Subscribe(CLUSTER_SUBJECT, c.handle)
+	if err != nil {
+		return err
+	}
+	c.sub = sub
+
+	go func() {
+		ticker := time.NewTicker(c.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.publish(&clusterEvent{Type: "node.heartbeat"})
+				c.expire()
+			}
+		}
+	}()
+
+	return c.publish(&clusterEvent{Type: "node.sync"})
+}
+
+// Stop notifies other nodes, they drop facts of this node at once
+func (c *Cluster) Stop() {
+	close(c.done)
+	c.publish(&clusterEvent{Type: "node.leave"})
+	if c.sub != nil {
+		c.sub.Unsubscribe()
+	}
+}
+
+func (c *Cluster) publish(e *clusterEvent) error {
+	e.Node = c.NodeID
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	err = c.bus.Publish(CLUSTER_SUBJECT, data)
+	if err != nil {
+		log.Println("Cluster: failed to publish event.", err)
+	}
+	return err
+}
+
+// AddRoom registers room or updates its settings
+func (c *Cluster) AddRoom(room *ClusterRoom) {
+	c.mu.Lock()
+	room = c.mergeRoom(room)
+	c.rooms[room.ID] = room
+	c.mu.Unlock()
+
+	c.publish(&clusterEvent{Type: "room.create", Room: room})
+}
+
+func (c *Cluster) RemoveRoom(id string) {
+	c.mu.Lock()
+	room := c.rooms[id]
+	c.removeRoom(id)
+	c.mu.Unlock()
+
+	if room != nil {
+		c.publish(&clusterEvent{Type: "room.delete", Room: room})
+	}
+}
+
+// mergeRoom keeps access settings of known room, must be called with c.mu locked
+func (c *Cluster) mergeRoom(room *ClusterRoom) *ClusterRoom {
+	known := c.rooms[room.ID]
+	if known == nil {
+		return room
+	}
+	merged := *room
+	merged.Roles = known.Roles
+	merged.Banned = known.Banned
+	merged.Invited = known.Invited
+	merged.Password = known.Password
+	merged.Meta = known.Meta
+	return &merged
+}
+
+// Room returns room from registry or nil. Returned room must not be changed
+func (c *Cluster) Room(id string) *ClusterRoom {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rooms[id]
+}
+
+// SetRole changes role of user in room, ROLE_MEMBER removes role
+func (c *Cluster) SetRole(roomID string, userID string, role string) {
+	c.updateRoom(roomID, &clusterRoomOp{User: userID, Role: &role})
+}
+
+// SetBanned adds user to room ban list or removes from it
+func (c *Cluster) SetBanned(roomID string, userID string, banned bool) {
+	c.updateRoom(roomID, &clusterRoomOp{User: userID, Banned: &banned})
+}
+
+// SetInvited allows user to join private room
+func (c *Cluster) SetInvited(roomID string, userID string, invited bool) {
+	c.updateRoom(roomID, &clusterRoomOp{User: userID, Invited: &invited})
+}
+
+// SetMeta replaces room metadata, only fields different from known metadata are sent to other nodes
+func (c *Cluster) SetMeta(roomID string, meta RoomMeta) {
+	c.mu.Lock()
+	known := RoomMeta{}
+	if room := c.rooms[roomID]; room != nil {
+		known = room.Meta
+	}
+	c.mu.Unlock()
+
+	op := &clusterRoomOp{}
+	if meta.Topic != known.Topic {
+		op.Topic = &meta.Topic
+	}
+	if meta.Description != known.Description {
+		op.Description = &meta.Description
+	}
+	if meta.Avatar != known.Avatar {
+		op.Avatar = &meta.Avatar
+	}
+	c.updateRoom(roomID, op)
+}
+
+func (c *Cluster) updateRoom(id string, op *clusterRoomOp) {
+	c.mu.Lock()
+	if c.rooms[id] == nil {
+		c.mu.Unlock()
+		return
+	}
+	room := c.rooms[id].copy()
+	op.apply(room)
+	c.rooms[id] = room
+	c.mu.Unlock()
+
+	c.publish(&clusterEvent{Type: "room.update", Room: &ClusterRoom{ID: id}, Op: op})
+}
+
+// Role returns role of user in room, ROLE_MEMBER if not set
+func (c *Cluster) Role(roomID string, userID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if room := c.rooms[roomID]; room != nil && room.Roles[userID] != "" {
+		return room.Roles[userID]
+	}
+	return ROLE_MEMBER
+}
+
+// Roles returns copy of room roles
+func (c *Cluster) Roles(roomID string) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	roles := map[string]string{}
+	if room := c.rooms[roomID]; room != nil {
+		for id, role := range room.Roles {
+			roles[id] = role
+		}
+	}
+	return roles
+}
+
+func (c *Cluster) IsBanned(roomID string, userID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	room := c.rooms[roomID]
+	return room != nil && room.Banned[userID]
+}
+
+// removeRoom must be called with c.mu locked
+func (c *Cluster) removeRoom(id string) {
+	delete(c.rooms, id)
+	for _, state := range c.nodes {
+		delete(state.Members, id)
+	}
+}
+
+// Join marks user as member of room on this node
+func (c *Cluster) Join(roomID string, user *ClusterUser) {
+	c.mu.Lock()
+	c.nodes[c.NodeID].join(roomID, user)
+	c.mu.Unlock()
+
+	c.publish(&clusterEvent{Type: "member.join", Room: &ClusterRoom{ID: roomID}, User: user})
+}
+
+func (c *Cluster) Leave(roomID string, userID string) {
+	c.mu.Lock()
+	c.nodes[c.NodeID].leave(roomID, userID)
+	c.mu.Unlock()
+
+	c.publish(&clusterEvent{Type: "member.leave", Room: &ClusterRoom{ID: roomID}, User: &ClusterUser{ID: userID}})
+}
+
+// SetUser marks user as connected to this node with presence
+func (c *Cluster) SetUser(user *ClusterUser) {
+	c.mu.Lock()
+	c.nodes[c.NodeID].Users[user.ID] = user
+	c.mu.Unlock()
+
+	c.publish(&clusterEvent{Type: "user.set", User: user})
+}
+
+// RemoveUser is called when user has no sessions on this node anymore
+func (c *Cluster) RemoveUser(id string) {
+	c.mu.Lock()
+	c.nodes[c.NodeID].removeUser(id)
+	c.mu.Unlock()
+
+	c.publish(&clusterEvent{Type: "user.remove", User: &ClusterUser{ID: id}})
+}
+
+func (s *clusterNodeState) join(roomID string, user *ClusterUser) {
+	if s.Members[roomID] == nil {
+		s.Members[roomID] = map[string]bool{}
+	}
+	s.Members[roomID][user.ID] = true
+	if s.Users[user.ID] == nil {
+		s.Users[user.ID] = user
+	}
+}
+
+func (s *clusterNodeState) leave(roomID string, userID string) {
+	delete(s.Members[roomID], userID)
+	if len(s.Members[roomID]) == 0 {
+		delete(s.Members, roomID)
+	}
+}
+
+func (s *clusterNodeState) removeUser(id string) {
+	delete(s.Users, id)
+	for roomID := range s.Members {
+		s.leave(roomID, id)
+	}
+}
+
+func (c *Cluster) Rooms() []*ClusterRoom {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rooms := []*ClusterRoom{}
+	for _, room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// RoomUsers returns members of room on all nodes
+func (c *Cluster) RoomUsers(roomID string) []*ClusterUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	users := map[string]*ClusterUser{}
+	for _, state := range c.nodes {
+		for id := range state.Members[roomID] {
+			if users[id] == nil {
+				users[id] = c.user(id)
+			}
+			if users[id] == nil {
+				users[id] = &ClusterUser{ID: id}
+			}
+		}
+	}
+
+	result := []*ClusterUser{}
+	for _, u := range users {
+		result = append(result, u)
+	}
+	return result
+}
+
+func (c *Cluster) RoomUserCount(roomID string) int {
+	return len(c.RoomUsers(roomID))
+}
+
+func (c *Cluster) IsMember(roomID string, userID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.isMember(roomID, userID)
+}
+
+// isMember must be called with c.mu locked
+func (c *Cluster) isMember(roomID string, userID string) bool {
+	for _, state := range c.nodes {
+		if state.Members[roomID][userID] {
+			return true
+		}
+	}
+	return false
+}
+
+// UserExists returns true if user connected to any node
+func (c *Cluster) UserExists(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.user(id) != nil
+}
+
+// Presence merges user state of all nodes: online on any node wins over away
+func (c *Cluster) Presence(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	presence := PRESENCE_OFFLINE
+	for _, state := range c.nodes {
+		if u := state.Users[id]; u != nil {
+			if u.Presence == PRESENCE_ONLINE {
+				return PRESENCE_ONLINE
+			}
+			presence = u.Presence
+		}
+	}
+	return presence
+}
+
+// FindUser returns connected user by name (case insensitive), nil if not found
+func (c *Cluster) FindUser(name string) *ClusterUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, state := range c.nodes {
+		for _, u := range state.Users {
+			if strings.EqualFold(u.Name, name) {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+// user must be called with c.mu locked
+func (c *Cluster) user(id string) *ClusterUser {
+	for _, state := range c.nodes {
+		if u := state.Users[id]; u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) handle(data []byte) {
+	e := clusterEvent{}
+	if err := json.Unmarshal(data, &e); err != nil {
+		log.Println("Cluster: failed to decode event.", err)
+		return
+	}
+	if e.Node == c.NodeID || e.Node == "" {
+		return
+	}
+
+	created := []*ClusterRoom{}
+	deleted := []*ClusterRoom{}
+	var updated *ClusterRoom
+	reply := false
+
+	c.mu.Lock()
+	if e.Type == "node.leave" {
+		departed := c.nodes[e.Node]
+		delete(c.seen, e.Node)
+		delete(c.nodes, e.Node)
+		deleted = c.dropEmptyRooms(departed)
+		c.mu.Unlock()
+		c.notify(created, deleted)
+		return
+	}
+
+	state := c.nodes[e.Node]
+	known := state != nil
+	if !known {
+		state = newClusterNodeState()
+		c.nodes[e.Node] = state
+	}
+	c.seen[e.Node] = time.Now()
+
+	switch e.Type {
+	case "node.sync":
+		reply = e.To == "" || e.To == c.NodeID
+	case "node.state":
+		if e.State != nil {
+			state = e.State
+			if state.Users == nil {
+				state.Users = map[string]*ClusterUser{}
+			}
+			if state.Members == nil {
+				state.Members = map[string]map[string]bool{}
+			}
+			c.nodes[e.Node] = state
+		}
+		for _, room := range e.Rooms {
+			if c.rooms[room.ID] == nil {
+				c.rooms[room.ID] = room
+				created = append(created, room)
+			}
+		}
+	case "room.create":
+		if e.Room != nil {
+			if c.rooms[e.Room.ID] == nil {
+				created = append(created, e.Room)
+			}
+			c.rooms[e.Room.ID] = c.mergeRoom(e.Room)
+		}
+	case "room.update":
+		if e.Room != nil && e.Op != nil && c.rooms[e.Room.ID] != nil {
+			room := c.rooms[e.Room.ID].copy()
+			e.Op.apply(room)
+			c.rooms[e.Room.ID] = room
+			updated = room
+		}
+	case "room.delete":
+		if e.Room != nil && c.rooms[e.Room.ID] != nil {
+			c.removeRoom(e.Room.ID)
+			deleted = append(deleted, e.Room)
+		}
+	case "member.join":
+		if e.Room != nil && e.User != nil {
+			state.join(e.Room.ID, e.User)
+		}
+	case "member.leave":
+		if e.Room != nil && e.User != nil {
+			state.leave(e.Room.ID, e.User.ID)
+		}
+	case "user.set":
+		if e.User != nil {
+			state.Users[e.User.ID] = e.User
+		}
+	case "user.remove":
+		if e.User != nil {
+			state.removeUser(e.User.ID)
+		}
+	}
+	c.mu.Unlock()
+
+	c.notify(created, deleted)
+	if updated != nil && c.OnRoomUpdated != nil {
+		c.OnRoomUpdated(updated)
+	}
+
+	if reply {
+		c.publishState()
+	} else if !known && e.Type != "node.state" {
+		// Node started before us or was dropped by timeout, its facts are unknown
+		c.publish(&clusterEvent{Type: "node.sync", To: e.Node})
+	}
+}
+
+func (c *Cluster) publishState() {
+	c.mu.Lock()
+	rooms := []*ClusterRoom{}
+	for _, room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	data, _ := json.Marshal(c.nodes[c.NodeID])
+	c.mu.Unlock()
+
+	// Copy of own facts, map not shared with event encoder after unlock
+	state := &clusterNodeState{}
+	json.Unmarshal(data, state)
+	c.publish(&clusterEvent{Type: "node.state", Rooms: rooms, State: state})
+}
+
+// expire drops nodes without heartbeat
+func (c *Cluster) expire() {
+	c.mu.Lock()
+	deleted := []*ClusterRoom{}
+	for node, seen := range c.seen {
+		if time.Since(seen) > c.NodeTimeout {
+			log.Printf("Cluster: node %s timed out\n", node)
+			departed := c.nodes[node]
+			delete(c.seen, node)
+			delete(c.nodes, node)
+			deleted = append(deleted, c.dropEmptyRooms(departed)...)
+		}
+	}
+	c.mu.Unlock()
+
+	c.notify(nil, deleted)
+}
+
+// dropEmptyRooms removes not permanent rooms left without members by departed node, must be called with c.mu locked.
+// Rooms where departed node had no members are kept: room just created by 'room.create' is joined by creator next.
+// Private rooms with pending invites are kept too, invited users can still join.
+// Each node removes them by itself, so nothing published.
+func (c *Cluster) dropEmptyRooms(departed *clusterNodeState) []*ClusterRoom {
+	deleted := []*ClusterRoom{}
+	if departed == nil {
+		return deleted
+	}
+	for id := range departed.Members {
+		room := c.rooms[id]
+		if room == nil || room.Permanent || len(departed.Members[id]) == 0 {
+			continue
+		}
+		empty := true
+		for _, state := range c.nodes {
+			if len(state.Members[id]) > 0 {
+				empty = false
+				break
+			}
+		}
+		if !empty || c.pendingInvites(room) {
+			continue
+		}
+		c.removeRoom(id)
+		deleted = append(deleted, room)
+	}
+	return deleted
+}
+
+// pendingInvites returns true if invited user is not in room yet, must be called with c.mu locked
+func (c *Cluster) pendingInvites(room *ClusterRoom) bool {
+	for userID := range room.Invited {
+		if !c.isMember(room.ID, userID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cluster) notify(created []*ClusterRoom, deleted []*ClusterRoom) {
+	for _, room := range created {
+		if c.OnRoomCreated != nil {
+			c.OnRoomCreated(room)
+		}
+	}
+	for _, room := range deleted {
+		if c.OnRoomDeleted != nil {
+			c.OnRoomDeleted(room)
+		}
+	}
+}
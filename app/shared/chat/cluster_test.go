@@ -0,0 +1,219 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+// eventually waits until cluster events delivered
+func eventually(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startTestNode(t *testing.T, id string, b Bus) (*Cluster, chan string) {
+	node := NewCluster(id, b)
+	node.HeartbeatInterval = 20 * time.Millisecond
+	node.NodeTimeout = 100 * time.Millisecond
+
+	deleted := make(chan string, 10)
+	node.OnRoomDeleted = func(room *ClusterRoom) {
+		deleted <- room.ID
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return node, deleted
+}
+
+func TestClusterNodes(t *testing.T) {
+	b := NewMemoryBus()
+	defer b.Close()
+
+	n1, _ := startTestNode(t, "n1", b)
+	n2, _ := startTestNode(t, "n2", b)
+
+	room := &ClusterRoom{ID: RoomID("shared"), Name: "shared", Type: ROOM_PUBLIC}
+	n1.AddRoom(room)
+	eventually(t, func() bool { return len(n2.Rooms()) == 1 }, "room on second node")
+
+	n1.SetUser(&ClusterUser{ID: "u1", Name: "Alice", Presence: PRESENCE_ONLINE})
+	n1.Join(room.ID, &ClusterUser{ID: "u1", Name: "Alice"})
+	n2.SetUser(&ClusterUser{ID: "u2", Name: "Bob", Presence: PRESENCE_AWAY})
+	n2.Join(room.ID, &ClusterUser{ID: "u2", Name: "Bob"})
+
+	for _, n := range []*Cluster{n1, n2} {
+		n := n
+		eventually(t, func() bool { return n.RoomUserCount(room.ID) == 2 }, "members on node "+n.NodeID)
+	}
+	if !n2.UserExists("u1") || n2.Presence("u1") != PRESENCE_ONLINE {
+		t.Error("User of first node not visible on second node")
+	}
+	if n1.Presence("u2") != PRESENCE_AWAY {
+		t.Errorf("Expected away, got %s", n1.Presence("u2"))
+	}
+
+	// Late node gets state of running nodes
+	n3, deleted := startTestNode(t, "n3", b)
+	defer n3.Stop()
+	eventually(t, func() bool { return len(n3.Rooms()) == 1 && n3.RoomUserCount(room.ID) == 2 }, "state sync on new node")
+
+	// Stopped node facts dropped at once
+	n1.Stop()
+	eventually(t, func() bool { return n3.RoomUserCount(room.ID) == 1 && !n3.UserExists("u1") }, "leave of first node")
+
+	// Crashed node dropped by timeout, its room left empty
+	close(n2.done)
+	n2.sub.Unsubscribe()
+	select {
+	case id := <-deleted:
+		if id != room.ID {
+			t.Errorf("Expected deleted room %s, got %s", room.ID, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Empty room of crashed node not deleted")
+	}
+	if n3.UserExists("u2") {
+		t.Error("User of crashed node still exists")
+	}
+}
+
+func TestClusterEmptyRooms(t *testing.T) {
+	b := NewMemoryBus()
+	defer b.Close()
+
+	n1, deleted := startTestNode(t, "empty-n1", b)
+	defer n1.Stop()
+	n2, _ := startTestNode(t, "empty-n2", b)
+
+	// Room created but not joined yet, room left by users of second node, private room with pending invite
+	fresh := &ClusterRoom{ID: RoomID("fresh"), Name: "fresh", Type: ROOM_PUBLIC}
+	used := &ClusterRoom{ID: RoomID("used"), Name: "used", Type: ROOM_PUBLIC}
+	invited := &ClusterRoom{ID: RoomID("invited"), Name: "invited", Type: ROOM_PRIVATE}
+	n1.AddRoom(fresh)
+	for _, room := range []*ClusterRoom{used, invited} {
+		n2.AddRoom(room)
+		n2.Join(room.ID, &ClusterUser{ID: "empty-u2", Name: "Bob"})
+	}
+	n2.SetInvited(invited.ID, "empty-u3", true)
+	eventually(t, func() bool {
+		return len(n1.Rooms()) == 3 && n1.RoomUserCount(used.ID) == 1 && n1.RoomUserCount(invited.ID) == 1 && n1.Room(invited.ID).Invited["empty-u3"]
+	}, "rooms of second node")
+
+	n2.Stop()
+	select {
+	case id := <-deleted:
+		if id != used.ID {
+			t.Errorf("Expected deleted room %s, got %s", used.ID, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Room left empty by stopped node not deleted")
+	}
+	select {
+	case id := <-deleted:
+		t.Errorf("Room %s deleted, expected only %s", id, used.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(n1.Rooms()) != 2 {
+		t.Errorf("Expected new and invited rooms kept, got %d rooms", len(n1.Rooms()))
+	}
+}
+
+func TestClusterChat(t *testing.T) {
+	// Other node on the same bus as chat started by TestMain
+	remote, _ := startTestNode(t, "remote", bus)
+
+	room := &ClusterRoom{ID: RoomID("remote-room"), Name: "remote-room", Type: ROOM_PUBLIC}
+	remote.AddRoom(room)
+	remote.SetUser(&ClusterUser{ID: "cluster-carol", Name: "Carol", Presence: PRESENCE_ONLINE})
+	remote.Join(room.ID, &ClusterUser{ID: "cluster-carol", Name: "Carol"})
+
+	eventually(t, func() bool {
+		return RoomExists("remote-room") && UserExists("cluster-carol")
+	}, "remote room and user")
+
+	local, err := GetRoom("remote-room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return local.UserCount() == 1 }, "remote member")
+
+	alice := GetUser("cluster-alice", "Alice")
+	s := alice.NewSession()
+	defer alice.DeleteSession(s)
+
+	to := MessageUser{ID: local.ID, Name: local.Name}
+	ProcessMessage(&Message{Type: "room.join", To: to}, s)
+	waitMessage(t, s, "room.join")
+	eventually(t, func() bool { return remote.RoomUserCount(room.ID) == 2 }, "local member on remote node")
+
+	// Members of both nodes listed
+	if users := local.GetUsers(); len(users) != 2 {
+		t.Errorf("Expected 2 room users, got %d", len(users))
+	}
+
+	// Room kept while remote user in it, removed when last user left
+	ProcessMessage(&Message{Type: "room.leave", To: to}, s)
+	if !RoomExists("remote-room") {
+		t.Error("Room removed while remote user in it")
+	}
+	remote.Stop()
+	eventually(t, func() bool { return !RoomExists("remote-room") }, "empty room deletion")
+}
+
+func TestClusterRoomRoles(t *testing.T) {
+	b := NewMemoryBus()
+	defer b.Close()
+
+	n1, _ := startTestNode(t, "roles-n1", b)
+	n2, _ := startTestNode(t, "roles-n2", b)
+	defer n1.Stop()
+	defer n2.Stop()
+
+	room := &ClusterRoom{ID: RoomID("moderated"), Name: "moderated", Type: ROOM_PUBLIC, Roles: map[string]string{"u1": ROLE_OWNER}}
+	n1.AddRoom(room)
+	eventually(t, func() bool { return n2.Role(room.ID, "u1") == ROLE_OWNER }, "owner on second node")
+
+	n2.SetRole(room.ID, "u2", ROLE_MODERATOR)
+	n2.SetBanned(room.ID, "u3", true)
+	eventually(t, func() bool {
+		return n1.Role(room.ID, "u2") == ROLE_MODERATOR && n1.IsBanned(room.ID, "u3")
+	}, "role and ban on first node")
+
+	n2.SetMeta(room.ID, RoomMeta{Topic: "rules"})
+	eventually(t, func() bool { return n1.Room(room.ID).Meta.Topic == "rules" }, "metadata on first node")
+
+	// Room created again (node restart) keeps roles, bans and metadata
+	n2.AddRoom(&ClusterRoom{ID: room.ID, Name: room.Name, Type: ROOM_PUBLIC, Permanent: true})
+	time.Sleep(50 * time.Millisecond)
+	if n1.Role(room.ID, "u1") != ROLE_OWNER || !n1.IsBanned(room.ID, "u3") || n1.Room(room.ID).Meta.Topic != "rules" {
+		t.Error("Roles lost after room create")
+	}
+
+	n1.SetBanned(room.ID, "u3", false)
+	n1.SetRole(room.ID, "u2", ROLE_MEMBER)
+	eventually(t, func() bool {
+		return n2.Role(room.ID, "u2") == ROLE_MEMBER && !n2.IsBanned(room.ID, "u3")
+	}, "unban and demote on second node")
+
+	// Concurrent changes of different fields on different nodes are kept on both
+	n1.SetBanned(room.ID, "u4", true)
+	n2.SetRole(room.ID, "u5", ROLE_MODERATOR)
+	n1.SetMeta(room.ID, RoomMeta{Topic: "new rules"})
+	n2.SetMeta(room.ID, RoomMeta{Topic: "rules", Avatar: "https://example.com/a.png"})
+	for _, n := range []*Cluster{n1, n2} {
+		n := n
+		eventually(t, func() bool {
+			meta := n.Room(room.ID).Meta
+			return n.IsBanned(room.ID, "u4") && n.Role(room.ID, "u5") == ROLE_MODERATOR &&
+				meta.Topic == "new rules" && meta.Avatar == "https://example.com/a.png"
+		}, "concurrent changes on node "+n.NodeID)
+	}
+}
@@ -0,0 +1,331 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Prefix of slash command in message text, doubled prefix sends text starting with single one
+const COMMAND_PREFIX = "/"
+
+// Command is IRC style command typed in message box of room or private conversation.
+// Most commands send other message types for user, so checks of those types are applied too.
+type Command struct {
+	Name  string // Without prefix, lower case
+	Usage string // Arguments, e.g. "<user>"
+	Help  string
+	Room  bool // Works only in room where user is member
+	// Allow checks permission, room is nil for not room command. Nil - allowed for all.
+	Allow func(s *Session, room *Room) bool
+	// Run executes command with text after name. Returns true if msg was rewritten and must be processed as message.
+	Run func(s *Session, msg *Message, args string) (bool, error)
+}
+
+// CommandInfo is command description in 'command.help' body
+type CommandInfo struct {
+	Name  string `json:"name"`
+	Usage string `json:"usage"`
+	Help  string `json:"help"`
+}
+
+func (c *Command) Info() CommandInfo {
+	return CommandInfo{Name: c.Name, Usage: COMMAND_PREFIX + strings.TrimSpace(c.Name+" "+c.Usage), Help: c.Help}
+}
+
+// ErrCommandRoomNotFound returned for room command sent to room which not exists
+var ErrCommandRoomNotFound = errors.New("Room not found.")
+
+type CommandUnknownError struct {
+	Name string
+}
+
+func (e *CommandUnknownError) Error() string {
+	return "Unknown command " + COMMAND_PREFIX + e.Name + ", type " + COMMAND_PREFIX + "help for list of commands"
+}
+
+type CommandForbiddenError struct {
+	Name string
+}
+
+func (e *CommandForbiddenError) Error() string {
+	return "You are not allowed to use " + COMMAND_PREFIX + e.Name + " here"
+}
+
+type CommandUsageError struct {
+	Command *Command
+}
+
+func (e *CommandUsageError) Error() string {
+	info := e.Command.Info()
+	return "Usage: " + info.Usage + " - " + info.Help
+}
+
+type CommandStoreType struct {
+	Map map[string]*Command
+	Mu  sync.Mutex
+}
+
+// Registered commands, built-in are added in init
+var CommandStore = CommandStoreType{
+	Map: map[string]*Command{},
+	Mu:  sync.Mutex{},
+}
+
+// RegisterCommand adds command or replaces registered one with the same name
+func RegisterCommand(c *Command) {
+	c.Name = strings.ToLower(c.Name)
+
+	CommandStore.Mu.Lock()
+	CommandStore.Map[c.Name] = c
+	CommandStore.Mu.Unlock()
+}
+
+func GetCommand(name string) *Command {
+	CommandStore.Mu.Lock()
+	defer CommandStore.Mu.Unlock()
+
+	return CommandStore.Map[strings.ToLower(name)]
+}
+
+// Commands returns registered commands sorted by name
+func Commands() []*Command {
+	CommandStore.Mu.Lock()
+	commands := make([]*Command, 0, len(CommandStore.Map))
+	for _, c := range CommandStore.Map {
+		commands = append(commands, c)
+	}
+	CommandStore.Mu.Unlock()
+
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// IsCommand returns true for room and private text starting with command prefix.
+// Doubled prefix is unescaped in place and message is not a command.
+func IsCommand(msg *Message) bool {
+	if msg.Type != "room.message" && msg.Type != "private.message" {
+		return false
+	}
+	if !strings.HasPrefix(msg.Body, COMMAND_PREFIX) {
+		return false
+	}
+	if strings.HasPrefix(msg.Body, COMMAND_PREFIX+COMMAND_PREFIX) {
+		msg.Body = strings.TrimPrefix(msg.Body, COMMAND_PREFIX)
+		return false
+	}
+	return true
+}
+
+// RunCommand parses and executes command from message text.
+// Returns true if msg was rewritten by command and must be processed further as message.
+func RunCommand(msg *Message, s *Session) (bool, error) {
+	text := strings.TrimSpace(strings.TrimPrefix(msg.Body, COMMAND_PREFIX))
+	name, args := text, ""
+	if i := strings.IndexAny(text, " \t\n"); i >= 0 {
+		name, args = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	name = strings.ToLower(name)
+
+	c := GetCommand(name)
+	if c == nil {
+		return false, &CommandUnknownError{Name: name}
+	}
+
+	var room *Room
+	if c.Room {
+		if msg.Type != "room.message" {
+			return false, &CommandForbiddenError{Name: name}
+		}
+		var err error
+		if room, err = GetRoomByID(msg.To.ID); err != nil {
+			return false, ErrCommandRoomNotFound
+		}
+		if !room.HasUser(s.User) {
+			return false, &CommandForbiddenError{Name: name}
+		}
+	}
+	if c.Allow != nil && !c.Allow(s, room) {
+		return false, &CommandForbiddenError{Name: name}
+	}
+
+	return c.Run(s, msg, args)
+}
+
+// processCommand runs command and reports errors to session, returns true if msg must be processed further
+func processCommand(msg *Message, s *Session) bool {
+	next, err := RunCommand(msg, s)
+	if err == nil {
+		return next
+	}
+	if err == ErrCommandRoomNotFound {
+		PublishMessage(s.ID, MessageRoomNotFound(s))
+		return false
+	}
+
+	switch err.(type) {
+	case *CommandUnknownError:
+		PublishMessage(s.ID, MessageCommandError(s, msg, "command.unknown", err))
+	case *CommandForbiddenError:
+		PublishMessage(s.ID, MessageCommandError(s, msg, "command.forbidden", err))
+	case *CommandUsageError:
+		PublishMessage(s.ID, MessageCommandError(s, msg, "command.usage", err))
+	default:
+		PublishMessage(s.ID, MessageCommandError(s, msg, "command.error", err))
+	}
+	return false
+}
+
+// findCommandUser returns user by ID or by name (case insensitive) among connected users
+func findCommandUser(s *Session, arg string) (MessageUser, bool) {
+	arg = strings.TrimPrefix(arg, "@")
+	if UserExists(arg) {
+		u := GetUser(arg, "")
+		return MessageUser{ID: u.ID, Name: u.Name}, true
+	}
+	if u := cluster.FindUser(arg); u != nil {
+		return MessageUser{ID: u.ID, Name: u.Name}, true
+	}
+	PublishMessage(s.ID, MessageUserNotFound(s, MessageUser{Name: arg}))
+	return MessageUser{}, false
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "help",
+		Usage: "[command]",
+		Help:  "List commands or show help of command",
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			list := []CommandInfo{}
+			if args != "" {
+				c := GetCommand(strings.TrimPrefix(args, COMMAND_PREFIX))
+				if c == nil {
+					return false, &CommandUnknownError{Name: args}
+				}
+				list = append(list, c.Info())
+			} else {
+				for _, c := range Commands() {
+					list = append(list, c.Info())
+				}
+			}
+			PublishMessage(s.ID, MessageCommandHelp(s, msg, list))
+			return false, nil
+		},
+	})
+
+	RegisterCommand(&Command{
+		Name:  "me",
+		Usage: "<action>",
+		Help:  "Send action message, shown as '* name action'",
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			if args == "" {
+				return false, &CommandUsageError{Command: GetCommand("me")}
+			}
+			msg.Body = args
+			msg.Action = true
+			return true, nil
+		},
+	})
+
+	RegisterCommand(&Command{
+		Name:  "topic",
+		Usage: "<text>",
+		Help:  "Change room topic (owner and moderators)",
+		Room:  true,
+		Allow: func(s *Session, room *Room) bool {
+			return room.IsModerator(s.User)
+		},
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			if args == "" {
+				return false, &CommandUsageError{Command: GetCommand("topic")}
+			}
+			body, _ := json.Marshal(map[string]string{"topic": args})
+			ProcessMessage(&Message{Type: "room.update", To: msg.To, Body: string(body)}, s)
+			return false, nil
+		},
+	})
+
+	RegisterCommand(&Command{
+		Name:  "invite",
+		Usage: "<user>",
+		Help:  "Invite user to this room",
+		Room:  true,
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			if args == "" {
+				return false, &CommandUsageError{Command: GetCommand("invite")}
+			}
+			user, ok := findCommandUser(s, args)
+			if !ok {
+				return false, nil
+			}
+			body, _ := json.Marshal(map[string]string{"user": user.ID})
+			ProcessMessage(&Message{Type: "room.invite", To: msg.To, Body: string(body)}, s)
+			return false, nil
+		},
+	})
+
+	RegisterCommand(&Command{
+		Name:  "mute",
+		Usage: "<user>",
+		Help:  "Hide messages of user",
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			if args == "" {
+				return false, &CommandUsageError{Command: GetCommand("mute")}
+			}
+			user, ok := findCommandUser(s, args)
+			if !ok {
+				return false, nil
+			}
+			ProcessMessage(&Message{Type: "mute", To: user}, s)
+			return false, nil
+		},
+	})
+
+	RegisterCommand(&Command{
+		Name:  "join",
+		Usage: "<room> [password]",
+		Help:  "Join room",
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			fields := strings.Fields(args)
+			if len(fields) == 0 || len(fields) > 2 {
+				return false, &CommandUsageError{Command: GetCommand("join")}
+			}
+			body := ""
+			if len(fields) == 2 {
+				encoded, _ := json.Marshal(map[string]string{"password": fields[1]})
+				body = string(encoded)
+			}
+			to := MessageUser{ID: RoomID(fields[0]), Name: fields[0]}
+			ProcessMessage(&Message{Type: "room.join", To: to, Body: body}, s)
+			return false, nil
+		},
+	})
+
+	RegisterCommand(&Command{
+		Name:  "leave",
+		Usage: "[room]",
+		Help:  "Leave this or named room",
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			to := msg.To
+			if args != "" {
+				to = MessageUser{ID: RoomID(args), Name: args}
+			} else if msg.Type != "room.message" {
+				return false, &CommandUsageError{Command: GetCommand("leave")}
+			}
+			ProcessMessage(&Message{Type: "room.leave", To: to}, s)
+			return false, nil
+		},
+	})
+
+	RegisterCommand(&Command{
+		Name: "who",
+		Help: "List room members",
+		Room: true,
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			ProcessMessage(&Message{Type: "room.users", To: msg.To}, s)
+			return false, nil
+		},
+	})
+}
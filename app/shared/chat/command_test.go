@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	owner := GetUser("command-owner", "CommandOwner")
+	member := GetUser("command-member", "CommandMember")
+	so := owner.NewSession()
+	sm := member.NewSession()
+	defer owner.DeleteSession(so)
+	defer member.DeleteSession(sm)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "command-room"}}, so)
+	to := MessageUser{ID: RoomID("command-room"), Name: "command-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	ProcessMessage(&Message{Type: "room.join", To: to}, so)
+	waitMessage(t, so, "room.join")
+
+	// Join and leave by name
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/join command-room"}, sm)
+	waitMessage(t, sm, "room.join")
+
+	// Action
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/me waves"}, sm)
+	m := waitMessage(t, so, "room.message")
+	if m.Body != "waves" || !m.Action || m.From.ID != member.ID {
+		t.Errorf("Expected action message, got %+v", m)
+	}
+
+	// Action set by client is cleared
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "fake action", Action: true}, sm)
+	if m = waitMessage(t, so, "room.message"); m.Action {
+		t.Errorf("Expected text message, got %+v", m)
+	}
+
+	// Escaped prefix posted as text
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "//me is text", Action: true}, sm)
+	if m = waitMessage(t, so, "room.message"); m.Body != "/me is text" || m.Action {
+		t.Errorf("Expected text message, got %+v", m)
+	}
+
+	// Unknown command not posted
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/dance now"}, sm)
+	waitMessage(t, sm, "command.unknown")
+
+	// Permission and usage
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/topic Member topic"}, sm)
+	waitMessage(t, sm, "command.forbidden")
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/topic"}, so)
+	waitMessage(t, so, "command.usage")
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/TOPIC Owner topic"}, so)
+	waitMessage(t, sm, "room.updated")
+	room, _ := GetRoomByID(to.ID)
+	if room.GetMeta().Topic != "Owner topic" {
+		t.Errorf("Topic not changed, got %s", room.GetMeta().Topic)
+	}
+
+	// Room command not allowed in private conversation
+	ProcessMessage(&Message{Type: "private.message", To: MessageUser{ID: owner.ID}, Body: "/who"}, sm)
+	waitMessage(t, sm, "command.forbidden")
+
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/who"}, sm)
+	if m = waitMessage(t, sm, "room.users"); m.From.ID != to.ID {
+		t.Errorf("Expected users of room, got %+v", m)
+	}
+
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/help me"}, sm)
+	m = waitMessage(t, sm, "command.help")
+	list := []CommandInfo{}
+	if err := json.Unmarshal([]byte(m.Body), &list); err != nil || len(list) != 1 || list[0].Usage != "/me <action>" {
+		t.Errorf("Unexpected help %s", m.Body)
+	}
+
+	// User found by name
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/mute commandowner"}, sm)
+	waitMessage(t, sm, "muted")
+	if muted, _ := member.CheckInMute(owner); !muted {
+		t.Error("User not muted")
+	}
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/mute nobody-here"}, sm)
+	waitMessage(t, sm, "user.not_found")
+
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/leave"}, sm)
+	eventually(t, func() bool { return !room.HasUser(member) }, "member left room")
+
+	// Registered command
+	RegisterCommand(&Command{
+		Name: "ping",
+		Help: "Test command",
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			msg.Body = "pong"
+			return true, nil
+		},
+	})
+	defer func() {
+		CommandStore.Mu.Lock()
+		delete(CommandStore.Map, "ping")
+		CommandStore.Mu.Unlock()
+	}()
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/ping"}, so)
+	if m = waitMessage(t, so, "room.message"); m.Body != "pong" {
+		t.Errorf("Expected pong, got %s", m.Body)
+	}
+
+	// Other command errors returned with text
+	RegisterCommand(&Command{
+		Name: "fail",
+		Run: func(s *Session, msg *Message, args string) (bool, error) {
+			return false, errors.New("Service is down")
+		},
+	})
+	defer func() {
+		CommandStore.Mu.Lock()
+		delete(CommandStore.Map, "fail")
+		CommandStore.Mu.Unlock()
+	}()
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "/fail"}, so)
+	if m = waitMessage(t, so, "command.error"); m.Body != "Service is down" {
+		t.Errorf("Expected command error, got %s", m.Body)
+	}
+}
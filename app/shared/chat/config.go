@@ -0,0 +1,198 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Config contains the chat settings from config.json. Durations are in seconds.
+// Start from DefaultConfig, so missed keys keep default values.
+type Config struct {
+	NATSURL                 string            `json:"NATSURL"`                 // Empty - in-process bus, single node only
+	NATSServer              NATSServerConfig  `json:"NATSServer"`              // Embedded server, replaces NATSURL if enabled
+	JetStream               JetStreamConfig   `json:"JetStream"`               // Room history in JetStream streams
+	NodeID                  string            `json:"NodeID"`                  // Unique name of node in cluster, empty - random
+	DefaultRooms            []string          `json:"DefaultRooms"`            // Permanent public rooms
+	HeartBeatTimeout        int               `json:"HeartBeatTimeout"`        // Session without activity suspended after
+	SessionResumeGrace      int               `json:"SessionResumeGrace"`      // Suspended session can be resumed while, 0 - no resume
+	FixedWindowMax          int               `json:"FixedWindowMax"`          // Messages per FixedWindowInterval
+	FixedWindowInterval     int               `json:"FixedWindowInterval"`     // Throttling window
+	MaxTextMessageLength    int               `json:"MaxTextMessageLength"`    // 0 - unlimited
+	MaxRoomUsers            int               `json:"MaxRoomUsers"`            // 0 - unlimited
+	MaxRoomCount            int               `json:"MaxRoomCount"`            // 0 - unlimited
+	MaxRoomHistoryMessages  int               `json:"MaxRoomHistoryMessages"`  // 0 - unlimited
+	UploadDir               string            `json:"UploadDir"`               // Unreferenced files removed on start!
+	UploadUserQuota         int64             `json:"UploadUserQuota"`         // Bytes per UploadQuotaResetTimeout
+	UploadQuotaResetTimeout int               `json:"UploadQuotaResetTimeout"` // Quota window
+	BadWords                map[string]string `json:"BadWords"`                // Regexp to replacement, empty replacement - ****. Not set - BadWordsDictionary kept
+	Admins                  []string          `json:"Admins"`                  // Login emails of users allowed to open admin console
+	Webhooks                WebhookConfig     `json:"Webhooks"`                // Delivery of room events to webhooks
+}
+
+// DefaultConfig returns settings used when config.json has no Chat section
+func DefaultConfig() Config {
+	return Config{
+		NATSURL:                 "nats://127.0.0.1:4222",
+		DefaultRooms:            []string{"default", "marvel", "dc"},
+		HeartBeatTimeout:        30,
+		SessionResumeGrace:      60,
+		FixedWindowMax:          20,
+		FixedWindowInterval:     10,
+		MaxTextMessageLength:    0,
+		MaxRoomUsers:            100,
+		MaxRoomCount:            100,
+		MaxRoomHistoryMessages:  200,
+		UploadDir:               "static/upload",
+		UploadUserQuota:         1024 * 1024 * 100,
+		UploadQuotaResetTimeout: 15 * 60,
+		Webhooks: WebhookConfig{
+			Workers:      2,
+			QueueSize:    1000,
+			Timeout:      10,
+			MaxAttempts:  5,
+			RetryBackoff: 2,
+		},
+	}
+}
+
+// Validate checks that settings are usable
+func (c Config) Validate() error {
+	if err := c.NATSServer.Validate(); err != nil {
+		return err
+	}
+	if c.JetStream.Enabled {
+		if c.NATSURL == "" && !c.NATSServer.Enabled {
+			return errors.New("Chat: JetStream needs NATSURL or NATSServer")
+		}
+		if c.NATSServer.Enabled && !c.NATSServer.JetStream {
+			return errors.New("Chat: JetStream needs NATSServer.JetStream enabled")
+		}
+		if c.JetStream.MaxAge < 0 || c.JetStream.Replicas < 0 {
+			return errors.New("Chat: JetStream limits can't be negative")
+		}
+	}
+	if err := c.Webhooks.Validate(); err != nil {
+		return err
+	}
+	if c.HeartBeatTimeout <= 0 {
+		return errors.New("Chat: HeartBeatTimeout must be positive")
+	}
+	if c.SessionResumeGrace < 0 {
+		return errors.New("Chat: SessionResumeGrace can't be negative")
+	}
+	if c.FixedWindowMax <= 0 || c.FixedWindowInterval <= 0 {
+		return errors.New("Chat: FixedWindowMax and FixedWindowInterval must be positive")
+	}
+	if c.UploadQuotaResetTimeout <= 0 {
+		return errors.New("Chat: UploadQuotaResetTimeout must be positive")
+	}
+	if c.MaxTextMessageLength < 0 || c.MaxRoomUsers < 0 || c.MaxRoomCount < 0 || c.MaxRoomHistoryMessages < 0 || c.UploadUserQuota < 0 {
+		return errors.New("Chat: limits can't be negative")
+	}
+
+	// Files in upload dir are removed on start, so never use root or working dir
+	dir := filepath.Clean(c.UploadDir)
+	if c.UploadDir == "" || dir == "." || dir == filepath.Dir(dir) {
+		return fmt.Errorf("Chat: UploadDir '%s' not allowed", c.UploadDir)
+	}
+
+	if len(c.DefaultRooms) == 0 {
+		return errors.New("Chat: at least one default room needed")
+	}
+	if c.MaxRoomCount > 0 && len(c.DefaultRooms) > c.MaxRoomCount {
+		return errors.New("Chat: more default rooms than MaxRoomCount")
+	}
+	names := map[string]bool{}
+	for _, name := range c.DefaultRooms {
+		if !ValidateRoomName(name) {
+			return fmt.Errorf("Chat: bad default room name '%s'", name)
+		}
+		if names[name] {
+			return fmt.Errorf("Chat: duplicated default room '%s'", name)
+		}
+		names[name] = true
+	}
+
+	for bad := range c.BadWords {
+		if _, err := regexp.Compile(bad); err != nil {
+			return fmt.Errorf("Chat: bad word pattern '%s'. %s", bad, err)
+		}
+	}
+
+	return nil
+}
+
+// apply copies validated settings to package limits
+func (c Config) apply() {
+	HEART_BEAT_TIMEOUT = time.Duration(c.HeartBeatTimeout) * time.Second
+	SESSION_RESUME_GRACE = time.Duration(c.SessionResumeGrace) * time.Second
+	FIXED_WINDOW_MAX = c.FixedWindowMax
+	FIXED_WINDOW_INTERVAL = time.Duration(c.FixedWindowInterval) * time.Second
+	MAX_TEXT_MESSAGE_LENGTH = c.MaxTextMessageLength
+	MAX_ROOM_USERS = c.MaxRoomUsers
+	MAX_ROOM_COUNT = c.MaxRoomCount
+	MAX_ROOM_HISTORY_MESSAGES = c.MaxRoomHistoryMessages
+	UPLOAD_DIR = c.UploadDir
+	UPLOAD_USER_QUOTA = c.UploadUserQuota
+	UPLOAD_QUOTA_RESET_TIMEOUT = time.Duration(c.UploadQuotaResetTimeout) * time.Second
+	WEBHOOK_WORKERS = c.Webhooks.Workers
+	WEBHOOK_QUEUE_SIZE = c.Webhooks.QueueSize
+	WEBHOOK_TIMEOUT = time.Duration(c.Webhooks.Timeout) * time.Second
+	WEBHOOK_MAX_ATTEMPTS = c.Webhooks.MaxAttempts
+	WEBHOOK_RETRY_BACKOFF = time.Duration(c.Webhooks.RetryBackoff) * time.Second
+	WEBHOOK_ALLOW_PRIVATE = c.Webhooks.AllowPrivate
+
+	ADMINS = map[string]bool{}
+	for _, email := range c.Admins {
+		ADMINS[strings.ToLower(email)] = true
+	}
+
+	if c.BadWords == nil {
+		return
+	}
+	BadWordsDictionary = map[*regexp.Regexp]string{}
+	for bad, good := range c.BadWords {
+		if good == "" {
+			good = "****"
+		}
+		BadWordsDictionary[regexp.MustCompile(bad)] = good
+	}
+}
+
+// NewBus starts embedded NATS server and connects to it, connects to NATSURL
+// or returns in-process bus if NATSURL is empty
+func NewBus(c Config) (Bus, error) {
+	if c.NATSServer.Enabled {
+		srv, err := StartNATSServer(c.NATSServer)
+		if err != nil {
+			return nil, err
+		}
+
+		options := []nats.Option{}
+		if c.NATSServer.Username != "" {
+			options = append(options, nats.UserInfo(c.NATSServer.Username, c.NATSServer.Password))
+		}
+		if c.NATSServer.Token != "" {
+			options = append(options, nats.Token(c.NATSServer.Token))
+		}
+
+		b, err := DialNATS(srv.ClientURL(), options...)
+		if err != nil {
+			srv.Shutdown()
+			return nil, err
+		}
+		b.Server = srv
+		return b, nil
+	}
+
+	if c.NATSURL == "" {
+		return NewMemoryBus(), nil
+	}
+	return DialNATS(c.NATSURL)
+}
@@ -0,0 +1,36 @@
+package chat
+
+import (
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatal("Default config not valid.", err)
+	}
+
+	bad := map[string]func(c *Config){
+		"heartbeat":      func(c *Config) { c.HeartBeatTimeout = 0 },
+		"resume grace":   func(c *Config) { c.SessionResumeGrace = -1 },
+		"window":         func(c *Config) { c.FixedWindowInterval = 0 },
+		"negative limit": func(c *Config) { c.MaxRoomUsers = -1 },
+		"empty upload":   func(c *Config) { c.UploadDir = "" },
+		"root upload":    func(c *Config) { c.UploadDir = "/" },
+		"dot upload":     func(c *Config) { c.UploadDir = "./" },
+		"no rooms":       func(c *Config) { c.DefaultRooms = nil },
+		"room name":      func(c *Config) { c.DefaultRooms = []string{"chat.broadcast"} },
+		"duplicate room": func(c *Config) { c.DefaultRooms = []string{"a", "a"} },
+		"room count":     func(c *Config) { c.MaxRoomCount = 1 },
+		"bad word":       func(c *Config) { c.BadWords = map[string]string{"(": ""} },
+		"webhook worker": func(c *Config) { c.Webhooks.Workers = 0 },
+		"webhook retry":  func(c *Config) { c.Webhooks.RetryBackoff = -1 },
+	}
+
+	for name, change := range bad {
+		c := DefaultConfig()
+		change(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("Config with bad %s passed validation", name)
+		}
+	}
+}
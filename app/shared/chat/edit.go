@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// EditMessage applies 'room.message.edit', 'room.message.delete' (and private equivalents) to stored message.
+// msg.ID is target message, msg.Body is new text for edit.
+// Changed message is published to subjects with msg.Type, so clients can update it in place by ID.
+// room is nil for private messages, in room moderators and owner can delete messages of users they can moderate.
+func EditMessage(session *Session, room *Room, key string, msg *Message, subjects ...string) {
+	unlock := LockHistory(key)
+	defer unlock()
+
+	stored, err := History.Get(key, msg.ID)
+	if err != nil || stored.Deleted {
+		PublishMessage(session.ID, MessageNotFound(session, msg))
+		return
+	}
+
+	// Only author can change message, moderators can delete it
+	deleting := strings.HasSuffix(msg.Type, ".delete")
+	moderated := deleting && room != nil && room.CanModerate(session.User, stored.From.ID)
+	if stored.From.ID != session.User.ID && !moderated {
+		PublishMessage(session.ID, MessageForbidden(session, msg))
+		return
+	}
+
+	// Check user spam to fast
+	if !session.User.AllowMessage() {
+		PublishMessage(session.ID, MessageToManyRequests(session, msg.To))
+		return
+	}
+
+	now := time.Now()
+	stored.EditedAt = &now
+	if deleting {
+		RemoveAttachments([]*Message{stored})
+		stored.Body = ""
+		stored.Attachments = nil
+		stored.Deleted = true
+	} else {
+		stored.Body = msg.Body
+	}
+
+	if err = History.Update(key, stored); err != nil {
+		log.Println("Chat: failed to update message.", err)
+		return
+	}
+	IndexMessage(key, stored)
+
+	event := *stored
+	event.Type = msg.Type
+	for _, subject := range subjects {
+		PublishMessage(subject, &event)
+	}
+
+	if deleting && room != nil && stored.ParentID != "" {
+		removeThreadReply(room, stored)
+	}
+}
@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Folder of attachment files inside transcript zip
+const EXPORT_ZIP_ATTACHMENTS = "attachments"
+
+// ExportQuery selects conversation for export: room by ID or private conversation with user by ID
+type ExportQuery struct {
+	Room  string
+	With  string
+	Since time.Time // Zero - no bound
+	Until time.Time // Zero - no bound
+}
+
+// Transcript is stored conversation prepared for export, messages are in order of sending
+type Transcript struct {
+	Title    string
+	Key      string
+	Since    time.Time
+	Until    time.Time
+	Exported time.Time
+	Bundled  bool // Attachment paths are inside transcript zip
+	Messages []*Message
+}
+
+var ErrExportBadQuery = errors.New("Export needs room or user")
+var ErrExportForbidden = errors.New("Not allowed to export conversation")
+
+// ExportConversation returns transcript of room where user is member (any room for admin)
+// or of user private conversation. Messages of muted users are filtered same as in history.
+func ExportConversation(u *User, q *ExportQuery, admin bool) (*Transcript, error) {
+	t := &Transcript{Since: q.Since, Until: q.Until, Exported: time.Now()}
+
+	switch {
+	case q.Room != "" && q.With == "":
+		room, err := GetRoomByID(q.Room)
+		if err != nil {
+			return nil, err
+		}
+		if !admin && !room.HasUser(u) {
+			return nil, ErrExportForbidden
+		}
+		t.Title = room.Name
+		t.Key = RoomHistoryKey(room)
+	case q.With != "" && q.Room == "":
+		if !UserExists(q.With) {
+			return nil, errors.New("User not found")
+		}
+		peer := GetUser(q.With, "")
+		t.Title = u.Name + " - " + peer.Name
+		t.Key = PrivateHistoryKey(u, peer)
+	default:
+		return nil, ErrExportBadQuery
+	}
+
+	messages, err := History.List(t.Key, time.Time{}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Messages = []*Message{}
+	for _, msg := range FilterMuted(messages, u) {
+		if !q.Since.IsZero() && msg.Timestamp.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && msg.Timestamp.After(q.Until) {
+			continue
+		}
+		StripMissingAttachments(msg)
+		t.Messages = append(t.Messages, msg)
+	}
+	return t, nil
+}
+
+// WriteTranscriptJSON writes one JSON message per line
+func WriteTranscriptJSON(w io.Writer, t *Transcript) error {
+	encoder := json.NewEncoder(w)
+	for _, msg := range t.Messages {
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTranscriptCSV writes header and one row per message, attachments are original paths separated by space
+func WriteTranscriptCSV(w io.Writer, t *Transcript) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "timestamp", "from_id", "from_name", "body", "attachments", "parent_id", "edited_at", "deleted"})
+	for _, msg := range t.Messages {
+		attachments := []string{}
+		for _, a := range msg.Attachments {
+			attachments = append(attachments, a.OriginalPath)
+		}
+		edited := ""
+		if msg.EditedAt != nil {
+			edited = msg.EditedAt.Format(time.RFC3339)
+		}
+		writer.Write([]string{
+			msg.ID,
+			msg.Timestamp.Format(time.RFC3339),
+			msg.From.ID,
+			msg.From.Name,
+			msg.Body,
+			strings.Join(attachments, " "),
+			msg.ParentID,
+			edited,
+			strconv.FormatBool(msg.Deleted),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteTranscriptZip writes zip with transcript file written by write and attachment files.
+// Attachment paths in transcript are replaced by paths inside zip.
+func WriteTranscriptZip(w io.Writer, t *Transcript, name string, write func(io.Writer, *Transcript) error) error {
+	bundled := *t
+	bundled.Bundled = true
+	bundled.Messages = make([]*Message, 0, len(t.Messages))
+	files := map[string]string{}
+	for _, msg := range t.Messages {
+		copied := *msg
+		copied.Attachments = make([]*Attachment, 0, len(msg.Attachments))
+		for _, a := range msg.Attachments {
+			ca := *a
+			ca.OriginalPath = exportZipPath(a.OriginalPath, files)
+			ca.MinifiedPath = exportZipPath(a.MinifiedPath, files)
+			copied.Attachments = append(copied.Attachments, &ca)
+		}
+		bundled.Messages = append(bundled.Messages, &copied)
+	}
+
+	archive := zip.NewWriter(w)
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = write(f, &bundled); err != nil {
+		return err
+	}
+	for path, file := range files {
+		if err = exportZipFile(archive, path, file); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// exportZipPath returns path of upload file inside zip and remembers it
+func exportZipPath(file string, files map[string]string) string {
+	path := EXPORT_ZIP_ATTACHMENTS + "/" + filepath.Base(file)
+	files[path] = file
+	return path
+}
+
+func exportZipFile(archive *zip.Writer, path string, file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		// Removed after transcript was prepared
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+
+	dst, err := archive.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
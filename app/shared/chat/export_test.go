@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportConversation(t *testing.T) {
+	owner := GetUser("export-owner", "Owner")
+	outsider := GetUser("export-outsider", "Outsider")
+	so := owner.NewSession()
+	defer owner.DeleteSession(so)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "export-room"}}, so)
+	to := MessageUser{ID: RoomID("export-room"), Name: "export-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	ProcessMessage(&Message{Type: "room.join", To: to}, so)
+	waitMessage(t, so, "room.join")
+
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "first"}, so)
+	waitMessage(t, so, "room.message")
+	middle := time.Now()
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "second, with \"quotes\""}, so)
+	waitMessage(t, so, "room.message")
+
+	// Only members and admins
+	if _, err := ExportConversation(outsider, &ExportQuery{Room: to.ID}, false); err != ErrExportForbidden {
+		t.Errorf("Expected forbidden, got %v", err)
+	}
+	if _, err := ExportConversation(outsider, &ExportQuery{Room: to.ID}, true); err != nil {
+		t.Errorf("Admin export failed. %s", err)
+	}
+	if _, err := ExportConversation(owner, &ExportQuery{}, false); err != ErrExportBadQuery {
+		t.Errorf("Expected bad query, got %v", err)
+	}
+
+	transcript, err := ExportConversation(owner, &ExportQuery{Room: to.ID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript.Messages) != 2 || transcript.Messages[0].Body != "first" {
+		t.Fatalf("Expected 2 messages in order, got %v", transcript.Messages)
+	}
+	ranged, _ := ExportConversation(owner, &ExportQuery{Room: to.ID, Since: middle}, false)
+	if len(ranged.Messages) != 1 || ranged.Messages[0].Body != "second, with \"quotes\"" {
+		t.Errorf("Expected second message only, got %v", ranged.Messages)
+	}
+
+	// JSON lines
+	out := &bytes.Buffer{}
+	if err = WriteTranscriptJSON(out, transcript); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	msg := &Message{}
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), msg) != nil || msg.Body != "second, with \"quotes\"" {
+		t.Errorf("Unexpected JSON lines %q", out.String())
+	}
+
+	// CSV
+	out.Reset()
+	if err = WriteTranscriptCSV(out, transcript); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(out).ReadAll()
+	if err != nil || len(records) != 3 || records[2][4] != "second, with \"quotes\"" || records[2][3] != "Owner" {
+		t.Errorf("Unexpected CSV %v. %v", records, err)
+	}
+}
+
+func TestWriteTranscriptZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "picture.png")
+	if err = ioutil.WriteFile(file, []byte("png"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	transcript := &Transcript{Messages: []*Message{{
+		ID:          "1",
+		Body:        "look",
+		Attachments: []*Attachment{{OriginalPath: file, MinifiedPath: file}},
+	}}}
+
+	out := &bytes.Buffer{}
+	if err = WriteTranscriptZip(out, transcript, "transcript.jsonl", WriteTranscriptJSON); err != nil {
+		t.Fatal(err)
+	}
+	if transcript.Bundled || transcript.Messages[0].Attachments[0].OriginalPath != file {
+		t.Error("Source transcript changed")
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, _ := f.Open()
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+	}
+	if files["attachments/picture.png"] != "png" {
+		t.Errorf("Attachment not bundled, files %v", files)
+	}
+	msg := &Message{}
+	if err = json.Unmarshal([]byte(files["transcript.jsonl"]), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Attachments[0].OriginalPath != "attachments/picture.png" {
+		t.Errorf("Attachment path not replaced, got %s", msg.Attachments[0].OriginalPath)
+	}
+}
@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// Handler processes client message of one type
+type Handler interface {
+	Handle(c *Context)
+}
+
+// HandlerFunc lets function be used as Handler
+type HandlerFunc func(c *Context)
+
+func (f HandlerFunc) Handle(c *Context) {
+	f(c)
+}
+
+// Middleware wraps handler with reusable check or change of message.
+// It calls next.Handle to continue processing or returns to stop it (usually after error message to session).
+type Middleware func(next Handler) Handler
+
+// Context is processed message with its session, middleware resolves conversation for handler
+type Context struct {
+	Msg     *Message
+	Session *Session
+	Room    *Room // Set by RequireRoom
+	Peer    *User // Set by RequirePeer
+	Action  bool  // Set by SlashCommands when command made action message, kept by Stamp
+}
+
+type HandlerStoreType struct {
+	Map map[string]Handler
+	Mu  sync.Mutex
+}
+
+// Handlers by message type, built-in are registered in init of chat.go
+var HandlerStore = HandlerStoreType{
+	Map: map[string]Handler{},
+	Mu:  sync.Mutex{},
+}
+
+// RegisterHandler sets handler of message type wrapped by middleware, first middleware runs first.
+// Handler registered for the same type is replaced.
+func RegisterHandler(mtype string, h Handler, middleware ...Middleware) {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+
+	HandlerStore.Mu.Lock()
+	HandlerStore.Map[mtype] = h
+	HandlerStore.Mu.Unlock()
+}
+
+func GetHandler(mtype string) Handler {
+	HandlerStore.Mu.Lock()
+	defer HandlerStore.Mu.Unlock()
+
+	return HandlerStore.Map[mtype]
+}
+
+// ProcessMessage passes client message to handler of its type, unknown types are ignored
+func ProcessMessage(msg *Message, session *Session) {
+	h := GetHandler(msg.Type)
+	if h == nil {
+		return
+	}
+	h.Handle(&Context{Msg: msg, Session: session})
+}
+
+// SlashCommands runs command typed in message text, see command.go.
+// Message rewritten by command (e.g. '/me') continues to next handler.
+func SlashCommands(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if IsCommand(c.Msg) {
+			// Only command can make action message, not client
+			c.Msg.Action = false
+			if !processCommand(c.Msg, c.Session) {
+				return
+			}
+			c.Action = c.Msg.Action
+		}
+		next.Handle(c)
+	})
+}
+
+// CheckRoomName stops message with bad room name in msg.To
+func CheckRoomName(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if !ValidateRoomName(c.Msg.To.Name) {
+			PublishMessage(c.Session.ID, MessageRoomBadName(c.Session))
+			return
+		}
+		next.Handle(c)
+	})
+}
+
+// RequireRoom sets c.Room from msg.To.ID
+func RequireRoom(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		room, err := GetRoomByID(c.Msg.To.ID)
+		if err != nil {
+			PublishMessage(c.Session.ID, MessageRoomNotFound(c.Session))
+			return
+		}
+		c.Room = room
+		next.Handle(c)
+	})
+}
+
+// RequireRoomMember stops message of user not joined to c.Room, use after RequireRoom
+func RequireRoomMember(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if !c.Room.HasUser(c.Session.User) {
+			PublishMessage(c.Session.ID, MessageUserNotInRoom(c.Session, c.Room))
+			return
+		}
+		next.Handle(c)
+	})
+}
+
+// RequireRoomModerator stops message of user who is not owner or moderator of c.Room, use after RequireRoom
+func RequireRoomModerator(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if !c.Room.IsModerator(c.Session.User) {
+			PublishMessage(c.Session.ID, MessageRoomForbidden(c.Session, c.Room))
+			return
+		}
+		next.Handle(c)
+	})
+}
+
+// RequireRoomOwner stops message of user who is not owner of c.Room, use after RequireRoom
+func RequireRoomOwner(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if c.Room.Role(c.Session.User) != ROLE_OWNER {
+			PublishMessage(c.Session.ID, MessageRoomForbidden(c.Session, c.Room))
+			return
+		}
+		next.Handle(c)
+	})
+}
+
+// RequirePeer sets c.Peer to user from msg.To.ID
+func RequirePeer(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if !UserExists(c.Msg.To.ID) {
+			PublishMessage(c.Session.ID, MessageUserNotFound(c.Session, c.Msg.To))
+			return
+		}
+		c.Peer = GetUser(c.Msg.To.ID, "")
+		next.Handle(c)
+	})
+}
+
+// SkipMuted silently drops message if user muted c.Peer (unmute first!) or c.Peer muted user, use after RequirePeer
+func SkipMuted(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if check, _ := c.Session.User.CheckInMute(c.Peer); check == true {
+			return
+		}
+		if check, _ := c.Peer.CheckInMute(c.Session.User); check == true {
+			return
+		}
+		next.Handle(c)
+	})
+}
+
+// FilterContent truncates text and replaces bad words by ValidateMessage, drops empty messages
+func FilterContent(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if !ValidateMessage(c.Msg, c.Session) {
+			return
+		}
+		next.Handle(c)
+	})
+}
+
+// Stamp sets sender from session data (to prevent message fake), new timestamp and ID, clears server fields
+func Stamp(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		c.Msg.From = MessageUser{
+			ID:   c.Session.User.ID,
+			Name: c.Session.User.Name,
+		}
+		c.Msg.Timestamp = time.Now()
+		c.Msg.ID = NewMessageID()
+		c.Msg.ClearServerFields()
+		c.Msg.Action = c.Action
+		next.Handle(c)
+	})
+}
+
+// RateLimit counts message in user fixed window, over FIXED_WINDOW_MAX user receives 'to_many_requests'
+func RateLimit(next Handler) Handler {
+	return HandlerFunc(func(c *Context) {
+		if !c.Session.User.AllowMessage() {
+			PublishMessage(c.Session.ID, MessageToManyRequests(c.Session, c.Msg.To))
+			return
+		}
+		next.Handle(c)
+	})
+}
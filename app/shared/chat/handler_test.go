@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"testing"
+)
+
+func TestRegisterHandler(t *testing.T) {
+	alice := GetUser("handler-alice", "Alice")
+	s := alice.NewSession()
+	defer alice.DeleteSession(s)
+
+	// Middleware run in order and can stop processing
+	calls := []string{}
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(c *Context) {
+				calls = append(calls, name)
+				if c.Msg.Body == "stop" && name == "second" {
+					return
+				}
+				next.Handle(c)
+			})
+		}
+	}
+	var handled *Context
+	RegisterHandler("test.custom", HandlerFunc(func(c *Context) {
+		handled = c
+	}), trace("first"), trace("second"), RequireRoom, RequireRoomMember, Stamp)
+	defer func() {
+		HandlerStore.Mu.Lock()
+		delete(HandlerStore.Map, "test.custom")
+		HandlerStore.Mu.Unlock()
+	}()
+
+	room, err := GetRoom("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := MessageUser{ID: room.ID, Name: room.Name}
+
+	ProcessMessage(&Message{Type: "test.custom", To: to, Body: "stop"}, s)
+	if handled != nil || len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Fatalf("Expected stop after second middleware, calls %v", calls)
+	}
+
+	// Not a member
+	ProcessMessage(&Message{Type: "test.custom", To: to}, s)
+	waitMessage(t, s, "room.not_joined")
+	if handled != nil {
+		t.Fatal("Handler called for not member")
+	}
+
+	ProcessMessage(&Message{Type: "room.join", To: to}, s)
+	waitMessage(t, s, "room.join")
+	ProcessMessage(&Message{Type: "test.custom", To: to, From: MessageUser{ID: "fake"}, StreamSeq: 42}, s)
+	if handled == nil || handled.Room != room || handled.Msg.From.ID != alice.ID || handled.Msg.ID == "" || handled.Msg.StreamSeq != 0 {
+		t.Fatalf("Expected stamped message with room in context, got %+v", handled)
+	}
+
+	// Unknown type ignored
+	ProcessMessage(&Message{Type: "test.unknown"}, s)
+}
+
+func TestRateLimit(t *testing.T) {
+	bob := GetUser("handler-bob", "Bob")
+	s := bob.NewSession()
+	defer bob.DeleteSession(s)
+
+	bob.FixedWindowCounterMu.Lock()
+	bob.FixedWindowCounter = FIXED_WINDOW_MAX + 1
+	bob.FixedWindowCounterMu.Unlock()
+	defer AdminResetUser(bob.ID)
+
+	called := false
+	RateLimit(HandlerFunc(func(c *Context) { called = true })).Handle(&Context{Msg: &Message{}, Session: s})
+	if called {
+		t.Error("Handler called over limit")
+	}
+	waitMessage(t, s, "to_many_requests")
+}
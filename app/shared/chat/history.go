@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+)
+
+// HistoryStorage keeps messages of conversations (rooms, private chats).
+// Conversation addressed by string key, see RoomHistoryKey.
+type HistoryStorage interface {
+	// Append adds message to the end of conversation.
+	// If conversation become longer than max - oldest messages removed and returned (0 - unlimited)
+	Append(key string, msg *Message, max int) ([]*Message, error)
+	// List returns last limit messages (0 - all) sent before time (zero - no bound) in chronological order
+	List(key string, before time.Time, limit int) ([]*Message, error)
+	// Get returns message of conversation by message ID
+	Get(key string, id string) (*Message, error)
+	// Update replaces stored message with the same ID
+	Update(key string, msg *Message) error
+	// Drop removes conversation and returns all removed messages
+	Drop(key string) ([]*Message, error)
+	// Walk calls fn for every stored message, stops on first error
+	Walk(fn func(key string, msg *Message) error) error
+}
+
+// ErrStorageUnavailable returned when database connection is lost
+var ErrStorageUnavailable = errors.New("Database is unavailable.")
+
+// ErrMessageNotFound returned when conversation has no message with requested ID
+var ErrMessageNotFound = errors.New("Message not found.")
+
+// History is the storage used by chat, set in Init depending on configured database
+var History HistoryStorage = NewMemoryHistory()
+
+// NewHistoryStorage returns storage for configured database type.
+// Fallback to memory storage (history lost on restart) if database not connected.
+func NewHistoryStorage(d database.Info) HistoryStorage {
+	switch d.Type {
+	case database.TypeBolt:
+		if database.BoltDB != nil {
+			return &BoltHistory{}
+		}
+	case database.TypeMongoDB:
+		if database.CheckConnection() {
+			return &MongoHistory{}
+		}
+	case database.TypeMySQL:
+		if database.SQL != nil {
+			return &MySQLHistory{}
+		}
+	}
+
+	log.Println("Chat: no database for history, messages will be lost on restart")
+	return NewMemoryHistory()
+}
+
+type historyLock struct {
+	Mu   sync.Mutex
+	Refs int
+}
+
+// Locks of conversations with stored message being changed, see LockHistory
+var historyLocks = struct {
+	Map map[string]*historyLock
+	Mu  sync.Mutex
+}{
+	Map: map[string]*historyLock{},
+	Mu:  sync.Mutex{},
+}
+
+// LockHistory serializes read-modify-write of stored messages (edit, reactions, thread info) of conversation
+// on this node, so concurrent changes are not lost. Returns unlock function.
+func LockHistory(key string) func() {
+	historyLocks.Mu.Lock()
+	l := historyLocks.Map[key]
+	if l == nil {
+		l = &historyLock{}
+		historyLocks.Map[key] = l
+	}
+	l.Refs++
+	historyLocks.Mu.Unlock()
+
+	l.Mu.Lock()
+	return func() {
+		l.Mu.Unlock()
+
+		historyLocks.Mu.Lock()
+		l.Refs--
+		if l.Refs == 0 {
+			delete(historyLocks.Map, key)
+		}
+		historyLocks.Mu.Unlock()
+	}
+}
+
+func RoomHistoryKey(room *Room) string {
+	return "room:" + room.Name
+}
+
+// limitHistory returns copy of last limit messages sent before time, for storages which filter in memory
+func limitHistory(history []*Message, before time.Time, limit int) []*Message {
+	result := []*Message{}
+	for _, msg := range history {
+		if !before.IsZero() && !msg.Timestamp.Before(before) {
+			continue
+		}
+		result = append(result, msg)
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// MemoryHistory keeps history in process memory
+type MemoryHistory struct {
+	Map map[string][]*Message
+	Mu  sync.Mutex
+}
+
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{
+		Map: map[string][]*Message{},
+		Mu:  sync.Mutex{},
+	}
+}
+
+func (h *MemoryHistory) Append(key string, msg *Message, max int) ([]*Message, error) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	history := append(h.Map[key], msg)
+	dropped := []*Message{}
+	if max > 0 && len(history) > max {
+		dropped = append(dropped, history[:len(history)-max]...)
+		history = history[len(history)-max:]
+	}
+	h.Map[key] = history
+
+	return dropped, nil
+}
+
+func (h *MemoryHistory) List(key string, before time.Time, limit int) ([]*Message, error) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	return limitHistory(h.Map[key], before, limit), nil
+}
+
+func (h *MemoryHistory) Get(key string, id string) (*Message, error) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for _, msg := range h.Map[key] {
+		if msg.ID == id {
+			return msg.Clone(), nil
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (h *MemoryHistory) Update(key string, msg *Message) error {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for i, stored := range h.Map[key] {
+		if stored.ID == msg.ID {
+			h.Map[key][i] = msg.Clone()
+			return nil
+		}
+	}
+	return ErrMessageNotFound
+}
+
+func (h *MemoryHistory) Drop(key string) ([]*Message, error) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	dropped := h.Map[key]
+	delete(h.Map, key)
+	return dropped, nil
+}
+
+func (h *MemoryHistory) Walk(fn func(key string, msg *Message) error) error {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for key, history := range h.Map {
+		for _, msg := range history {
+			if err := fn(key, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
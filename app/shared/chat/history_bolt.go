@@ -0,0 +1,263 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+
+	"github.com/boltdb/bolt"
+)
+
+const boltHistoryBucket = "chat_history"
+
+var boltHistoryMessages = []byte("messages")
+var boltHistoryIDs = []byte("ids")
+
+// BoltHistory keeps each conversation in nested bucket of chat_history named by hex of conversation key.
+// Hex protects from room names with "/" inside.
+// Conversation bucket has "messages" bucket with zero padded sequence keys, so cursor returns messages in order,
+// and "ids" bucket with sequence key of message ID, so Get and Update don't read whole conversation.
+type BoltHistory struct{}
+
+// boltConversation returns messages and ids buckets of conversation, nil buckets if it not exists and create is false
+func boltConversation(tx *bolt.Tx, key string, create bool) (*bolt.Bucket, *bolt.Bucket, error) {
+	name := []byte(hex.EncodeToString([]byte(key)))
+	if !create {
+		b := tx.Bucket([]byte(boltHistoryBucket))
+		if b == nil {
+			return nil, nil, nil
+		}
+		conversation := b.Bucket(name)
+		if conversation == nil {
+			return nil, nil, nil
+		}
+		return conversation.Bucket(boltHistoryMessages), conversation.Bucket(boltHistoryIDs), nil
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(boltHistoryBucket))
+	if err != nil {
+		return nil, nil, err
+	}
+	conversation, err := b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err := conversation.CreateBucketIfNotExists(boltHistoryMessages)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := conversation.CreateBucketIfNotExists(boltHistoryIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return messages, ids, nil
+}
+
+// boltHistoryPut stores message under seqKey, new sequence key if it is nil, and indexes its ID
+func boltHistoryPut(messages *bolt.Bucket, ids *bolt.Bucket, msg *Message, seqKey []byte) error {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if seqKey == nil {
+		seq, err := messages.NextSequence()
+		if err != nil {
+			return err
+		}
+		seqKey = []byte(fmt.Sprintf("%020d", seq))
+	}
+	if err = messages.Put(seqKey, encoded); err != nil {
+		return err
+	}
+	if msg.ID == "" {
+		return nil
+	}
+	return ids.Put([]byte(msg.ID), seqKey)
+}
+
+func boltHistoryDecode(v []byte) *Message {
+	msg := &Message{}
+	if err := json.Unmarshal(v, msg); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return msg
+}
+
+func (h *BoltHistory) Append(key string, msg *Message, max int) ([]*Message, error) {
+	dropped := []*Message{}
+
+	err := database.BoltDB.Update(func(tx *bolt.Tx) error {
+		messages, ids, err := boltConversation(tx, key, true)
+		if err != nil {
+			return err
+		}
+		if err = boltHistoryPut(messages, ids, msg, nil); err != nil {
+			return err
+		}
+
+		if max <= 0 {
+			return nil
+		}
+
+		// Skip max newest messages, older ones are dropped
+		c := messages.Cursor()
+		k, _ := c.Last()
+		for i := 0; i < max && k != nil; i++ {
+			k, _ = c.Prev()
+		}
+		keys := [][]byte{}
+		for ; k != nil; k, _ = c.Prev() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			if old := boltHistoryDecode(messages.Get(keys[i])); old != nil {
+				// ID may be appended again, then index points to newer message
+				if bytes.Equal(ids.Get([]byte(old.ID)), keys[i]) {
+					if err = ids.Delete([]byte(old.ID)); err != nil {
+						return err
+					}
+				}
+				dropped = append(dropped, old)
+			}
+			if err = messages.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return dropped, err
+}
+
+func (h *BoltHistory) List(key string, before time.Time, limit int) ([]*Message, error) {
+	reversed := []*Message{}
+
+	err := database.BoltDB.View(func(tx *bolt.Tx) error {
+		messages, _, err := boltConversation(tx, key, false)
+		if err != nil || messages == nil {
+			return err
+		}
+
+		// Newest first until limit
+		c := messages.Cursor()
+		for k, v := c.Last(); k != nil && (limit <= 0 || len(reversed) < limit); k, v = c.Prev() {
+			msg := boltHistoryDecode(v)
+			if msg == nil || (!before.IsZero() && !msg.Timestamp.Before(before)) {
+				continue
+			}
+			reversed = append(reversed, msg)
+		}
+		return nil
+	})
+
+	result := make([]*Message, 0, len(reversed))
+	for i := len(reversed) - 1; i >= 0; i-- {
+		result = append(result, reversed[i])
+	}
+	return result, err
+}
+
+func (h *BoltHistory) Get(key string, id string) (*Message, error) {
+	var found *Message
+
+	err := database.BoltDB.View(func(tx *bolt.Tx) error {
+		messages, ids, err := boltConversation(tx, key, false)
+		if err != nil {
+			return err
+		}
+		if ids == nil {
+			return ErrMessageNotFound
+		}
+
+		seqKey := ids.Get([]byte(id))
+		if seqKey == nil {
+			return ErrMessageNotFound
+		}
+		if found = boltHistoryDecode(messages.Get(seqKey)); found == nil {
+			return ErrMessageNotFound
+		}
+		return nil
+	})
+
+	return found, err
+}
+
+func (h *BoltHistory) Update(key string, msg *Message) error {
+	return database.BoltDB.Update(func(tx *bolt.Tx) error {
+		messages, ids, err := boltConversation(tx, key, false)
+		if err != nil {
+			return err
+		}
+		if ids == nil {
+			return ErrMessageNotFound
+		}
+
+		seqKey := ids.Get([]byte(msg.ID))
+		if seqKey == nil {
+			return ErrMessageNotFound
+		}
+		// Value points to page of ids bucket which is changed by Put, so copy it
+		return boltHistoryPut(messages, ids, msg, append([]byte{}, seqKey...))
+	})
+}
+
+func (h *BoltHistory) Drop(key string) ([]*Message, error) {
+	dropped := []*Message{}
+
+	err := database.BoltDB.Update(func(tx *bolt.Tx) error {
+		messages, _, err := boltConversation(tx, key, false)
+		if err != nil || messages == nil {
+			return err
+		}
+
+		err = messages.ForEach(func(k, v []byte) error {
+			if msg := boltHistoryDecode(v); msg != nil {
+				dropped = append(dropped, msg)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(boltHistoryBucket)).DeleteBucket([]byte(hex.EncodeToString([]byte(key))))
+	})
+
+	return dropped, err
+}
+
+func (h *BoltHistory) Walk(fn func(key string, msg *Message) error) error {
+	return database.BoltDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(boltHistoryBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(name, v []byte) error {
+			// Conversations are nested buckets
+			conversation := b.Bucket(name)
+			if v != nil || conversation == nil {
+				return nil
+			}
+			key, err := hex.DecodeString(string(name))
+			if err != nil {
+				return nil
+			}
+			messages := conversation.Bucket(boltHistoryMessages)
+			if messages == nil {
+				return nil
+			}
+			return messages.ForEach(func(k, v []byte) error {
+				if msg := boltHistoryDecode(v); msg != nil {
+					return fn(string(key), msg)
+				}
+				return nil
+			})
+		})
+	})
+}
@@ -0,0 +1,99 @@
+//go:build !race
+// +build !race
+
+// boltdb v1.3.1 fails pointer checks enabled by race detector
+
+package chat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBoltHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bolt.Open(filepath.Join(dir, "history.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	previous := database.BoltDB
+	database.BoltDB = db
+	defer func() { database.BoltDB = previous }()
+
+	h := &BoltHistory{}
+	if _, err = h.Append("room:other", &Message{ID: "other", Type: "room.message", Body: "other room"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.Get("room:bolt/history", "other"); err != ErrMessageNotFound {
+		t.Errorf("Expected message of other room not found, got %v", err)
+	}
+
+	key := "room:bolt/history"
+	now := time.Now()
+	for i, id := range []string{"m1", "m2", "m3"} {
+		dropped, err := h.Append(key, &Message{ID: id, Type: "room.message", Body: id, Timestamp: now.Add(time.Duration(i) * time.Second)}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == "m3" && (len(dropped) != 1 || dropped[0].ID != "m1") {
+			t.Errorf("Expected m1 dropped, got %v", dropped)
+		}
+	}
+	if _, err = h.Get(key, "m1"); err != ErrMessageNotFound {
+		t.Errorf("Expected dropped message not found, got %v", err)
+	}
+
+	msg, err := h.Get(key, "m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Body = "edited"
+	if err = h.Update(key, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Update(key, &Message{ID: "m1"}); err != ErrMessageNotFound {
+		t.Errorf("Expected not found on update of dropped message, got %v", err)
+	}
+
+	list, err := h.List(key, time.Time{}, 0)
+	if err != nil || len(list) != 2 || list[0].Body != "edited" || list[1].ID != "m3" {
+		t.Fatalf("Unexpected history %v. %v", list, err)
+	}
+	if list, _ = h.List(key, now.Add(2*time.Second), 1); len(list) != 1 || list[0].ID != "m2" {
+		t.Errorf("Expected m2 before m3, got %v", list)
+	}
+	if list, _ = h.List(key, time.Time{}, 1); len(list) != 1 || list[0].ID != "m3" {
+		t.Errorf("Expected last message, got %v", list)
+	}
+
+	walked := map[string]int{}
+	h.Walk(func(k string, m *Message) error {
+		walked[k]++
+		return nil
+	})
+	if walked[key] != 2 || walked["room:other"] != 1 {
+		t.Errorf("Unexpected walked messages %v", walked)
+	}
+
+	dropped, err := h.Drop(key)
+	if err != nil || len(dropped) != 2 {
+		t.Fatalf("Expected 2 dropped messages, got %d. %v", len(dropped), err)
+	}
+	if list, _ = h.List(key, time.Time{}, 0); len(list) != 0 {
+		t.Errorf("Dropped conversation listed %v", list)
+	}
+}
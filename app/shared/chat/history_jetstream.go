@@ -0,0 +1,452 @@
+package chat
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Room stream is named ROOM_STREAM_PREFIX + room ID and stores subjects ROOM_STREAM_SUBJECT + room ID + "." + message ID
+const ROOM_STREAM_PREFIX = "CHAT_ROOM_"
+const ROOM_STREAM_SUBJECT = "chat.history."
+
+// Wait for next revision while reading stream
+const ROOM_STREAM_FETCH_TIMEOUT = 5 * time.Second
+
+// Maximum messages returned by one 'room.replay'
+const ROOM_REPLAY_LIMIT = 100
+
+// JetStreamConfig backs room history with JetStream stream per room
+type JetStreamConfig struct {
+	Enabled  bool `json:"Enabled"`
+	MaxAge   int  `json:"MaxAge"`   // Seconds, 0 - unlimited. Count limited by MaxRoomHistoryMessages
+	Replicas int  `json:"Replicas"` // Stream replicas in NATS cluster, 0 - 1
+}
+
+// JetStreamHistory keeps room conversations in streams, other conversations in Fallback storage.
+// Stream is source of truth: every Append and Update publishes full message revision to subject of message,
+// stream keeps the last revision per subject, so its count limit is count of messages. Cache keeps the same:
+// read revision replaces previous one of message ID. Stream limits (count and age) are applied by server,
+// messages without revisions left in stream are reported as dropped by next Append.
+type JetStreamHistory struct {
+	JS       nats.JetStreamContext
+	Config   JetStreamConfig
+	Fallback HistoryStorage
+	Rooms    map[string]*jetStreamRoom // Cache of read revisions by stream name
+	Mu       sync.Mutex
+}
+
+type jetStreamRecord struct {
+	Seq  uint64
+	Time time.Time
+	ID   string
+	Data []byte
+}
+
+// jetStreamRoom is last revisions read from stream, updated from LastSeq on each access
+type jetStreamRoom struct {
+	Records []*jetStreamRecord          // Ordered by Seq
+	IDs     map[string]*jetStreamRecord // Record of message ID
+	LastSeq uint64
+	Dropped []*Message
+	Ready   bool // Stream created with current limits
+	Mu      sync.Mutex
+}
+
+// RoomReplay is body of 'room.replay' response
+type RoomReplay struct {
+	Messages []*Message `json:"messages"`
+	LastSeq  uint64     `json:"last_seq"` // Send as 'seq' to continue
+	More     bool       `json:"more"`
+}
+
+func NewJetStreamHistory(nc *nats.Conn, c JetStreamConfig, fallback HistoryStorage) (*JetStreamHistory, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	// Fails if server has no JetStream
+	if _, err := js.AccountInfo(); err != nil {
+		return nil, err
+	}
+	return &JetStreamHistory{
+		JS:       js,
+		Config:   c,
+		Fallback: fallback,
+		Rooms:    map[string]*jetStreamRoom{},
+		Mu:       sync.Mutex{},
+	}, nil
+}
+
+// roomStream returns stream name for room history key, false for other conversations
+func roomStream(key string) (string, bool) {
+	if !strings.HasPrefix(key, "room:") {
+		return "", false
+	}
+	return ROOM_STREAM_PREFIX + RoomID(strings.TrimPrefix(key, "room:")), true
+}
+
+func (h *JetStreamHistory) room(stream string) *jetStreamRoom {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	if h.Rooms[stream] == nil {
+		h.Rooms[stream] = &jetStreamRoom{Records: []*jetStreamRecord{}, IDs: map[string]*jetStreamRecord{}}
+	}
+	return h.Rooms[stream]
+}
+
+// streamSubject returns subject of message revisions in room stream
+func streamSubject(stream string, id string) string {
+	if id == "" {
+		id = "-"
+	}
+	return ROOM_STREAM_SUBJECT + strings.TrimPrefix(stream, ROOM_STREAM_PREFIX) + "." + id
+}
+
+// ensureStream creates stream or updates its limits, max is count of messages (0 - unlimited)
+func (h *JetStreamHistory) ensureStream(key string, stream string, max int) error {
+	config := &nats.StreamConfig{
+		Name:              stream,
+		Description:       key,
+		Subjects:          []string{streamSubject(stream, "*")},
+		MaxMsgs:           -1,
+		MaxMsgsPerSubject: 1, // Previous revisions of message removed by new one
+		MaxAge:            time.Duration(h.Config.MaxAge) * time.Second,
+		Storage:           nats.FileStorage,
+		Replicas:          h.Config.Replicas,
+		Discard:           nats.DiscardOld,
+	}
+	if max > 0 {
+		config.MaxMsgs = int64(max)
+	}
+	if config.Replicas == 0 {
+		config.Replicas = 1
+	}
+
+	info, err := h.JS.StreamInfo(stream)
+	if err == nats.ErrStreamNotFound {
+		_, err = h.JS.AddStream(config)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if info.Config.MaxMsgs != config.MaxMsgs || info.Config.MaxAge != config.MaxAge ||
+		info.Config.MaxMsgsPerSubject != config.MaxMsgsPerSubject || len(info.Config.Subjects) != 1 || info.Config.Subjects[0] != config.Subjects[0] {
+		_, err = h.JS.UpdateStream(config)
+	}
+	return err
+}
+
+// sync reads new revisions, forgets revisions removed by stream limits. Must be called with r.Mu locked.
+func (h *JetStreamHistory) sync(stream string, r *jetStreamRoom) error {
+	info, err := h.JS.StreamInfo(stream)
+	if err != nil && err != nats.ErrStreamNotFound {
+		return err
+	}
+
+	// Stream removed (room deleted by other node) or recreated
+	if err == nats.ErrStreamNotFound || info.State.LastSeq < r.LastSeq {
+		r.Dropped = append(r.Dropped, r.messages()...)
+		r.Records = []*jetStreamRecord{}
+		r.IDs = map[string]*jetStreamRecord{}
+		r.LastSeq = 0
+		r.Ready = false
+		if err == nats.ErrStreamNotFound {
+			return nil
+		}
+	}
+
+	first := info.State.FirstSeq
+	start := r.LastSeq + 1
+	if start < first {
+		start = first
+	}
+	if start <= info.State.LastSeq && info.State.Msgs > 0 {
+		if err := h.fetch(stream, r, start, info.State.LastSeq); err != nil {
+			return err
+		}
+	}
+	if info.State.LastSeq > r.LastSeq {
+		r.LastSeq = info.State.LastSeq
+	}
+
+	// Removed by limits. Revisions replaced after first are already removed by fetch, so rest is dropped.
+	i := sort.Search(len(r.Records), func(i int) bool { return r.Records[i].Seq >= first })
+	for _, record := range r.Records[:i] {
+		delete(r.IDs, record.ID)
+		if msg := record.message(); msg != nil {
+			r.Dropped = append(r.Dropped, msg)
+		}
+	}
+	r.Records = append(r.Records[:0], r.Records[i:]...)
+	return nil
+}
+
+// fetch reads revisions from start to last by ordered consumer, sequences of replaced revisions are skipped by server
+func (h *JetStreamHistory) fetch(stream string, r *jetStreamRoom, start uint64, last uint64) error {
+	sub, err := h.JS.SubscribeSync("", nats.BindStream(stream), nats.OrderedConsumer(), nats.StartSequence(start))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		raw, err := sub.NextMsg(ROOM_STREAM_FETCH_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		meta, err := raw.Metadata()
+		if err != nil {
+			return err
+		}
+		r.add(meta.Sequence.Stream, meta.Timestamp, raw.Data)
+		if meta.Sequence.Stream >= last || meta.NumPending == 0 {
+			return nil
+		}
+	}
+}
+
+// add keeps revision as the last one of its message ID
+func (r *jetStreamRoom) add(seq uint64, t time.Time, data []byte) {
+	if seq <= r.LastSeq {
+		return
+	}
+	msg := Message{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	if previous := r.IDs[msg.ID]; previous != nil {
+		i := sort.Search(len(r.Records), func(i int) bool { return r.Records[i].Seq >= previous.Seq })
+		r.Records = append(r.Records[:i], r.Records[i+1:]...)
+	}
+	record := &jetStreamRecord{Seq: seq, Time: t, ID: msg.ID, Data: data}
+	r.Records = append(r.Records, record)
+	r.IDs[msg.ID] = record
+	r.LastSeq = seq
+}
+
+// message decodes revision, every call returns new message
+func (record *jetStreamRecord) message() *Message {
+	msg := &Message{}
+	if err := json.Unmarshal(record.Data, msg); err != nil {
+		return nil
+	}
+	msg.StreamSeq = record.Seq
+	return msg
+}
+
+// messages returns cached messages in stream order
+func (r *jetStreamRoom) messages() []*Message {
+	messages := make([]*Message, 0, len(r.Records))
+	for _, record := range r.Records {
+		if msg := record.message(); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// publish stores revision and sets msg.StreamSeq, so live message can be used as replay position
+func (h *JetStreamHistory) publish(stream string, r *jetStreamRoom, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ack, err := h.JS.Publish(streamSubject(stream, msg.ID), data)
+	if err != nil {
+		return err
+	}
+	msg.StreamSeq = ack.Sequence
+	// Revisions of other nodes between LastSeq and ack read by next sync
+	if ack.Sequence == r.LastSeq+1 {
+		r.add(ack.Sequence, time.Now(), data)
+	}
+	return nil
+}
+
+func (h *JetStreamHistory) Append(key string, msg *Message, max int) ([]*Message, error) {
+	stream, ok := roomStream(key)
+	if !ok {
+		return h.Fallback.Append(key, msg, max)
+	}
+
+	r := h.room(stream)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if !r.Ready {
+		if err := h.ensureStream(key, stream, max); err != nil {
+			return nil, err
+		}
+		r.Ready = true
+	}
+
+	if err := h.publish(stream, r, msg); err != nil {
+		r.Ready = false
+		return nil, err
+	}
+	if err := h.sync(stream, r); err != nil {
+		return nil, err
+	}
+
+	dropped := r.Dropped
+	r.Dropped = []*Message{}
+	return dropped, nil
+}
+
+func (h *JetStreamHistory) List(key string, before time.Time, limit int) ([]*Message, error) {
+	stream, ok := roomStream(key)
+	if !ok {
+		return h.Fallback.List(key, before, limit)
+	}
+
+	r := h.room(stream)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if err := h.sync(stream, r); err != nil {
+		return nil, err
+	}
+
+	messages := r.messages()
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+	return limitHistory(messages, before, limit), nil
+}
+
+func (h *JetStreamHistory) Get(key string, id string) (*Message, error) {
+	stream, ok := roomStream(key)
+	if !ok {
+		return h.Fallback.Get(key, id)
+	}
+
+	r := h.room(stream)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if err := h.sync(stream, r); err != nil {
+		return nil, err
+	}
+
+	record := r.IDs[id]
+	if record == nil {
+		return nil, ErrMessageNotFound
+	}
+	if msg := record.message(); msg != nil {
+		return msg, nil
+	}
+	return nil, ErrMessageNotFound
+}
+
+// Update publishes new revision of message
+func (h *JetStreamHistory) Update(key string, msg *Message) error {
+	stream, ok := roomStream(key)
+	if !ok {
+		return h.Fallback.Update(key, msg)
+	}
+
+	r := h.room(stream)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if err := h.sync(stream, r); err != nil {
+		return err
+	}
+
+	if r.IDs[msg.ID] == nil {
+		return ErrMessageNotFound
+	}
+
+	return h.publish(stream, r, msg)
+}
+
+func (h *JetStreamHistory) Drop(key string) ([]*Message, error) {
+	stream, ok := roomStream(key)
+	if !ok {
+		return h.Fallback.Drop(key)
+	}
+
+	r := h.room(stream)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if err := h.sync(stream, r); err != nil {
+		return nil, err
+	}
+
+	err := h.JS.DeleteStream(stream)
+	if err != nil && err != nats.ErrStreamNotFound {
+		return nil, err
+	}
+
+	dropped := append(r.Dropped, r.messages()...)
+	h.Mu.Lock()
+	delete(h.Rooms, stream)
+	h.Mu.Unlock()
+	return dropped, nil
+}
+
+func (h *JetStreamHistory) Walk(fn func(key string, msg *Message) error) error {
+	for stream := range h.JS.StreamNames() {
+		if !strings.HasPrefix(stream, ROOM_STREAM_PREFIX) {
+			continue
+		}
+		info, err := h.JS.StreamInfo(stream)
+		if err != nil {
+			return err
+		}
+		if _, ok := roomStream(info.Config.Description); !ok {
+			continue
+		}
+		messages, err := h.List(info.Config.Description, time.Time{}, 0)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			if err := fn(info.Config.Description, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return h.Fallback.Walk(fn)
+}
+
+// Replay returns messages of room in stream order, starting after seq or from time since.
+// Stream keeps the last revision of message only, so edited message is returned once, at position of its last revision.
+func (h *JetStreamHistory) Replay(key string, seq uint64, since time.Time, limit int) (*RoomReplay, error) {
+	stream, _ := roomStream(key)
+
+	r := h.room(stream)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if err := h.sync(stream, r); err != nil {
+		return nil, err
+	}
+
+	replay := &RoomReplay{Messages: []*Message{}, LastSeq: seq}
+	for _, record := range r.Records {
+		if record.Seq <= seq || (!since.IsZero() && record.Time.Before(since)) {
+			continue
+		}
+		if limit > 0 && len(replay.Messages) >= limit {
+			replay.More = true
+			break
+		}
+		msg := record.message()
+		if msg == nil {
+			continue
+		}
+		replay.Messages = append(replay.Messages, msg)
+		replay.LastSeq = record.Seq
+	}
+	return replay, nil
+}
@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJetStreamHistory(t *testing.T) {
+	c := DefaultConfig()
+	c.NATSServer = NATSServerConfig{
+		Enabled:   true,
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	}
+	c.JetStream = JetStreamConfig{Enabled: true}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBus(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	h, err := NewJetStreamHistory(b.(*NATSBus).Conn, c.JetStream, NewMemoryHistory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "room:jetstream"
+	base := time.Now()
+	messages := []*Message{}
+	for i, body := range []string{"m1", "m2", "m3"} {
+		msg := &Message{ID: body, Type: "room.message", Body: body, Timestamp: base.Add(time.Duration(i) * time.Second)}
+		if _, err := h.Append(key, msg, 3); err != nil {
+			t.Fatal(err)
+		}
+		if msg.StreamSeq != uint64(i+1) {
+			t.Errorf("Expected stream seq %d, got %d", i+1, msg.StreamSeq)
+		}
+		messages = append(messages, msg)
+	}
+
+	// Edit and reactions are new revisions of message, stream limit counts messages
+	edited, err := h.Get(key, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited.Body = "m1 edited"
+	if err := h.Update(key, edited); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		edited.Reactions = []*Reaction{{Emoji: "+1", Count: i + 1}}
+		if err := h.Update(key, edited); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dropped, err := h.Append(key, &Message{ID: "m4", Type: "room.message", Body: "m4", Timestamp: base.Add(3 * time.Second)}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 1 || dropped[0].ID != "m2" {
+		t.Errorf("Expected m2 dropped, got %v", dropped)
+	}
+
+	// Other node reads the same stream
+	other, err := NewJetStreamHistory(b.(*NATSBus).Conn, c.JetStream, NewMemoryHistory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, history := range []*JetStreamHistory{h, other} {
+		list, err := history.List(key, time.Time{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies := []string{}
+		for _, msg := range list {
+			bodies = append(bodies, msg.Body)
+		}
+		if len(bodies) != 3 || bodies[0] != "m1 edited" || bodies[1] != "m3" || bodies[2] != "m4" {
+			t.Errorf("Unexpected history %v", bodies)
+		}
+	}
+
+	// Cache keeps the last revision only, like stream
+	stream, _ := roomStream(key)
+	if records := h.room(stream).Records; len(records) != 3 {
+		t.Errorf("Expected 3 cached revisions, got %d", len(records))
+	}
+
+	replay, err := other.Replay(key, 3, time.Time{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay.Messages) != 1 || replay.Messages[0].Body != "m1 edited" || len(replay.Messages[0].Reactions) != 1 || !replay.More {
+		t.Errorf("Unexpected replay %+v", replay)
+	}
+
+	// Not room conversations stored in fallback
+	if _, err := h.Append("private:a:b", &Message{ID: "p1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Fallback.Get("private:a:b", "p1"); err != nil {
+		t.Error("Private message not stored in fallback")
+	}
+
+	dropped, err = h.Drop(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 3 {
+		t.Errorf("Expected 3 dropped messages, got %d", len(dropped))
+	}
+	if list, _ := other.List(key, time.Time{}, 0); len(list) != 0 {
+		t.Errorf("History not empty after drop")
+	}
+}
@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const mongoHistoryCollection = "chat_history"
+
+// MongoHistory keeps every message as separate document, ordered by ObjectId
+type MongoHistory struct{}
+
+type mongoHistoryRecord struct {
+	ObjectID  bson.ObjectId `bson:"_id"`
+	Key       string        `bson:"key"`
+	MessageID string        `bson:"message_id"`
+	Timestamp int64         `bson:"timestamp"` // Message timestamp in nanoseconds, Mongo dates lose precision
+	Data      string        `bson:"data"`
+}
+
+func (r *mongoHistoryRecord) message() *Message {
+	msg := &Message{}
+	if err := json.Unmarshal([]byte(r.Data), msg); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return msg
+}
+
+// mongoHistory returns collection on copied session, session must be closed by caller
+func mongoHistory() (*mgo.Session, *mgo.Collection, error) {
+	if !database.CheckConnection() {
+		return nil, nil, ErrStorageUnavailable
+	}
+	session := database.Mongo.Copy()
+	c := session.DB(database.ReadConfig().MongoDB.Database).C(mongoHistoryCollection)
+	return session, c, nil
+}
+
+func (h *MongoHistory) Append(key string, msg *Message, max int) ([]*Message, error) {
+	session, c, err := mongoHistory()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Insert(&mongoHistoryRecord{
+		ObjectID:  bson.NewObjectId(),
+		Key:       key,
+		MessageID: msg.ID,
+		Timestamp: msg.Timestamp.UnixNano(),
+		Data:      string(encoded),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := []*Message{}
+	if max <= 0 {
+		return dropped, nil
+	}
+
+	count, err := c.Find(bson.M{"key": key}).Count()
+	if err != nil || count <= max {
+		return dropped, err
+	}
+
+	records := []mongoHistoryRecord{}
+	err = c.Find(bson.M{"key": key}).Sort("_id").Limit(count - max).All(&records)
+	if err != nil {
+		return dropped, err
+	}
+	for _, r := range records {
+		if err = c.RemoveId(r.ObjectID); err != nil {
+			return dropped, err
+		}
+		if m := r.message(); m != nil {
+			dropped = append(dropped, m)
+		}
+	}
+
+	return dropped, nil
+}
+
+func (h *MongoHistory) List(key string, before time.Time, limit int) ([]*Message, error) {
+	session, c, err := mongoHistory()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	query := bson.M{"key": key}
+	if !before.IsZero() {
+		query["timestamp"] = bson.M{"$lt": before.UnixNano()}
+	}
+
+	records := []mongoHistoryRecord{}
+	err = c.Find(query).Sort("-_id").Limit(limit).All(&records)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first from query, reverse to chronological
+	messages := make([]*Message, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		if m := records[i].message(); m != nil {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+func (h *MongoHistory) Get(key string, id string) (*Message, error) {
+	session, c, err := mongoHistory()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	record := mongoHistoryRecord{}
+	err = c.Find(bson.M{"key": key, "message_id": id}).One(&record)
+	if err == mgo.ErrNotFound {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m := record.message(); m != nil {
+		return m, nil
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (h *MongoHistory) Update(key string, msg *Message) error {
+	session, c, err := mongoHistory()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	err = c.Update(bson.M{"key": key, "message_id": msg.ID}, bson.M{"$set": bson.M{"data": string(encoded)}})
+	if err == mgo.ErrNotFound {
+		return ErrMessageNotFound
+	}
+	return err
+}
+
+func (h *MongoHistory) Drop(key string) ([]*Message, error) {
+	session, c, err := mongoHistory()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	records := []mongoHistoryRecord{}
+	if err = c.Find(bson.M{"key": key}).All(&records); err != nil {
+		return nil, err
+	}
+	if _, err = c.RemoveAll(bson.M{"key": key}); err != nil {
+		return nil, err
+	}
+
+	dropped := []*Message{}
+	for _, r := range records {
+		if m := r.message(); m != nil {
+			dropped = append(dropped, m)
+		}
+	}
+	return dropped, nil
+}
+
+func (h *MongoHistory) Walk(fn func(key string, msg *Message) error) error {
+	session, c, err := mongoHistory()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	record := mongoHistoryRecord{}
+	iter := c.Find(nil).Sort("_id").Iter()
+	for iter.Next(&record) {
+		if m := record.message(); m != nil {
+			if err = fn(record.Key, m); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+	return iter.Close()
+}
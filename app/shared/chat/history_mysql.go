@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+)
+
+// MySQLHistory keeps messages in chat_history table (see config/mysql.sql), ordered by auto increment id
+type MySQLHistory struct{}
+
+type mysqlHistoryRecord struct {
+	ID           uint64 `db:"id"`
+	Conversation string `db:"conversation"`
+	Data         string `db:"data"`
+}
+
+func (r *mysqlHistoryRecord) message() *Message {
+	msg := &Message{}
+	if err := json.Unmarshal([]byte(r.Data), msg); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return msg
+}
+
+func mysqlHistoryMessages(records []mysqlHistoryRecord) []*Message {
+	messages := make([]*Message, 0, len(records))
+	for _, r := range records {
+		if m := r.message(); m != nil {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+func (h *MySQLHistory) Append(key string, msg *Message, max int) ([]*Message, error) {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = database.SQL.Exec("INSERT INTO chat_history (conversation, message_id, timestamp, data) VALUES (?,?,?,?)", key, msg.ID, msg.Timestamp.UnixNano(), string(encoded))
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := []*Message{}
+	if max <= 0 {
+		return dropped, nil
+	}
+
+	count := 0
+	err = database.SQL.Get(&count, "SELECT COUNT(*) FROM chat_history WHERE conversation = ?", key)
+	if err != nil || count <= max {
+		return dropped, err
+	}
+
+	records := []mysqlHistoryRecord{}
+	err = database.SQL.Select(&records, "SELECT id, conversation, data FROM chat_history WHERE conversation = ? ORDER BY id ASC LIMIT ?", key, count-max)
+	if err != nil {
+		return dropped, err
+	}
+	for _, r := range records {
+		if _, err = database.SQL.Exec("DELETE FROM chat_history WHERE id = ?", r.ID); err != nil {
+			return dropped, err
+		}
+	}
+
+	return mysqlHistoryMessages(records), nil
+}
+
+func (h *MySQLHistory) List(key string, before time.Time, limit int) ([]*Message, error) {
+	query := "SELECT id, conversation, data FROM chat_history WHERE conversation = ?"
+	args := []interface{}{key}
+	if !before.IsZero() {
+		query += " AND timestamp < ?"
+		args = append(args, before.UnixNano())
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	records := []mysqlHistoryRecord{}
+	err := database.SQL.Select(&records, "SELECT id, conversation, data FROM ("+query+") AS last ORDER BY id ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return mysqlHistoryMessages(records), nil
+}
+
+func (h *MySQLHistory) Get(key string, id string) (*Message, error) {
+	record := mysqlHistoryRecord{}
+	err := database.SQL.Get(&record, "SELECT id, conversation, data FROM chat_history WHERE conversation = ? AND message_id = ? LIMIT 1", key, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m := record.message(); m != nil {
+		return m, nil
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (h *MySQLHistory) Update(key string, msg *Message) error {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	result, err := database.SQL.Exec("UPDATE chat_history SET data = ? WHERE conversation = ? AND message_id = ?", string(encoded), key, msg.ID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+func (h *MySQLHistory) Drop(key string) ([]*Message, error) {
+	records := []mysqlHistoryRecord{}
+	err := database.SQL.Select(&records, "SELECT id, conversation, data FROM chat_history WHERE conversation = ? ORDER BY id ASC", key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = database.SQL.Exec("DELETE FROM chat_history WHERE conversation = ?", key); err != nil {
+		return nil, err
+	}
+
+	return mysqlHistoryMessages(records), nil
+}
+
+func (h *MySQLHistory) Walk(fn func(key string, msg *Message) error) error {
+	rows, err := database.SQL.Queryx("SELECT id, conversation, data FROM chat_history ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := mysqlHistoryRecord{}
+		if err = rows.StructScan(&r); err != nil {
+			return err
+		}
+		if m := r.message(); m != nil {
+			if err = fn(r.Conversation, m); err != nil {
+				return err
+			}
+		}
+	}
+	return rows.Err()
+}
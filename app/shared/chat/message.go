@@ -11,18 +11,29 @@ import (
 )
 
 type Message struct {
+	ID          string        `json:"id,omitempty"`         // Set by server for stored messages (room.message, private.message)
+	Seq         uint64        `json:"seq,omitempty"`        // Per session delivery number, set when message buffered
+	StreamSeq   uint64        `json:"stream_seq,omitempty"` // Room stream position of stored revision (JetStream history), see 'room.replay'
 	Timestamp   time.Time     `json:"timestamp"`
 	Type        string        `json:"type"`
 	Body        string        `json:"body"`
 	From        MessageUser   `json:"from"`
 	To          MessageUser   `json:"to"`
 	Attachments []*Attachment `json:"attachments"`
+	EditedAt    *time.Time    `json:"edited_at,omitempty"`
+	Deleted     bool          `json:"deleted,omitempty"`
+	Reactions   []*Reaction   `json:"reactions,omitempty"`
+	ParentID    string        `json:"parent_id,omitempty"` // Thread reply to room message with this ID
+	Thread      *ThreadInfo   `json:"thread,omitempty"`    // Set on thread parent
+	Action      bool          `json:"action,omitempty"`    // Sent by '/me' command, shown as '* name body'
 }
 
 type MessageUser struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Muted bool   `json:"muted"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Muted    bool   `json:"muted"`
+	Presence string `json:"presence,omitempty"`
+	Role     string `json:"role,omitempty"` // Room role, set in 'room.users'
 }
 
 func (mu *MessageUser) fromUser(u *User) *MessageUser {
@@ -31,14 +42,59 @@ func (mu *MessageUser) fromUser(u *User) *MessageUser {
 	return mu
 }
 
+func NewMessageID() string {
+	return RandomString(32)
+}
+
+// Clone returns copy of message which changes (edit, reactions, thread info) not affect original
+func (m *Message) Clone() *Message {
+	c := *m
+	if m.EditedAt != nil {
+		t := *m.EditedAt
+		c.EditedAt = &t
+	}
+	if m.Attachments != nil {
+		c.Attachments = append([]*Attachment{}, m.Attachments...)
+	}
+	if m.Reactions != nil {
+		c.Reactions = make([]*Reaction, 0, len(m.Reactions))
+		for _, r := range m.Reactions {
+			cr := *r
+			cr.Users = append([]string{}, r.Users...)
+			c.Reactions = append(c.Reactions, &cr)
+		}
+	}
+	if m.Thread != nil {
+		t := *m.Thread
+		c.Thread = &t
+	}
+	return &c
+}
+
+// ClearServerFields resets fields which only server can set, to prevent fake from client
+func (m *Message) ClearServerFields() {
+	m.Seq = 0
+	m.StreamSeq = 0
+	m.EditedAt = nil
+	m.Deleted = false
+	m.Reactions = nil
+	m.Thread = nil
+	m.Action = false
+}
+
 func ValidateMessage(msg *Message, s *Session) bool {
 	// Truncate message text if limit is set
-	if msg.Type == "room.message" || msg.Type == "private.message" || msg.Type == "private.delivered" {
+	if msg.Type == "room.message" || msg.Type == "private.message" || msg.Type == "private.delivered" ||
+		msg.Type == "room.message.edit" || msg.Type == "private.message.edit" {
 
 		//Ignore empty messages for messages with content
 		if len(msg.Body) == 0 && len(msg.Attachments) == 0 {
 			return false
 		}
+		// Edit changes text only, attachments of stored message are kept
+		if (msg.Type == "room.message.edit" || msg.Type == "private.message.edit") && len(msg.Body) == 0 {
+			return false
+		}
 
 		if MAX_TEXT_MESSAGE_LENGTH > 0 {
 			msg.Body = TruncateString(msg.Body, MAX_TEXT_MESSAGE_LENGTH)
@@ -53,11 +109,13 @@ func ValidateMessage(msg *Message, s *Session) bool {
 	return true
 }
 
-// Remove attachment url from message if file not exists
-// TODO: while we have not full persistence chat, we need to clean history and attachments...
+// Remove attachment url from message if file not exists or placed outside of upload dir
 func StripMissingAttachments(msg *Message) {
 	temp := msg.Attachments[:0]
 	for _, a := range msg.Attachments {
+		if !InUploadDir(a.OriginalPath) || !InUploadDir(a.MinifiedPath) {
+			continue
+		}
 		if _, err := os.Stat(a.OriginalPath); errors.Is(err, os.ErrNotExist) {
 			continue
 		}
@@ -85,6 +143,18 @@ func MessageSessionNotFound() *Message {
 	}
 }
 
+func MessageSessionResync(s *Session) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "session.resync",
+		Body:      "Not acknowledged messages lost, reload rooms and history",
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+	}
+}
+
 func MessageRoomList(s *Session) *Message {
 	list := []*Room{}
 	RoomStore.Mu.Lock()
@@ -164,6 +234,63 @@ func MessageRoomJoinWithHistory(s *Session, room *Room, history []*Message) *Mes
 	}
 }
 
+func MessageRoomThread(s *Session, room *Room, parent *Message, replies []*Message) *Message {
+	mbody := struct {
+		Parent  *Message   `json:"parent"`
+		Replies []*Message `json:"replies"`
+	}{
+		Parent:  parent,
+		Replies: replies,
+	}
+	body, _ := json.Marshal(mbody)
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.thread",
+		Body:      string(body),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+func MessageRoomReplay(s *Session, room *Room, replay *RoomReplay) *Message {
+	body, _ := json.Marshal(replay)
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.replay",
+		Body:      string(body),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+func MessageRoomReplayUnavailable(s *Session, room *Room) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.replay.unavailable",
+		Body:      "Room replay needs JetStream history",
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
 func MessageRoomLeave(s *Session, room *Room) *Message {
 	body, _ := json.Marshal(room)
 	return &Message{
@@ -185,7 +312,7 @@ func MessageRoomUsers(s *Session, room *Room) *Message {
 	users := room.GetUsers()
 	m_users := []*MessageUser{}
 	for _, u := range users {
-		mu := MessageUser{ID: u.ID, Name: u.Name, Muted: false}
+		mu := MessageUser{ID: u.ID, Name: u.Name, Muted: false, Presence: u.GetPresence(), Role: room.Role(u)}
 		s.User.MuteListMu.Lock()
 		for target := range s.User.MuteList {
 			if target == u {
@@ -228,6 +355,7 @@ func MessagePrivateCreated(s *Session, calle *User) *Message {
 	}
 }
 
+// MessagePrivateInvite is sent to invited user, body is room
 func MessagePrivateInvite(s *Session, room *Room, calle *User) *Message {
 	body, _ := json.Marshal(room)
 	return &Message{
@@ -235,13 +363,13 @@ func MessagePrivateInvite(s *Session, room *Room, calle *User) *Message {
 		Type:      "private.invite",
 		Body:      string(body),
 		To: MessageUser{
-			ID:   s.User.ID,
-			Name: s.User.Name,
-		},
-		From: MessageUser{
 			ID:   calle.ID,
 			Name: calle.Name,
 		},
+		From: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
 	}
 }
 
@@ -302,6 +430,122 @@ func MessageUserNotInRoom(s *Session, room *Room) *Message {
 	}
 }
 
+func MessageRoomForbidden(s *Session, room *Room) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.forbidden",
+		Body:      "Not enough rights in this room",
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+func MessageRoomInviteRequired(s *Session, room *Room) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.invite_required",
+		Body:      "This room is invite only",
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+func MessageRoomBadPassword(s *Session, room *Room) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.bad_password",
+		Body:      "Wrong room password",
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+// MessageRoomUpdated has changed room with metadata in body, user changed it in 'from'
+func MessageRoomUpdated(s *Session, room *Room) *Message {
+	body, _ := json.Marshal(room)
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.updated",
+		Body:      string(body),
+		To: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+		From: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+	}
+}
+
+func MessageRoomBadMeta(s *Session, room *Room, err error) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.bad_meta",
+		Body:      err.Error(),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+func MessageRoomBanned(s *Session, room *Room) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "room.banned",
+		Body:      "You are banned in this room",
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+// MessageRoomModeration is 'room.kick', 'room.ban', 'room.unban' or 'room.promote' event, body is target user with new role
+func MessageRoomModeration(mtype string, s *Session, room *Room, target *User, role string) *Message {
+	body, _ := json.Marshal(MessageUser{ID: target.ID, Name: target.Name, Role: role})
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      mtype,
+		Body:      string(body),
+		To: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+		From: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+	}
+}
+
 func MessageRoomsMaxCount(s *Session) *Message {
 	return &Message{
 		Timestamp: time.Now(),
@@ -380,6 +624,33 @@ func MessageRoomDeleted(room *Room) *Message {
 	}
 }
 
+func MessageTyping(mtype string, u *User, to MessageUser) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      mtype,
+		Body:      "",
+		To:        to,
+		From: MessageUser{
+			ID:   u.ID,
+			Name: u.Name,
+		},
+	}
+}
+
+func MessagePresence(u *User) *Message {
+	presence := u.GetPresence()
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "presence",
+		Body:      presence,
+		From: MessageUser{
+			ID:       u.ID,
+			Name:     u.Name,
+			Presence: presence,
+		},
+	}
+}
+
 func MessageHearbeat(s *Session) *Message {
 	return &Message{
 		Timestamp: time.Now(),
@@ -394,6 +665,7 @@ func MessageHearbeat(s *Session) *Message {
 
 func MessagePrivateDelivered(s *Session, msg *Message, callee MessageUser) *Message {
 	return &Message{
+		ID:          msg.ID,
 		Timestamp:   time.Now(),
 		Type:        "private.delivered",
 		Body:        msg.Body,
@@ -406,10 +678,31 @@ func MessagePrivateDelivered(s *Session, msg *Message, callee MessageUser) *Mess
 	}
 }
 
-func MessagePrivateHistory(s *Session, history *PrivateHistory, callee *User) *Message {
-	history.Mu.Lock()
-	mbody, _ := json.Marshal(history.History)
-	history.Mu.Unlock()
+func MessagePrivateRead(reader *User, peer *User, until time.Time) *Message {
+	mbody, _ := json.Marshal(struct {
+		User  string    `json:"user"`
+		Until time.Time `json:"until"`
+	}{
+		User:  reader.ID,
+		Until: until,
+	})
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "private.read",
+		Body:      string(mbody),
+		To: MessageUser{
+			ID:   peer.ID,
+			Name: peer.Name,
+		},
+		From: MessageUser{
+			ID:   reader.ID,
+			Name: reader.Name,
+		},
+	}
+}
+
+func MessagePrivateHistory(s *Session, page *PrivateHistoryPage, callee *User) *Message {
+	mbody, _ := json.Marshal(page)
 
 	return &Message{
 		Timestamp: time.Now(),
@@ -489,3 +782,166 @@ func MessageUserUnmutedBy(u *User, target *User) *Message {
 		},
 	}
 }
+
+func MessageNotFound(s *Session, msg *Message) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "message.not_found",
+		Body:      fmt.Sprintf("Message id:%s not found", msg.ID),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: msg.To,
+	}
+}
+
+func MessageForbidden(s *Session, msg *Message) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "message.forbidden",
+		Body:      fmt.Sprintf("You can't change message id:%s", msg.ID),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: msg.To,
+	}
+}
+
+func MessageReactionBad(s *Session, msg *Message) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "message.bad_reaction",
+		Body:      "Reaction must be single emoji",
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: msg.To,
+	}
+}
+
+// Body is {"query": search query, "messages": [found messages newest first]}
+func MessageSearchResults(s *Session, result *SearchResult) *Message {
+	body, _ := json.Marshal(result)
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "search.results",
+		Body:      string(body),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+	}
+}
+
+func MessageSearchBadQuery(s *Session, err error) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "search.bad_query",
+		Body:      err.Error(),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+	}
+}
+
+// Command error of mtype ('command.unknown', 'command.forbidden', 'command.usage') with reason in body
+func MessageCommandError(s *Session, msg *Message, mtype string, err error) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      mtype,
+		Body:      err.Error(),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: msg.To,
+	}
+}
+
+// Body is [{"name": ..., "usage": ..., "help": ...}]
+func MessageCommandHelp(s *Session, msg *Message, commands []CommandInfo) *Message {
+	body, _ := json.Marshal(commands)
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "command.help",
+		Body:      string(body),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: msg.To,
+	}
+}
+
+// Body is webhook with secret
+func MessageWebhookAdded(s *Session, room *Room, hook *Webhook) *Message {
+	body, _ := json.Marshal(hook)
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "webhook.added",
+		Body:      string(body),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+// Body is removed webhook ID
+func MessageWebhookRemoved(s *Session, room *Room, hook *Webhook) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "webhook.removed",
+		Body:      hook.ID,
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+// Body is {"webhooks": [...], "deliveries": [...]}, deliveries are newest first
+func MessageWebhookList(s *Session, room *Room, hooks []*Webhook, deliveries []WebhookDelivery) *Message {
+	body, _ := json.Marshal(map[string]interface{}{"webhooks": hooks, "deliveries": deliveries})
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "webhook.list",
+		Body:      string(body),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
+
+func MessageWebhookError(s *Session, room *Room, err error) *Message {
+	return &Message{
+		Timestamp: time.Now(),
+		Type:      "webhook.error",
+		Body:      err.Error(),
+		To: MessageUser{
+			ID:   s.User.ID,
+			Name: s.User.Name,
+		},
+		From: MessageUser{
+			ID:   room.ID,
+			Name: room.Name,
+		},
+	}
+}
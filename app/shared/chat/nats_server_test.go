@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestEmbeddedNATSServer(t *testing.T) {
+	c := DefaultConfig()
+	c.NATSServer = NATSServerConfig{
+		Enabled: true,
+		Host:    "127.0.0.1",
+		Port:    -1,
+		Token:   "secret",
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBus(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := b.(*NATSBus).Server
+
+	received := make(chan string, 1)
+	b.Subscribe("test", func(data []byte) {
+		received <- string(data)
+	})
+	b.Publish("test", []byte("hello"))
+
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Errorf("Expected hello, got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message not delivered by embedded server")
+	}
+
+	// Auth required
+	if nc, err := nats.Connect(srv.ClientURL()); err == nil {
+		nc.Close()
+		t.Error("Connected without token")
+	}
+
+	b.Close()
+	if srv.Running() {
+		t.Error("Embedded server still running after bus closed")
+	}
+}
+
+func TestNATSServerConfigValidate(t *testing.T) {
+	bad := []NATSServerConfig{
+		{Enabled: true, Port: 70000},
+		{Enabled: true, Username: "user", Token: "token"},
+		{Enabled: true, Password: "password"},
+		{Enabled: true, Routes: []string{"nats-route://127.0.0.1:6222"}},
+		{Enabled: true, ClusterPort: 6222, Routes: []string{"::bad"}},
+	}
+	for i, c := range bad {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Bad config %d passed validation", i)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package chat
+
+import (
+	"time"
+)
+
+const PRESENCE_ONLINE = "online"
+const PRESENCE_AWAY = "away"
+const PRESENCE_OFFLINE = "offline"
+
+// User without sessions becomes offline after this delay, so quick reconnect (page reload) not flicker
+var PRESENCE_OFFLINE_GRACE = 10 * time.Second
+
+func ValidatePresence(state string) bool {
+	return state == PRESENCE_ONLINE || state == PRESENCE_AWAY
+}
+
+// GetPresence returns state merged from all nodes, user can be connected to several of them
+func (u *User) GetPresence() string {
+	if cluster != nil {
+		return cluster.Presence(u.ID)
+	}
+
+	u.PresenceMu.Lock()
+	defer u.PresenceMu.Unlock()
+
+	return u.Presence
+}
+
+func (u *User) clusterUser(presence string) *ClusterUser {
+	return &ClusterUser{ID: u.ID, Name: u.Name, Presence: presence}
+}
+
+// SetPresence sets explicit state (online or away) and broadcasts it if changed
+func (u *User) SetPresence(state string) {
+	u.PresenceMu.Lock()
+	changed := u.Presence != state
+	u.Presence = state
+	u.PresenceMu.Unlock()
+
+	if changed {
+		cluster.SetUser(u.clusterUser(state))
+		BroadcastPresence(u, nil)
+	}
+}
+
+// presenceSessionOpened cancels pending offline and makes offline user online
+func (u *User) presenceSessionOpened() {
+	u.PresenceMu.Lock()
+	if u.PresenceTimer != nil {
+		u.PresenceTimer.Stop()
+		u.PresenceTimer = nil
+	}
+	u.PresenceRooms = map[string]bool{}
+	changed := u.Presence == PRESENCE_OFFLINE
+	if changed {
+		u.Presence = PRESENCE_ONLINE
+	}
+	u.PresenceMu.Unlock()
+
+	if changed {
+		cluster.SetUser(u.clusterUser(PRESENCE_ONLINE))
+		BroadcastPresence(u, nil)
+	}
+}
+
+// presenceSessionClosed is called after session removed from user.
+// Rooms of closed session are notified too, because session already left them.
+func (u *User) presenceSessionClosed(rooms []string) {
+	u.SessionsMu.Lock()
+	last := len(u.Sessions) == 0
+	u.SessionsMu.Unlock()
+
+	u.PresenceMu.Lock()
+	defer u.PresenceMu.Unlock()
+
+	for _, id := range rooms {
+		u.PresenceRooms[id] = true
+	}
+
+	if !last || u.PresenceTimer != nil {
+		return
+	}
+
+	u.PresenceTimer = time.AfterFunc(PRESENCE_OFFLINE_GRACE, func() {
+		u.SessionsMu.Lock()
+		reconnected := len(u.Sessions) > 0
+		u.SessionsMu.Unlock()
+
+		u.PresenceMu.Lock()
+		u.PresenceTimer = nil
+		if reconnected || u.Presence == PRESENCE_OFFLINE {
+			u.PresenceMu.Unlock()
+			return
+		}
+		u.Presence = PRESENCE_OFFLINE
+		rooms := []string{}
+		for id := range u.PresenceRooms {
+			rooms = append(rooms, id)
+		}
+		u.PresenceRooms = map[string]bool{}
+		u.PresenceMu.Unlock()
+
+		cluster.RemoveUser(u.ID)
+		BroadcastPresence(u, rooms)
+	})
+}
+
+// RoomIDs returns rooms joined by any session of user
+func (u *User) RoomIDs() []string {
+	sessions := []*Session{}
+	u.SessionsMu.Lock()
+	for _, s := range u.Sessions {
+		sessions = append(sessions, s)
+	}
+	u.SessionsMu.Unlock()
+
+	ids := map[string]bool{}
+	for _, s := range sessions {
+		s.RoomsMu.Lock()
+		for _, r := range s.Rooms {
+			ids[r.ID] = true
+		}
+		s.RoomsMu.Unlock()
+	}
+
+	result := []string{}
+	for id := range ids {
+		result = append(result, id)
+	}
+	return result
+}
+
+// AddPeer remembers private conversation on both sides, peers receive presence changes
+func (u *User) AddPeer(peer *User) {
+	if u == peer {
+		return
+	}
+	u.PeersMu.Lock()
+	u.Peers[peer.ID] = peer
+	u.PeersMu.Unlock()
+
+	peer.PeersMu.Lock()
+	peer.Peers[u.ID] = u
+	peer.PeersMu.Unlock()
+}
+
+// BroadcastPresence publishes user state to shared rooms, extra rooms and private conversation peers
+func BroadcastPresence(u *User, rooms []string) {
+	msg := MessagePresence(u)
+
+	subjects := map[string]bool{}
+	for _, id := range append(u.RoomIDs(), rooms...) {
+		if RoomExistsByID(id) {
+			subjects[id] = true
+		}
+	}
+
+	u.PeersMu.Lock()
+	for id := range u.Peers {
+		subjects[id] = true
+	}
+	u.PeersMu.Unlock()
+
+	for subject := range subjects {
+		PublishMessage(subject, msg)
+	}
+}
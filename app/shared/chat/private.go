@@ -1,59 +1,72 @@
 package chat
 
 import (
-	"sync"
+	"log"
+	"sort"
+	"time"
 )
 
-type PrivateHistory struct {
-	User1   *User
-	User2   *User
-	History []*Message
-	Mu      sync.Mutex
-}
+// Maximum number of stored messages in private conversation. After that oldest messages removed.
+// 0 - unlimited
+const MAX_PRIVATE_HISTORY_MESSAGES = 1000
 
-func (h *PrivateHistory) Add(m *Message) {
-	h.Mu.Lock()
-	if len(h.History) >= MAX_ROOM_HISTORY_MESSAGES {
-		message := h.History[0]
-		for _, attachments := range message.Attachments {
-			AttachmentStore.Remove(attachments)
-		}
-		// Shift history
-		h.History = h.History[1:]
-	}
-	h.History = append(h.History, m)
-	h.Mu.Unlock()
+// Number of messages returned in one 'private.history' response
+const PRIVATE_HISTORY_PAGE_SIZE = 50
+
+// PrivateHistoryPage is body of 'private.history' message.
+// If More is set - client can request older messages with Before as 'private.history' body.
+type PrivateHistoryPage struct {
+	History []*Message   `json:"history"`
+	More    bool         `json:"more"`
+	Before  time.Time    `json:"before"`
+	Read    ReadReceipts `json:"read"` // Read watermark of each side by user ID
 }
 
-type PrivateHistoryStoreType struct {
-	History []*PrivateHistory
-	Mu      sync.Mutex
+// PrivateHistoryKey is the same for both sides of conversation
+func PrivateHistoryKey(u1 *User, u2 *User) string {
+	ids := []string{u1.ID, u2.ID}
+	sort.Strings(ids)
+	return "private:" + ids[0] + ":" + ids[1]
 }
 
-var PrivateHistoryStore = &PrivateHistoryStoreType{
-	History: []*PrivateHistory{},
-	Mu:      sync.Mutex{},
+func AddToPrivateHistory(u1 *User, u2 *User, msg *Message) {
+	// Remove attachments for shifted messages
+	key := PrivateHistoryKey(u1, u2)
+	dropped, err := History.Append(key, msg, MAX_PRIVATE_HISTORY_MESSAGES)
+	if err != nil {
+		log.Println("Chat: failed to save private history.", err)
+		return
+	}
+	ClaimAttachments(msg)
+	RemoveAttachments(dropped)
+	IndexMessage(key, msg)
 }
 
-func (store *PrivateHistoryStoreType) Get(u1 *User, u2 *User) *PrivateHistory {
-	store.Mu.Lock()
-	var h *PrivateHistory
-	for _, history := range store.History {
-		if (u1 == history.User1 && u2 == history.User2) || (u2 == history.User1 && u1 == history.User2) {
-			h = history
-			break
-		}
+// GetPrivateHistory returns page of conversation messages sent before time (zero - last messages)
+func GetPrivateHistory(u1 *User, u2 *User, before time.Time) *PrivateHistoryPage {
+	// One extra message to know if older messages exist
+	messages, err := History.List(PrivateHistoryKey(u1, u2), before, PRIVATE_HISTORY_PAGE_SIZE+1)
+	if err != nil {
+		log.Println("Chat: failed to load private history.", err)
 	}
-	if h == nil {
-		h = &PrivateHistory{
-			User1:   u1,
-			User2:   u2,
-			History: []*Message{},
-			Mu:      sync.Mutex{},
-		}
+
+	page := &PrivateHistoryPage{
+		History: messages,
+		More:    false,
+		Before:  before,
+		Read:    GetReadReceipts(u1, u2),
+	}
+	if len(messages) > PRIVATE_HISTORY_PAGE_SIZE {
+		page.History = messages[1:]
+		page.More = true
+	}
+	if len(page.History) > 0 {
+		page.Before = page.History[0].Timestamp
+	}
+
+	for _, message := range page.History {
+		StripMissingAttachments(message)
 	}
-	store.History = append(store.History, h)
-	store.Mu.Unlock()
 
-	return h
+	return page
 }
@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"log"
+	"strings"
+	"unicode"
+)
+
+// Maximum length of reaction in runes (some emoji are sequence of several runes)
+const MAX_REACTION_LENGTH = 16
+
+// Maximum number of different reactions on single message
+const MAX_MESSAGE_REACTIONS = 20
+
+// Reaction is aggregated reaction on stored message
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+func ValidateReaction(emoji string) bool {
+	if emoji == "" || len([]rune(emoji)) > MAX_REACTION_LENGTH {
+		return false
+	}
+	return strings.IndexFunc(emoji, unicode.IsSpace) == -1
+}
+
+// AddReaction adds user reaction, returns false if nothing changed
+func (m *Message) AddReaction(emoji string, userID string) bool {
+	for _, r := range m.Reactions {
+		if r.Emoji != emoji {
+			continue
+		}
+		for _, id := range r.Users {
+			if id == userID {
+				return false
+			}
+		}
+		r.Users = append(r.Users, userID)
+		r.Count = len(r.Users)
+		return true
+	}
+
+	if len(m.Reactions) >= MAX_MESSAGE_REACTIONS {
+		return false
+	}
+	m.Reactions = append(m.Reactions, &Reaction{Emoji: emoji, Count: 1, Users: []string{userID}})
+	return true
+}
+
+// RemoveReaction removes user reaction, returns false if nothing changed
+func (m *Message) RemoveReaction(emoji string, userID string) bool {
+	for i, r := range m.Reactions {
+		if r.Emoji != emoji {
+			continue
+		}
+		for j, id := range r.Users {
+			if id != userID {
+				continue
+			}
+			r.Users = append(r.Users[:j], r.Users[j+1:]...)
+			r.Count = len(r.Users)
+			// Last reaction of this kind
+			if r.Count == 0 {
+				m.Reactions = append(m.Reactions[:i], m.Reactions[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// ReactMessage applies 'message.react' or 'message.unreact' to stored message.
+// msg.ID is target message, msg.Body is emoji.
+// Changed message with aggregated reactions is published to subjects with msg.Type.
+func ReactMessage(session *Session, key string, msg *Message, subjects ...string) {
+	emoji := strings.TrimSpace(msg.Body)
+	if !ValidateReaction(emoji) {
+		PublishMessage(session.ID, MessageReactionBad(session, msg))
+		return
+	}
+
+	unlock := LockHistory(key)
+	defer unlock()
+
+	stored, err := History.Get(key, msg.ID)
+	if err != nil || stored.Deleted {
+		PublishMessage(session.ID, MessageNotFound(session, msg))
+		return
+	}
+
+	// Check user spam to fast
+	if !session.User.AllowMessage() {
+		PublishMessage(session.ID, MessageToManyRequests(session, msg.To))
+		return
+	}
+
+	changed := false
+	if msg.Type == "message.react" {
+		changed = stored.AddReaction(emoji, session.User.ID)
+	} else {
+		changed = stored.RemoveReaction(emoji, session.User.ID)
+	}
+	if !changed {
+		return
+	}
+
+	if err = History.Update(key, stored); err != nil {
+		log.Println("Chat: failed to update message reactions.", err)
+		return
+	}
+
+	event := *stored
+	event.Type = msg.Type
+	for _, subject := range subjects {
+		PublishMessage(subject, &event)
+	}
+}
@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ReadReceipts are read watermarks of private conversation by user ID.
+// All messages sent before watermark are read by user.
+type ReadReceipts map[string]time.Time
+
+// Serialize watermark updates, load + save is not atomic in storages
+var readReceiptsMu sync.Mutex
+
+func ReadReceiptsKey(u1 *User, u2 *User) string {
+	return "read:" + PrivateHistoryKey(u1, u2)
+}
+
+func GetReadReceipts(u1 *User, u2 *User) ReadReceipts {
+	receipts := ReadReceipts{}
+	err := State.Load(ReadReceiptsKey(u1, u2), &receipts)
+	if err != nil && err != ErrStateNotFound {
+		log.Println("Chat: failed to load read receipts.", err)
+	}
+	return receipts
+}
+
+// MarkRead moves reader watermark in conversation with peer forward.
+// Returns false if watermark not changed.
+func MarkRead(reader *User, peer *User, until time.Time) bool {
+	// Future not read yet
+	if now := time.Now(); until.After(now) {
+		until = now
+	}
+
+	readReceiptsMu.Lock()
+	defer readReceiptsMu.Unlock()
+
+	receipts := GetReadReceipts(reader, peer)
+	if !until.After(receipts[reader.ID]) {
+		return false
+	}
+	receipts[reader.ID] = until
+
+	if err := State.Save(ReadReceiptsKey(reader, peer), receipts); err != nil {
+		log.Println("Chat: failed to save read receipts.", err)
+		return false
+	}
+	return true
+}
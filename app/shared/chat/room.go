@@ -1,14 +1,19 @@
 package chat
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/nats-io/nats.go"
+	"github.com/josephspurrier/gowebapp/app/shared/passhash"
 )
 
 type Room struct {
@@ -21,12 +26,105 @@ type Room struct {
 	Type         string              `json:"type"`
 	MaxUsers     int                 `json:"max_users"`
 	Permanent    bool                `json:"permanent"`
+	Protected    bool                `json:"protected"` // Password needed to join
+	Meta         RoomMeta            `json:"-"`         // Encoded by MarshalJSON under MetaMu
+	MetaMu       sync.Mutex          `json:"-"`
 	LastActivity time.Time           `json:"-"`
 }
 
-type RoomHistory struct {
-	History []*Message
-	Mu      sync.Mutex
+// RoomMeta is room info changed by owner and moderators with 'room.update'
+type RoomMeta struct {
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+	Avatar      string `json:"avatar"` // http(s) URL or file uploaded to UPLOAD_DIR
+}
+
+// roomJSON has Room fields without MarshalJSON method
+type roomJSON Room
+
+// MarshalJSON adds metadata fields to room, metadata can be changed while room is encoded
+func (room *Room) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		*roomJSON
+		RoomMeta
+	}{
+		roomJSON: (*roomJSON)(room),
+		RoomMeta: room.GetMeta(),
+	})
+}
+
+func (room *Room) GetMeta() RoomMeta {
+	room.MetaMu.Lock()
+	defer room.MetaMu.Unlock()
+	return room.Meta
+}
+
+// SetMeta changes metadata of room on all nodes
+func (room *Room) SetMeta(meta RoomMeta) {
+	room.setMeta(meta)
+	cluster.SetMeta(room.ID, meta)
+}
+
+func (room *Room) setMeta(meta RoomMeta) {
+	room.MetaMu.Lock()
+	previous := room.Meta.Avatar
+	room.Meta = meta
+	room.MetaMu.Unlock()
+
+	// Uploaded avatar is kept by cleanup and message deletes while room uses it
+	if previous != meta.Avatar {
+		ReleaseFile(room.avatarRef(), previous)
+		ClaimFile(room.avatarRef(), meta.Avatar)
+	}
+}
+
+// avatarRef is owner of avatar reference in AttachmentStore
+func (room *Room) avatarRef() string {
+	return "room.avatar:" + room.ID
+}
+
+// ValidateRoomMeta checks metadata limits and avatar, bad words replaced in text fields
+func ValidateRoomMeta(meta *RoomMeta) error {
+	if len([]rune(meta.Topic)) > MAX_ROOM_TOPIC_LENGTH {
+		return fmt.Errorf("Topic is longer than %d", MAX_ROOM_TOPIC_LENGTH)
+	}
+	if len([]rune(meta.Description)) > MAX_ROOM_DESCRIPTION_LENGTH {
+		return fmt.Errorf("Description is longer than %d", MAX_ROOM_DESCRIPTION_LENGTH)
+	}
+	if len([]rune(meta.Avatar)) > MAX_ROOM_AVATAR_LENGTH {
+		return fmt.Errorf("Avatar is longer than %d", MAX_ROOM_AVATAR_LENGTH)
+	}
+
+	if meta.Avatar != "" {
+		u, err := url.Parse(meta.Avatar)
+		remote := err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		if !remote {
+			if !InUploadDir(meta.Avatar) {
+				return errors.New("Avatar must be http(s) URL or uploaded file")
+			}
+			if _, err := os.Stat(meta.Avatar); err != nil {
+				return errors.New("Avatar file not found")
+			}
+		}
+	}
+
+	for bad, good := range BadWordsDictionary {
+		meta.Topic = bad.ReplaceAllString(meta.Topic, good)
+		meta.Description = bad.ReplaceAllString(meta.Description, good)
+	}
+	return nil
+}
+
+// Room roles. Owner is user created room, moderators are promoted by owner
+const ROLE_OWNER = "owner"
+const ROLE_MODERATOR = "moderator"
+const ROLE_MEMBER = "member"
+
+// Role rank, user can moderate only users with lower rank
+var roleRank = map[string]int{
+	ROLE_MEMBER:    0,
+	ROLE_MODERATOR: 1,
+	ROLE_OWNER:     2,
 }
 
 var RoomStore = struct {
@@ -37,19 +135,10 @@ var RoomStore = struct {
 	Mu:  sync.Mutex{},
 }
 
-// Store room history by room.ID
-var RoomHistoryStore = struct {
-	Map map[string]*RoomHistory
-	Mu  sync.Mutex
-}{
-	Map: map[string]*RoomHistory{},
-	Mu:  sync.Mutex{},
-}
-
 type RoomSubscriptionError struct{}
 
 func (re *RoomSubscriptionError) Error() string {
-	return "Can't create NATS subscribtion. Possible bad room name."
+	return "Can't create bus subscribtion. Possible bad room name."
 }
 
 type RoomAlreadyExistsError struct{}
@@ -58,6 +147,24 @@ func (re *RoomAlreadyExistsError) Error() string {
 	return "Room already exists."
 }
 
+type RoomBannedError struct{}
+
+func (re *RoomBannedError) Error() string {
+	return "User banned in room."
+}
+
+type RoomInviteRequiredError struct{}
+
+func (re *RoomInviteRequiredError) Error() string {
+	return "Room is invite only."
+}
+
+type RoomPasswordError struct{}
+
+func (re *RoomPasswordError) Error() string {
+	return "Wrong room password."
+}
+
 // Need to validate room name on creation (on types 'room.join', 'room.users' and 'room.leave')
 func ValidateRoomName(room string) bool {
 	// Max room length
@@ -83,43 +190,125 @@ func ValidateRoomName(room string) bool {
 	return true
 }
 
-func CreateRoom(name string, rtype string) (*Room, error) {
+// RoomID is derived from name, so nodes of cluster creating same room at the same time get same ID
+func RoomID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:16])
+}
+
+func newRoom(name string, rtype string) *Room {
+	return &Room{
+		ID:           RoomID(name),
+		Name:         name,
+		Users:        map[string]*User{},
+		UsersMu:      sync.Mutex{},
+		Sessions:     map[string]*Session{},
+		SessionsMu:   sync.Mutex{},
+		Type:         rtype,
+		MaxUsers:     MAX_ROOM_USERS,
+		Permanent:    false,
+		LastActivity: time.Now(),
+	}
+}
+
+// CreateRoom creates room with owner, owner is nil for rooms created by server.
+// Not empty password is stored hashed, users need it to join room.
+func CreateRoom(name string, rtype string, owner *User, password string) (*Room, error) {
 	RoomStore.Mu.Lock()
 	defer RoomStore.Mu.Unlock()
 
 	if RoomStore.Map[name] == nil {
-		room := &Room{
-			ID:           RandomString(32), // for public rooms - id same as name
-			Name:         name,
-			Users:        map[string]*User{},
-			UsersMu:      sync.Mutex{},
-			Sessions:     map[string]*Session{},
-			SessionsMu:   sync.Mutex{},
-			Type:         rtype,
-			MaxUsers:     MAX_ROOM_USERS,
-			Permanent:    false,
-			LastActivity: time.Now(),
+		room := newRoom(name, rtype)
+
+		hash := ""
+		if password != "" {
+			var err error
+			hash, err = passhash.HashString(password)
+			if err != nil {
+				return nil, err
+			}
+			room.Protected = true
 		}
 
-		// try to create subscription in NATS
-		temp := make(chan *nats.Msg)
-		_, err := nc.ChanSubscribe(room.ID, temp)
+		// try to create subscription on bus
+		sub, err := bus.Subscribe(room.ID, func(data []byte) {})
 		if err != nil {
 			fmt.Println(err)
 			return RoomStore.Map[name], &RoomSubscriptionError{}
 		}
+		sub.Unsubscribe()
 
 		if rtype == ROOM_PUBLIC {
 			PublishMessage("chat.broadcast", MessageNewRoomCreated(room))
 		}
 
 		RoomStore.Map[name] = room
+		cr := room.ClusterRoom()
+		if owner != nil {
+			cr.Roles = map[string]string{owner.ID: ROLE_OWNER}
+		}
+		cr.Password = hash
+		cluster.AddRoom(cr)
 		return room, nil
 	}
 
 	return RoomStore.Map[name], &RoomAlreadyExistsError{}
 }
 
+func (room *Room) ClusterRoom() *ClusterRoom {
+	return &ClusterRoom{
+		ID:        room.ID,
+		Name:      room.Name,
+		Type:      room.Type,
+		Permanent: room.Permanent,
+	}
+}
+
+// addClusterRoom registers room created by other node, clients already notified by that node
+func addClusterRoom(cr *ClusterRoom) {
+	RoomStore.Mu.Lock()
+	defer RoomStore.Mu.Unlock()
+
+	if RoomStore.Map[cr.Name] == nil {
+		room := newRoom(cr.Name, cr.Type)
+		room.Permanent = cr.Permanent
+		room.Protected = cr.Password != ""
+		room.Meta = cr.Meta
+		ClaimFile(room.avatarRef(), cr.Meta.Avatar)
+		RoomStore.Map[cr.Name] = room
+	}
+}
+
+// updateClusterRoom applies metadata changed by other node, clients already notified by that node
+func updateClusterRoom(cr *ClusterRoom) {
+	if room, err := GetRoomByID(cr.ID); err == nil {
+		room.setMeta(cr.Meta)
+	}
+}
+
+// removeClusterRoom removes room deleted by other node
+func removeClusterRoom(cr *ClusterRoom) {
+	if room, err := GetRoomByID(cr.ID); err == nil {
+		room.detachSessions()
+		dropRoom(room)
+	}
+}
+
+// detachSessions removes deleted room from sessions of this node without leave notifications
+func (room *Room) detachSessions() {
+	room.SessionsMu.Lock()
+	sessions := room.Sessions
+	room.Sessions = map[string]*Session{}
+	room.SessionsMu.Unlock()
+
+	for _, s := range sessions {
+		s.Unsubscribe(room.ID)
+		s.RoomsMu.Lock()
+		delete(s.Rooms, room.Name)
+		s.RoomsMu.Unlock()
+	}
+}
+
 func GetRoom(name string) (*Room, error) {
 	RoomStore.Mu.Lock()
 	defer RoomStore.Mu.Unlock()
@@ -141,24 +330,33 @@ func GetRoomByID(id string) (*Room, error) {
 }
 
 func DeleteRoom(room *Room) {
+	if dropRoom(room) {
+		EmitWebhook(WEBHOOK_EVENT_ROOM_DELETED, room, nil, nil)
+		removeRoomWebhooks(room)
+		cluster.RemoveRoom(room.ID)
+	}
+}
+
+// dropRoom removes room from this node only, returns false if already removed
+func dropRoom(room *Room) bool {
 	RoomStore.Mu.Lock()
-	if RoomStore.Map[room.Name] != nil {
-		// Clear room attachments before room delete
-		RoomHistoryStore.Mu.Lock()
-		if history := RoomHistoryStore.Map[room.ID]; history != nil {
-			history.Mu.Lock()
-			for _, message := range history.History {
-				for _, attachment := range message.Attachments {
-					AttachmentStore.Remove(attachment)
-				}
-			}
-			history.Mu.Unlock()
-		}
-		RoomHistoryStore.Mu.Unlock()
-		delete(RoomStore.Map, room.Name)
-		room = nil
+	defer RoomStore.Mu.Unlock()
+
+	if RoomStore.Map[room.Name] != room {
+		return false
 	}
-	RoomStore.Mu.Unlock()
+	// Clear room history and attachments before room delete
+	dropped, err := History.Drop(RoomHistoryKey(room))
+	if err != nil {
+		log.Println("Chat: failed to drop room history.", err)
+	}
+	RemoveAttachments(dropped)
+	ReleaseFile(room.avatarRef(), room.GetMeta().Avatar)
+	if err = Search.Drop(RoomHistoryKey(room)); err != nil {
+		log.Println("Chat: failed to drop room search index.", err)
+	}
+	delete(RoomStore.Map, room.Name)
+	return true
 }
 
 // Active public rooms count
@@ -168,21 +366,68 @@ func RoomCount() int {
 
 	i := 0
 	for _, r := range RoomStore.Map {
-		if r.Type == "public" {
+		if r.Type == ROOM_PUBLIC {
 			i++
 		}
 	}
 	return i
 }
 
+// Active rooms count, private rooms included, limited by MAX_ROOM_COUNT
+func TotalRoomCount() int {
+	RoomStore.Mu.Lock()
+	defer RoomStore.Mu.Unlock()
+
+	return len(RoomStore.Map)
+}
+
+// UserCount returns count of room users on all nodes
 func (room *Room) UserCount() int {
-	room.UsersMu.Lock()
-	defer room.UsersMu.Unlock()
+	return cluster.RoomUserCount(room.ID)
+}
+
+// Role returns role of user in room, roles are shared by all nodes
+func (room *Room) Role(u *User) string {
+	return cluster.Role(room.ID, u.ID)
+}
+
+// IsModerator returns true for room owner and moderators
+func (room *Room) IsModerator(u *User) bool {
+	return roleRank[room.Role(u)] >= roleRank[ROLE_MODERATOR]
+}
 
-	return len(room.Users)
+// CanModerate returns true if user role in room is higher than target role
+func (room *Room) CanModerate(u *User, targetID string) bool {
+	return room.IsModerator(u) && roleRank[room.Role(u)] > roleRank[cluster.Role(room.ID, targetID)]
+}
+
+func (room *Room) IsBanned(u *User) bool {
+	return cluster.IsBanned(room.ID, u.ID)
+}
+
+// CheckAccess returns error if user can't join room: private room needs invite, protected room needs password.
+// Members, users with role and invited users are allowed without password.
+func (room *Room) CheckAccess(u *User, password string) error {
+	cr := cluster.Room(room.ID)
+	if cr == nil {
+		cr = &ClusterRoom{}
+	}
+	if cluster.IsMember(room.ID, u.ID) || cr.Roles[u.ID] != "" || cr.Invited[u.ID] {
+		return nil
+	}
+	if room.Type == ROOM_PRIVATE {
+		return &RoomInviteRequiredError{}
+	}
+	if cr.Password != "" && !passhash.MatchString(cr.Password, password) {
+		return &RoomPasswordError{}
+	}
+	return nil
 }
 
 func JoinRoom(room *Room, session *Session, notify bool) error {
+	if room.IsBanned(session.User) {
+		return &RoomBannedError{}
+	}
 
 	room.SessionsMu.Lock()
 	if room.Sessions[session.ID] == nil {
@@ -200,10 +445,12 @@ func JoinRoom(room *Room, session *Session, notify bool) error {
 	room.UsersMu.Lock()
 	if room.Users[session.User.ID] == nil {
 		room.Users[session.User.ID] = session.User
+		cluster.Join(room.ID, &ClusterUser{ID: session.User.ID, Name: session.User.Name, Presence: session.User.GetPresence()})
 
 		if notify {
 			PublishMessage(room.ID, MessageRoomJoin(session, room))
 		}
+		EmitWebhook(WEBHOOK_EVENT_JOIN, room, session.User, nil)
 	}
 	room.UsersMu.Unlock()
 	return nil
@@ -235,16 +482,16 @@ func (room *Room) Leave(session *Session, notify bool) {
 
 	if last && user != nil {
 		delete(room.Users, user.ID)
+		cluster.Leave(room.ID, user.ID)
 		if notify {
-			response := MessageRoomLeave(session, room)
-			body, _ := json.Marshal(response)
-			nc.Publish(room.ID, body)
+			PublishMessage(room.ID, MessageRoomLeave(session, room))
 		}
+		EmitWebhook(WEBHOOK_EVENT_LEAVE, room, session.User, nil)
 	}
 	room.UsersMu.Unlock()
 
-	// If no users in room - free it name by deleting from RoomStore
-	if len(room.Users) == 0 && room.Permanent == false {
+	// If no users in room on all nodes - free it name by deleting from RoomStore
+	if room.UserCount() == 0 && room.Permanent == false {
 		if room.Type == ROOM_PUBLIC {
 			PublishMessage("chat.broadcast", MessageRoomDeleted(room))
 		}
@@ -253,13 +500,12 @@ func (room *Room) Leave(session *Session, notify bool) {
 
 }
 
+// GetUsers returns room users on all nodes
 func (r *Room) GetUsers() []*User {
-	r.UsersMu.Lock()
-	defer r.UsersMu.Unlock()
-
-	users := make([]*User, 0, len(r.Users))
-	for _, u := range r.Users {
-		users = append(users, u)
+	members := cluster.RoomUsers(r.ID)
+	users := make([]*User, 0, len(members))
+	for _, m := range members {
+		users = append(users, GetUser(m.ID, m.Name))
 	}
 
 	return users
@@ -300,49 +546,47 @@ func (r *Room) HasUser(u *User) bool {
 }
 
 func AddToHistory(room *Room, msg *Message) {
-	roomHistory := &RoomHistory{}
-
-	RoomHistoryStore.Mu.Lock()
-	if RoomHistoryStore.Map[room.ID] != nil {
-		roomHistory = RoomHistoryStore.Map[room.ID]
-	} else {
-		RoomHistoryStore.Map[room.ID] = roomHistory
-	}
-	RoomHistoryStore.Mu.Unlock()
-
-	roomHistory.Mu.Lock()
-	if len(roomHistory.History) >= MAX_ROOM_HISTORY_MESSAGES {
-		// Remove attachments for shifted message
-		message := roomHistory.History[0]
-		for _, attachments := range message.Attachments {
-			AttachmentStore.Remove(attachments)
-		}
-		// Shift history
-		roomHistory.History = roomHistory.History[1:]
+	// Remove attachments for shifted messages
+	dropped, err := History.Append(RoomHistoryKey(room), msg, MAX_ROOM_HISTORY_MESSAGES)
+	if err != nil {
+		log.Println("Chat: failed to save room history.", err)
+		return
 	}
-	roomHistory.History = append(roomHistory.History, msg)
-	roomHistory.Mu.Unlock()
+	ClaimAttachments(msg)
+	RemoveAttachments(dropped)
+	IndexMessage(RoomHistoryKey(room), msg)
 }
 
+// GetRoomHistory returns top level room messages visible for user, thread replies returned by GetRoomThread
 func GetRoomHistory(room *Room, for_user *User) []*Message {
 	history := []*Message{}
 
-	RoomHistoryStore.Mu.Lock()
-	if roomHistory := RoomHistoryStore.Map[room.ID]; roomHistory != nil {
-		roomHistory.Mu.Lock()
-		for _, message := range roomHistory.History {
-			// Filter message if it from user in MuteList
-			from := GetUser(message.From.ID, "")
-			muted, since := for_user.CheckInMute(from)
-			if muted && since.Before(message.Timestamp) {
-				continue
-			}
-			StripMissingAttachments(message)
-			history = append(history, message)
+	messages, err := History.List(RoomHistoryKey(room), time.Time{}, MAX_ROOM_HISTORY_MESSAGES)
+	if err != nil {
+		log.Println("Chat: failed to load room history.", err)
+	}
+
+	for _, message := range FilterMuted(messages, for_user) {
+		if message.ParentID != "" {
+			continue
 		}
-		roomHistory.Mu.Unlock()
+		StripMissingAttachments(message)
+		history = append(history, message)
 	}
-	RoomHistoryStore.Mu.Unlock()
 
 	return history
 }
+
+// FilterMuted removes messages sent by users from MuteList after they were muted
+func FilterMuted(messages []*Message, for_user *User) []*Message {
+	filtered := []*Message{}
+	for _, message := range messages {
+		from := GetUser(message.From.ID, "")
+		muted, since := for_user.CheckInMute(from)
+		if muted && since.Before(message.Timestamp) {
+			continue
+		}
+		filtered = append(filtered, message)
+	}
+	return filtered
+}
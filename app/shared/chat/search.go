@@ -0,0 +1,304 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+)
+
+// Maximum and default count of messages returned by search
+const SEARCH_RESULT_LIMIT = 50
+
+// Words shorter than this are not indexed and ignored in query
+const SEARCH_MIN_WORD_LENGTH = 2
+
+// Longer words are truncated, so long tokens not bloat index
+const SEARCH_MAX_WORD_LENGTH = 64
+
+// SearchIndex keeps words of stored messages. Messages removed from history by history limits stay
+// in index, so old messages can be found. Deleted messages and dropped conversations are removed.
+type SearchIndex interface {
+	// Index adds message of conversation or replaces indexed message with the same ID
+	Index(key string, msg *Message) error
+	// Remove removes message from index
+	Remove(key string, id string) error
+	// Drop removes all messages of conversation
+	Drop(key string) error
+	// Search returns messages matched query from conversations allowed by filter, newest first
+	Search(q *SearchQuery, allowed func(key string) bool) ([]*Message, error)
+}
+
+// SearchQuery is body of 'search' message and parameters of /chat/search.
+// Every word of Text must be prefix of message word.
+type SearchQuery struct {
+	Text  string    `json:"text"`
+	Room  string    `json:"room"`  // Room ID, only this room searched
+	With  string    `json:"with"`  // User ID, only private conversation with this user searched
+	From  string    `json:"from"`  // Author user ID
+	Since time.Time `json:"since"` // Zero - no bound
+	Until time.Time `json:"until"` // Zero - no bound
+	Limit int       `json:"limit"` // 0 or more than SEARCH_RESULT_LIMIT - SEARCH_RESULT_LIMIT
+}
+
+// SearchResult is body of 'search.results' message and response of /chat/search
+type SearchResult struct {
+	Query    *SearchQuery `json:"query"`
+	Messages []*Message   `json:"messages"`
+}
+
+// ErrSearchEmptyQuery returned when query has no words to search
+var ErrSearchEmptyQuery = errors.New("Search query has no words.")
+
+// Search is the index used by chat, set in Init depending on configured database
+var Search SearchIndex = NewMemorySearchIndex()
+
+// NewSearchIndex returns index stored in Bolt database if it is configured, memory index otherwise.
+// Memory index is rebuilt from history on start.
+func NewSearchIndex(d database.Info) SearchIndex {
+	if d.Type == database.TypeBolt && database.BoltDB != nil {
+		return &BoltSearchIndex{}
+	}
+	log.Println("Chat: search index kept in memory")
+	return NewMemorySearchIndex()
+}
+
+// SearchWords splits text to unique lower case words
+func SearchWords(text string) []string {
+	words := []string{}
+	seen := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		runes := []rune(word)
+		if len(runes) < SEARCH_MIN_WORD_LENGTH {
+			continue
+		}
+		if len(runes) > SEARCH_MAX_WORD_LENGTH {
+			word = string(runes[:SEARCH_MAX_WORD_LENGTH])
+		}
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// searchable returns true for messages with text which can be found
+func searchable(msg *Message) bool {
+	return msg.ID != "" && !msg.Deleted && (msg.Type == "room.message" || msg.Type == "private.message")
+}
+
+// IndexMessage adds stored message to search index, deleted message is removed from it
+func IndexMessage(key string, msg *Message) {
+	var err error
+	if searchable(msg) {
+		err = Search.Index(key, msg)
+	} else if msg.Deleted {
+		err = Search.Remove(key, msg.ID)
+	}
+	if err != nil {
+		log.Println("Chat: failed to index message.", err)
+	}
+}
+
+// SearchMessages returns messages visible for user: rooms where user is member and own private conversations.
+// Messages of muted users are filtered same as in history.
+func SearchMessages(u *User, q *SearchQuery) ([]*Message, error) {
+	if len(SearchWords(q.Text)) == 0 {
+		return nil, ErrSearchEmptyQuery
+	}
+	if q.Limit <= 0 || q.Limit > SEARCH_RESULT_LIMIT {
+		q.Limit = SEARCH_RESULT_LIMIT
+	}
+
+	allowed := func(key string) bool {
+		if strings.HasPrefix(key, "room:") {
+			if q.With != "" {
+				return false
+			}
+			room, err := GetRoom(strings.TrimPrefix(key, "room:"))
+			if err != nil || (q.Room != "" && room.ID != q.Room) {
+				return false
+			}
+			return room.HasUser(u)
+		}
+		if strings.HasPrefix(key, "private:") {
+			if q.Room != "" {
+				return false
+			}
+			if q.With != "" {
+				return key == PrivateHistoryKey(u, &User{ID: q.With})
+			}
+			ids := strings.Split(strings.TrimPrefix(key, "private:"), ":")
+			return len(ids) == 2 && (ids[0] == u.ID || ids[1] == u.ID)
+		}
+		return false
+	}
+
+	messages, err := Search.Search(q, allowed)
+	if err != nil {
+		return nil, err
+	}
+	messages = FilterMuted(messages, u)
+	for _, msg := range messages {
+		StripMissingAttachments(msg)
+	}
+	return messages, nil
+}
+
+// searchMatch checks query filters except words
+func searchMatch(q *SearchQuery, msg *Message) bool {
+	if q.From != "" && msg.From.ID != q.From {
+		return false
+	}
+	if !q.Since.IsZero() && msg.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && msg.Timestamp.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// searchLimit sorts messages newest first and cuts them to limit
+func searchLimit(messages []*Message, limit int) []*Message {
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Timestamp.After(messages[j].Timestamp) })
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages
+}
+
+// searchIntersect keeps ids present in both sets, nil set is all ids
+func searchIntersect(result map[string]bool, ids map[string]bool) map[string]bool {
+	if result == nil {
+		return ids
+	}
+	for id := range result {
+		if !ids[id] {
+			delete(result, id)
+		}
+	}
+	return result
+}
+
+type memorySearchDoc struct {
+	Key   string
+	Msg   *Message
+	Words []string
+}
+
+// MemorySearchIndex keeps index in process memory
+type MemorySearchIndex struct {
+	Docs  map[string]*memorySearchDoc // by conversation key + "/" + message ID
+	Words map[string]map[string]bool  // word -> doc IDs
+	Keys  map[string]map[string]bool  // conversation key -> doc IDs
+	Mu    sync.Mutex
+}
+
+func NewMemorySearchIndex() *MemorySearchIndex {
+	return &MemorySearchIndex{
+		Docs:  map[string]*memorySearchDoc{},
+		Words: map[string]map[string]bool{},
+		Keys:  map[string]map[string]bool{},
+		Mu:    sync.Mutex{},
+	}
+}
+
+func (idx *MemorySearchIndex) Index(key string, msg *Message) error {
+	idx.Mu.Lock()
+	defer idx.Mu.Unlock()
+
+	id := key + "/" + msg.ID
+	idx.remove(key, id)
+
+	copied := *msg
+	doc := &memorySearchDoc{Key: key, Msg: &copied, Words: SearchWords(msg.Body)}
+	idx.Docs[id] = doc
+	for _, word := range doc.Words {
+		if idx.Words[word] == nil {
+			idx.Words[word] = map[string]bool{}
+		}
+		idx.Words[word][id] = true
+	}
+	if idx.Keys[key] == nil {
+		idx.Keys[key] = map[string]bool{}
+	}
+	idx.Keys[key][id] = true
+	return nil
+}
+
+// remove must be called with idx.Mu locked
+func (idx *MemorySearchIndex) remove(key string, id string) {
+	doc := idx.Docs[id]
+	if doc == nil {
+		return
+	}
+	for _, word := range doc.Words {
+		delete(idx.Words[word], id)
+		if len(idx.Words[word]) == 0 {
+			delete(idx.Words, word)
+		}
+	}
+	delete(idx.Keys[key], id)
+	if len(idx.Keys[key]) == 0 {
+		delete(idx.Keys, key)
+	}
+	delete(idx.Docs, id)
+}
+
+func (idx *MemorySearchIndex) Remove(key string, id string) error {
+	idx.Mu.Lock()
+	defer idx.Mu.Unlock()
+
+	idx.remove(key, key+"/"+id)
+	return nil
+}
+
+func (idx *MemorySearchIndex) Drop(key string) error {
+	idx.Mu.Lock()
+	defer idx.Mu.Unlock()
+
+	for id := range idx.Keys[key] {
+		idx.remove(key, id)
+	}
+	return nil
+}
+
+func (idx *MemorySearchIndex) Search(q *SearchQuery, allowed func(key string) bool) ([]*Message, error) {
+	idx.Mu.Lock()
+	defer idx.Mu.Unlock()
+
+	var ids map[string]bool
+	for _, prefix := range SearchWords(q.Text) {
+		matched := map[string]bool{}
+		for word, docs := range idx.Words {
+			if strings.HasPrefix(word, prefix) {
+				for id := range docs {
+					matched[id] = true
+				}
+			}
+		}
+		ids = searchIntersect(ids, matched)
+	}
+
+	messages := []*Message{}
+	for id := range ids {
+		doc := idx.Docs[id]
+		if !allowed(doc.Key) || !searchMatch(q, doc.Msg) {
+			continue
+		}
+		// Attachments are filtered in place by StripMissingAttachments, so indexed slice not shared
+		copied := *doc.Msg
+		copied.Attachments = append([]*Attachment(nil), doc.Msg.Attachments...)
+		messages = append(messages, &copied)
+	}
+	return searchLimit(messages, q.Limit), nil
+}
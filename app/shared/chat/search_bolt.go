@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+
+	"github.com/boltdb/bolt"
+)
+
+const boltSearchDocsBucket = "chat_search_docs"
+const boltSearchWordsBucket = "chat_search_words"
+
+// BoltSearchIndex keeps index in the same Bolt database as history.
+// Docs bucket key is history prefix of conversation + message ID, value is indexed message.
+// Words bucket key is word + "\x00" + doc key with empty value, so cursor prefix scan finds docs by word prefix.
+type BoltSearchIndex struct{}
+
+type boltSearchDoc struct {
+	Key   string   `json:"key"`
+	Msg   *Message `json:"msg"`
+	Words []string `json:"words"`
+}
+
+// boltSearchPrefix is hex of conversation key + "/", hex protects from room names with "/" inside
+func boltSearchPrefix(key string) []byte {
+	return []byte(hex.EncodeToString([]byte(key)) + "/")
+}
+
+func boltSearchDocKey(key string, id string) []byte {
+	return append(boltSearchPrefix(key), []byte(id)...)
+}
+
+func boltSearchWordKey(word string, doc []byte) []byte {
+	return append([]byte(word+"\x00"), doc...)
+}
+
+// boltSearchRemove removes doc with its words, missed doc is not an error
+func boltSearchRemove(docs *bolt.Bucket, words *bolt.Bucket, id []byte) error {
+	v := docs.Get(id)
+	if v == nil {
+		return nil
+	}
+	doc := &boltSearchDoc{}
+	if err := json.Unmarshal(v, doc); err == nil {
+		for _, word := range doc.Words {
+			if err := words.Delete(boltSearchWordKey(word, id)); err != nil {
+				return err
+			}
+		}
+	}
+	return docs.Delete(id)
+}
+
+// boltSearchBuckets returns buckets of index, creating them in writable transaction
+func boltSearchBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	docs, err := tx.CreateBucketIfNotExists([]byte(boltSearchDocsBucket))
+	if err != nil {
+		return nil, nil, err
+	}
+	words, err := tx.CreateBucketIfNotExists([]byte(boltSearchWordsBucket))
+	if err != nil {
+		return nil, nil, err
+	}
+	return docs, words, nil
+}
+
+// Built returns true when index was created by previous run, then it is not rebuilt from history on start
+func (idx *BoltSearchIndex) Built() bool {
+	built := false
+	database.BoltDB.View(func(tx *bolt.Tx) error {
+		built = tx.Bucket([]byte(boltSearchDocsBucket)) != nil
+		return nil
+	})
+	return built
+}
+
+func (idx *BoltSearchIndex) Index(key string, msg *Message) error {
+	return database.BoltDB.Update(func(tx *bolt.Tx) error {
+		docs, words, err := boltSearchBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		id := boltSearchDocKey(key, msg.ID)
+		if err = boltSearchRemove(docs, words, id); err != nil {
+			return err
+		}
+
+		doc := &boltSearchDoc{Key: key, Msg: msg, Words: SearchWords(msg.Body)}
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err = docs.Put(id, encoded); err != nil {
+			return err
+		}
+		for _, word := range doc.Words {
+			if err = words.Put(boltSearchWordKey(word, id), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (idx *BoltSearchIndex) Remove(key string, id string) error {
+	return database.BoltDB.Update(func(tx *bolt.Tx) error {
+		docs, words, err := boltSearchBuckets(tx)
+		if err != nil {
+			return err
+		}
+		return boltSearchRemove(docs, words, boltSearchDocKey(key, id))
+	})
+}
+
+func (idx *BoltSearchIndex) Drop(key string) error {
+	return database.BoltDB.Update(func(tx *bolt.Tx) error {
+		docs, words, err := boltSearchBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		// Collect keys first, bucket must not be changed while cursor iterates
+		ids := [][]byte{}
+		prefix := boltSearchPrefix(key)
+		c := docs.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			ids = append(ids, append([]byte{}, k...))
+		}
+		for _, id := range ids {
+			if err = boltSearchRemove(docs, words, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (idx *BoltSearchIndex) Search(q *SearchQuery, allowed func(key string) bool) ([]*Message, error) {
+	messages := []*Message{}
+
+	err := database.BoltDB.View(func(tx *bolt.Tx) error {
+		docs := tx.Bucket([]byte(boltSearchDocsBucket))
+		words := tx.Bucket([]byte(boltSearchWordsBucket))
+		if docs == nil || words == nil {
+			return nil
+		}
+
+		var ids map[string]bool
+		for _, prefix := range SearchWords(q.Text) {
+			matched := map[string]bool{}
+			c := words.Cursor()
+			for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+				if i := bytes.IndexByte(k, 0); i >= 0 {
+					matched[string(k[i+1:])] = true
+				}
+			}
+			ids = searchIntersect(ids, matched)
+		}
+
+		for id := range ids {
+			v := docs.Get([]byte(id))
+			if v == nil {
+				continue
+			}
+			doc := &boltSearchDoc{}
+			if err := json.Unmarshal(v, doc); err != nil || doc.Msg == nil {
+				continue
+			}
+			if !allowed(doc.Key) || !searchMatch(q, doc.Msg) {
+				continue
+			}
+			messages = append(messages, doc.Msg)
+		}
+		return nil
+	})
+
+	return searchLimit(messages, q.Limit), err
+}
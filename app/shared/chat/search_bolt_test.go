@@ -0,0 +1,86 @@
+//go:build !race
+// +build !race
+
+// boltdb v1.3.1 fails pointer checks enabled by race detector
+
+package chat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBoltSearchIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bolt.Open(filepath.Join(dir, "search.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	previous := database.BoltDB
+	database.BoltDB = db
+	defer func() { database.BoltDB = previous }()
+
+	idx := &BoltSearchIndex{}
+	now := time.Now()
+	messages := []*Message{
+		{ID: "1", Type: "room.message", Body: "bolt indexed words", Timestamp: now.Add(-time.Minute), From: MessageUser{ID: "a"}},
+		{ID: "2", Type: "room.message", Body: "more indexed text", Timestamp: now, From: MessageUser{ID: "b"}},
+	}
+	for _, msg := range messages {
+		if err := idx.Index("room:bolt/search", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.Index("room:other", &Message{ID: "3", Type: "room.message", Body: "indexed elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+
+	all := func(key string) bool { return true }
+	found, err := idx.Search(&SearchQuery{Text: "index"}, all)
+	if err != nil || len(found) != 3 {
+		t.Fatalf("Expected 3 messages, got %d. %v", len(found), err)
+	}
+	found, _ = idx.Search(&SearchQuery{Text: "index", Limit: 1}, func(key string) bool { return key == "room:bolt/search" })
+	if len(found) != 1 || found[0].ID != "2" {
+		t.Errorf("Expected newest message of allowed room, got %v", found)
+	}
+	found, _ = idx.Search(&SearchQuery{Text: "index", From: "a"}, all)
+	if len(found) != 1 || found[0].ID != "1" {
+		t.Errorf("Expected message from a, got %v", found)
+	}
+
+	// Edit replaces words
+	if err := idx.Index("room:bolt/search", &Message{ID: "1", Type: "room.message", Body: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ = idx.Search(&SearchQuery{Text: "bolt"}, all); len(found) != 0 {
+		t.Errorf("Old words of edited message found")
+	}
+
+	if err := idx.Remove("room:bolt/search", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Drop("room:other"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ = idx.Search(&SearchQuery{Text: "indexed"}, all); len(found) != 0 {
+		t.Errorf("Removed messages found: %v", found)
+	}
+	if found, _ = idx.Search(&SearchQuery{Text: "edited"}, all); len(found) != 1 {
+		t.Errorf("Expected edited message, got %v", found)
+	}
+}
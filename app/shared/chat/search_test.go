@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// search sends 'search' message and returns found messages bodies
+func search(t *testing.T, s *Session, q SearchQuery) []string {
+	t.Helper()
+
+	body, _ := json.Marshal(q)
+	ProcessMessage(&Message{Type: "search", Body: string(body)}, s)
+	m := waitMessage(t, s, "search.results")
+
+	result := &SearchResult{}
+	if err := json.Unmarshal([]byte(m.Body), result); err != nil {
+		t.Fatal(err)
+	}
+	bodies := []string{}
+	for _, msg := range result.Messages {
+		bodies = append(bodies, msg.Body)
+	}
+	return bodies
+}
+
+func TestSearch(t *testing.T) {
+	owner := GetUser("search-owner", "Owner")
+	member := GetUser("search-member", "Member")
+	outsider := GetUser("search-outsider", "Outsider")
+	so := owner.NewSession()
+	sm := member.NewSession()
+	sx := outsider.NewSession()
+	defer owner.DeleteSession(so)
+	defer member.DeleteSession(sm)
+	defer outsider.DeleteSession(sx)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "search-room"}}, so)
+	to := MessageUser{ID: RoomID("search-room"), Name: "search-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	for _, s := range []*Session{so, sm} {
+		ProcessMessage(&Message{Type: "room.join", To: to}, s)
+		waitMessage(t, s, "room.join")
+	}
+
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "Quarterly zebrafish report"}, so)
+	waitMessage(t, sm, "room.message")
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "zebrafish lunch?"}, sm)
+	waitMessage(t, so, "room.message")
+	ProcessMessage(&Message{Type: "private.message", To: MessageUser{ID: member.ID}, Body: "secret zebrafish plan"}, so)
+	waitMessage(t, sm, "private.message")
+
+	// Words are prefixes, all must match
+	if found := search(t, sm, SearchQuery{Text: "zebra"}); len(found) != 3 {
+		t.Errorf("Expected 3 messages, got %v", found)
+	}
+	if found := search(t, sm, SearchQuery{Text: "zebrafish REP"}); len(found) != 1 || found[0] != "Quarterly zebrafish report" {
+		t.Errorf("Expected report message, got %v", found)
+	}
+
+	// Filters
+	if found := search(t, sm, SearchQuery{Text: "zebrafish", Room: to.ID}); len(found) != 2 {
+		t.Errorf("Expected 2 room messages, got %v", found)
+	}
+	if found := search(t, sm, SearchQuery{Text: "zebrafish", With: owner.ID}); len(found) != 1 || found[0] != "secret zebrafish plan" {
+		t.Errorf("Expected private message, got %v", found)
+	}
+	if found := search(t, sm, SearchQuery{Text: "zebrafish", From: member.ID}); len(found) != 1 || found[0] != "zebrafish lunch?" {
+		t.Errorf("Expected own message, got %v", found)
+	}
+	if found := search(t, sm, SearchQuery{Text: "zebrafish", Since: time.Now().Add(time.Hour)}); len(found) != 0 {
+		t.Errorf("Expected no future messages, got %v", found)
+	}
+
+	// Not a member and not a private peer
+	if found := search(t, sx, SearchQuery{Text: "zebrafish"}); len(found) != 0 {
+		t.Errorf("Outsider found %v", found)
+	}
+
+	// Messages of muted author sent after mute hidden, same as in history
+	ProcessMessage(&Message{Type: "mute", To: MessageUser{ID: owner.ID}}, sm)
+	waitMessage(t, sm, "muted")
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "zebrafish after mute"}, so)
+	waitMessage(t, so, "room.message")
+	if found := search(t, sm, SearchQuery{Text: "zebrafish"}); len(found) != 3 {
+		t.Errorf("Expected muted message hidden, got %v", found)
+	}
+	if found := search(t, so, SearchQuery{Text: "zebrafish after"}); len(found) != 1 {
+		t.Errorf("Expected message found by author, got %v", found)
+	}
+	ProcessMessage(&Message{Type: "unmute", To: MessageUser{ID: owner.ID}}, sm)
+	waitMessage(t, sm, "unmuted")
+
+	// Left room not searched
+	ProcessMessage(&Message{Type: "room.leave", To: to}, sm)
+	eventually(t, func() bool {
+		room, err := GetRoomByID(to.ID)
+		return err != nil || !room.HasUser(member)
+	}, "member left room")
+	if found := search(t, sm, SearchQuery{Text: "zebrafish"}); len(found) != 1 || found[0] != "secret zebrafish plan" {
+		t.Errorf("Expected private message only, got %v", found)
+	}
+
+	// Empty query
+	ProcessMessage(&Message{Type: "search", Body: `{"text":"a"}`}, sm)
+	waitMessage(t, sm, "search.bad_query")
+}
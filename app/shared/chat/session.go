@@ -6,13 +6,11 @@ import (
 	"log"
 	"sync"
 	"time"
-
-	"github.com/nats-io/nats.go"
 )
 
 type Session struct {
 	ID              string
-	Subscriptions   map[string]*nats.Subscription
+	Subscriptions   map[string]Subscription
 	SubscriptionMu  sync.Mutex
 	Buffer          []*Message
 	BufferAvailable chan bool
@@ -22,6 +20,30 @@ type Session struct {
 	RoomsMu         sync.Mutex
 	TimeToDie       *time.Timer
 	Closed          chan bool
+	Seq             uint64
+	Sent            []*Message // Delivered but not acknowledged by client
+	Lost            uint64     // Last seq of not acknowledged messages dropped from Sent
+	Token           string     // Secret to resume suspended session
+	Suspended       bool
+	LastSeen        time.Time // Last heartbeat
+	StateMu         sync.Mutex
+}
+
+// Count of delivered not acknowledged messages kept in session for replay (SSE Last-Event-ID, resume).
+// Client which falls behind more gets 'session.resync' on replay and must reload rooms and history.
+const SESSION_REPLAY_SIZE = 100
+
+// Suspended session kept with rooms and buffered messages while client can resume it.
+// 0 - session deleted by heartbeat timeout at once
+var SESSION_RESUME_GRACE = 60 * time.Second
+
+// Message types from muted users which not delivered to session
+var MutedMessageTypes = map[string]bool{
+	"room.message":        true,
+	"room.message.edit":   true,
+	"room.message.delete": true,
+	"typing.start":        true,
+	"typing.stop":         true,
 }
 
 var SessionStore = struct {
@@ -35,7 +57,7 @@ var SessionStore = struct {
 func NewSession(id string, user *User) *Session {
 	session := &Session{
 		ID:              id,
-		Subscriptions:   map[string]*nats.Subscription{},
+		Subscriptions:   map[string]Subscription{},
 		SubscriptionMu:  sync.Mutex{},
 		Buffer:          []*Message{},
 		BufferAvailable: make(chan bool, 1),
@@ -44,6 +66,8 @@ func NewSession(id string, user *User) *Session {
 		Rooms:           map[string]*Room{},
 		RoomsMu:         sync.Mutex{},
 		Closed:          make(chan bool, 1),
+		Token:           RandomString(32),
+		LastSeen:        time.Now(),
 	}
 
 	return session
@@ -58,10 +82,10 @@ func ValidateSubscriptionName(id string) bool {
 	return true
 }
 
-func (s *Session) Subscribe(name string) (*nats.Subscription, error) {
+func (s *Session) Subscribe(name string) (Subscription, error) {
 	// TODO: Validate name
 	if !ValidateSubscriptionName(name) {
-		return nil, errors.New("NATS(chat): Subscription name not valid")
+		return nil, errors.New("Bus(chat): Subscription name not valid")
 	}
 
 	// Check if already subscribed on this channel, only 1 subscription per session needed
@@ -69,43 +93,39 @@ func (s *Session) Subscribe(name string) (*nats.Subscription, error) {
 	sub := s.Subscriptions[name]
 	s.SubscriptionMu.Unlock()
 	if sub != nil {
-		log.Printf("NATS: session %s already subscribed to %s, returned existed subscription.\n", s.ID, name)
+		log.Printf("Bus: session %s already subscribed to %s, returned existed subscription.\n", s.ID, name)
 		return sub, nil
 	}
 
-	messages := make(chan *nats.Msg) //TODO: buffered or not
-
-	// Create NATS subscription
-	sub, err := nc.ChanSubscribe(name, messages)
-	if err != nil {
-		log.Println("NATS: failed create subscription.", err)
-		return nil, err
-	}
-
-	// Start consumer in background
-	go func(s *Session, pending chan *nats.Msg) {
-		for delivery := range pending {
-			m := Message{}
-			err := json.Unmarshal(delivery.Data, &m)
-			if err != nil {
-				log.Println("NATS(chat): failed to decode message.", err)
-			}
-			//Not add muted user messages to room messages
-			from := GetUser(m.From.ID, "")
-			muted, _ := s.User.CheckInMute(from)
-			if muted && m.Type == "room.message" {
-				continue
-			}
+	// Create bus subscription, handler is called in order for each delivery
+	sub, err := bus.Subscribe(name, func(data []byte) {
+		m := Message{}
+		err := json.Unmarshal(data, &m)
+		if err != nil {
+			log.Println("Bus(chat): failed to decode message.", err)
+		}
+		//Not add muted user messages to room messages
+		from := GetUser(m.From.ID, "")
+		muted, _ := s.User.CheckInMute(from)
+		if muted && MutedMessageTypes[m.Type] {
+			return
+		}
 
-			s.BufferMu.Lock()
-			s.Buffer = append(s.Buffer, &m)
-			s.BufferMu.Unlock()
+		s.Push(&m)
 
-			if len(s.BufferAvailable) == 0 {
-				s.BufferAvailable <- true
+		// User removed from room by moderator, sessions on all nodes leave it
+		if m.Type == "room.kick" || m.Type == "room.ban" {
+			target := MessageUser{}
+			json.Unmarshal([]byte(m.Body), &target)
+			if target.ID == s.User.ID {
+				go s.LeaveRoom(m.To.ID)
 			}
 		}
-	}(s, messages)
+	})
+	if err != nil {
+		log.Println("Bus: failed create subscription.", err)
+		return nil, err
+	}
 
 	s.SubscriptionMu.Lock()
 	s.Subscriptions[name] = sub
@@ -121,7 +141,7 @@ func (s *Session) Unsubscribe(name string) {
 	if s.Subscriptions[name] != nil {
 		err := s.Subscriptions[name].Unsubscribe()
 		if err != nil {
-			log.Println("NATS: unsubscribe failed.", err)
+			log.Println("Bus: unsubscribe failed.", err)
 		}
 		delete(s.Subscriptions, name)
 	}
@@ -133,7 +153,7 @@ func (s *Session) UnsubscribeAll() {
 	for name, sub := range s.Subscriptions {
 		err := sub.Unsubscribe()
 		if err != nil {
-			log.Panicln("NATS(chat): failed to unsubscribe")
+			log.Panicln("Bus(chat): failed to unsubscribe")
 		}
 		delete(s.Subscriptions, name)
 	}
@@ -152,10 +172,131 @@ func (s *Session) LeaveAllRooms() {
 	}
 }
 
+// LeaveRoom removes session from room by room ID without notification
+func (s *Session) LeaveRoom(id string) {
+	room, err := GetRoomByID(id)
+	if err != nil {
+		return
+	}
+	room.Leave(s, false)
+}
+
+// Touch resets heartbeat timer of session.
+// If timer already fired - session is suspended or deleting now and touch is ignored.
+func (s *Session) Touch() {
+	s.StateMu.Lock()
+	defer s.StateMu.Unlock()
+	if !s.Suspended && s.TimeToDie.Stop() {
+		s.TimeToDie.Reset(HEART_BEAT_TIMEOUT)
+		s.LastSeen = time.Now()
+	}
+}
+
+// IsSuspended returns true if client lost session and not resumed it yet
+func (s *Session) IsSuspended() bool {
+	s.StateMu.Lock()
+	defer s.StateMu.Unlock()
+	return s.Suspended
+}
+
+// Push numerates message and add it to session buffer
+func (s *Session) Push(m *Message) {
+	s.BufferMu.Lock()
+	s.Seq++
+	m.Seq = s.Seq
+	s.Buffer = append(s.Buffer, m)
+	s.BufferMu.Unlock()
+
+	// Signal is not blocking, one pending signal is enough for consumer
+	select {
+	case s.BufferAvailable <- true:
+	default:
+	}
+}
+
+// Drain returns all buffered messages and clears buffer.
+// Returned messages are remembered as sent until Ack, last SESSION_REPLAY_SIZE of them can be replayed.
+// Older not acknowledged messages are dropped and remembered as lost, so replay asks client to resync.
+func (s *Session) Drain() []*Message {
+	s.BufferMu.Lock()
+	defer s.BufferMu.Unlock()
+
+	messages := s.Buffer
+	s.Buffer = nil
+
+	s.Sent = append(s.Sent, messages...)
+	if len(s.Sent) > SESSION_REPLAY_SIZE {
+		cut := len(s.Sent) - SESSION_REPLAY_SIZE
+		s.Lost = s.Sent[cut-1].Seq
+		s.Sent = s.Sent[cut:]
+	}
+	return messages
+}
+
+// resync returns 'session.resync' if messages after seq were dropped, caller holds BufferMu.
+// It has seq of the last lost message, acknowledging it stops next resync.
+func (s *Session) resync(seq uint64) []*Message {
+	if seq >= s.Lost {
+		return []*Message{}
+	}
+	m := MessageSessionResync(s)
+	m.Seq = s.Lost
+	return []*Message{m}
+}
+
+// Replay returns already sent messages with sequence number greater than seq
+func (s *Session) Replay(seq uint64) []*Message {
+	s.BufferMu.Lock()
+	defer s.BufferMu.Unlock()
+
+	messages := s.resync(seq)
+	for _, m := range s.Sent {
+		if m.Seq > seq {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// Ack forgets sent messages with sequence number up to seq, client received them
+func (s *Session) Ack(seq uint64) {
+	s.BufferMu.Lock()
+	defer s.BufferMu.Unlock()
+
+	i := 0
+	for i < len(s.Sent) && s.Sent[i].Seq <= seq {
+		i++
+	}
+	s.Sent = s.Sent[i:]
+}
+
+// Requeue moves sent messages with sequence number greater than seq back to buffer,
+// so next Drain delivers them again before new messages
+func (s *Session) Requeue(seq uint64) {
+	s.BufferMu.Lock()
+	messages := s.resync(seq)
+	for _, m := range s.Sent {
+		if m.Seq > seq {
+			messages = append(messages, m)
+		}
+	}
+	s.Sent = nil
+	s.Buffer = append(messages, s.Buffer...)
+	pending := len(s.Buffer)
+	s.BufferMu.Unlock()
+
+	if pending > 0 {
+		select {
+		case s.BufferAvailable <- true:
+		default:
+		}
+	}
+}
+
 func (s *Session) Publish(channel string, msg *Message) error {
 	body, err := json.Marshal(msg)
 	if err != nil {
-		log.Println("NATS(chat): can't encode message.", err)
+		log.Println("Bus(chat): can't encode message.", err)
 	}
-	return nc.Publish(channel, body)
+	return bus.Publish(channel, body)
 }
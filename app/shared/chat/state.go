@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+)
+
+// StateStorage keeps small JSON documents of chat state (read receipts and etc) by key
+type StateStorage interface {
+	// Load decodes document into v, returns ErrStateNotFound if key not exists
+	Load(key string, v interface{}) error
+	// Save encodes v and replaces document
+	Save(key string, v interface{}) error
+	// Delete removes document
+	Delete(key string) error
+}
+
+// ErrStateNotFound returned when document not exists
+var ErrStateNotFound = errors.New("State not found.")
+
+// State is the storage used by chat, set in Init depending on configured database
+var State StateStorage = NewMemoryState()
+
+// NewStateStorage returns storage for configured database type.
+// Fallback to memory storage if database not connected.
+func NewStateStorage(d database.Info) StateStorage {
+	switch d.Type {
+	case database.TypeBolt:
+		if database.BoltDB != nil {
+			return &BoltState{}
+		}
+	case database.TypeMongoDB:
+		if database.CheckConnection() {
+			return &MongoState{}
+		}
+	case database.TypeMySQL:
+		if database.SQL != nil {
+			return &MySQLState{}
+		}
+	}
+
+	log.Println("Chat: no database for state, it will be lost on restart")
+	return NewMemoryState()
+}
+
+// MemoryState keeps encoded documents in process memory
+type MemoryState struct {
+	Map map[string][]byte
+	Mu  sync.Mutex
+}
+
+func NewMemoryState() *MemoryState {
+	return &MemoryState{
+		Map: map[string][]byte{},
+		Mu:  sync.Mutex{},
+	}
+}
+
+func (st *MemoryState) Load(key string, v interface{}) error {
+	st.Mu.Lock()
+	data, ok := st.Map[key]
+	st.Mu.Unlock()
+
+	if !ok {
+		return ErrStateNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (st *MemoryState) Save(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	st.Mu.Lock()
+	st.Map[key] = data
+	st.Mu.Unlock()
+	return nil
+}
+
+func (st *MemoryState) Delete(key string) error {
+	st.Mu.Lock()
+	delete(st.Map, key)
+	st.Mu.Unlock()
+	return nil
+}
@@ -0,0 +1,32 @@
+package chat
+
+import (
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+
+	"github.com/boltdb/bolt"
+)
+
+const boltStateBucket = "chat_state"
+
+// BoltState keeps documents in one bucket with database package helpers
+type BoltState struct{}
+
+func (st *BoltState) Load(key string, v interface{}) error {
+	err := database.View(boltStateBucket, key, v)
+	if err == bolt.ErrBucketNotFound || err == bolt.ErrInvalid {
+		return ErrStateNotFound
+	}
+	return err
+}
+
+func (st *BoltState) Save(key string, v interface{}) error {
+	return database.Update(boltStateBucket, key, v)
+}
+
+func (st *BoltState) Delete(key string) error {
+	err := database.Delete(boltStateBucket, key)
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"encoding/json"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+
+	"gopkg.in/mgo.v2"
+)
+
+const mongoStateCollection = "chat_state"
+
+// MongoState keeps every document as JSON string with key as _id
+type MongoState struct{}
+
+type mongoStateRecord struct {
+	Key  string `bson:"_id"`
+	Data string `bson:"data"`
+}
+
+// mongoState returns collection on copied session, session must be closed by caller
+func mongoState() (*mgo.Session, *mgo.Collection, error) {
+	if !database.CheckConnection() {
+		return nil, nil, ErrStorageUnavailable
+	}
+	session := database.Mongo.Copy()
+	c := session.DB(database.ReadConfig().MongoDB.Database).C(mongoStateCollection)
+	return session, c, nil
+}
+
+func (st *MongoState) Load(key string, v interface{}) error {
+	session, c, err := mongoState()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	record := mongoStateRecord{}
+	err = c.FindId(key).One(&record)
+	if err == mgo.ErrNotFound {
+		return ErrStateNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(record.Data), v)
+}
+
+func (st *MongoState) Save(key string, v interface{}) error {
+	session, c, err := mongoState()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.UpsertId(key, &mongoStateRecord{Key: key, Data: string(data)})
+	return err
+}
+
+func (st *MongoState) Delete(key string) error {
+	session, c, err := mongoState()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = c.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
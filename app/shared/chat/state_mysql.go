@@ -0,0 +1,38 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/josephspurrier/gowebapp/app/shared/database"
+)
+
+// MySQLState keeps documents in chat_state table (see config/mysql.sql)
+type MySQLState struct{}
+
+func (st *MySQLState) Load(key string, v interface{}) error {
+	data := ""
+	err := database.SQL.Get(&data, "SELECT data FROM chat_state WHERE name = ? LIMIT 1", key)
+	if err == sql.ErrNoRows {
+		return ErrStateNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (st *MySQLState) Save(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.SQL.Exec("INSERT INTO chat_state (name, data) VALUES (?,?) ON DUPLICATE KEY UPDATE data = VALUES(data)", key, string(data))
+	return err
+}
+
+func (st *MySQLState) Delete(key string) error {
+	_, err := database.SQL.Exec("DELETE FROM chat_state WHERE name = ?", key)
+	return err
+}
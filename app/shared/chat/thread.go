@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"log"
+	"time"
+)
+
+// ThreadInfo is set on parent message of thread
+type ThreadInfo struct {
+	ReplyCount    int         `json:"reply_count"`
+	LastReplyAt   time.Time   `json:"last_reply_at"`
+	LastReplyFrom MessageUser `json:"last_reply_from"`
+}
+
+// GetThreadParent returns top level message for reply.
+// Threads are flat: reply to reply is attached to the same parent.
+func GetThreadParent(room *Room, parentID string) (*Message, error) {
+	parent, err := History.Get(RoomHistoryKey(room), parentID)
+	if err != nil {
+		return nil, err
+	}
+	if parent.Deleted {
+		return nil, ErrMessageNotFound
+	}
+	if parent.ParentID != "" {
+		return GetThreadParent(room, parent.ParentID)
+	}
+	return parent, nil
+}
+
+// AddThreadReply updates reply count and last reply info of parent message.
+// Changed parent is published to room as 'room.thread.updated'.
+func AddThreadReply(room *Room, reply *Message) {
+	key := RoomHistoryKey(room)
+	unlock := LockHistory(key)
+	defer unlock()
+
+	parent, err := History.Get(key, reply.ParentID)
+	if err != nil {
+		log.Println("Chat: thread parent not found.", err)
+		return
+	}
+
+	if parent.Thread == nil {
+		parent.Thread = &ThreadInfo{}
+	}
+	parent.Thread.ReplyCount++
+	parent.Thread.LastReplyAt = reply.Timestamp
+	parent.Thread.LastReplyFrom = reply.From
+
+	if err = History.Update(key, parent); err != nil {
+		log.Println("Chat: failed to update thread parent.", err)
+		return
+	}
+
+	event := *parent
+	event.Type = "room.thread.updated"
+	PublishMessage(room.ID, &event)
+}
+
+// removeThreadReply decrements reply count of parent message after reply delete, last reply info is taken
+// from remaining replies. Must be called with room history locked, changed parent is published as in AddThreadReply.
+func removeThreadReply(room *Room, reply *Message) {
+	key := RoomHistoryKey(room)
+	parent, err := History.Get(key, reply.ParentID)
+	if err != nil || parent.Thread == nil {
+		return
+	}
+
+	parent.Thread.ReplyCount--
+	if parent.Thread.ReplyCount <= 0 {
+		parent.Thread = nil
+	} else if messages, err := History.List(key, time.Time{}, 0); err == nil {
+		parent.Thread.LastReplyAt = time.Time{}
+		parent.Thread.LastReplyFrom = MessageUser{}
+		for _, message := range messages {
+			if message.ParentID == parent.ID && !message.Deleted && !message.Timestamp.Before(parent.Thread.LastReplyAt) {
+				parent.Thread.LastReplyAt = message.Timestamp
+				parent.Thread.LastReplyFrom = message.From
+			}
+		}
+	}
+
+	if err = History.Update(key, parent); err != nil {
+		log.Println("Chat: failed to update thread parent.", err)
+		return
+	}
+
+	event := *parent
+	event.Type = "room.thread.updated"
+	PublishMessage(room.ID, &event)
+}
+
+// GetRoomThread returns parent message and replies visible for user
+func GetRoomThread(room *Room, parentID string, for_user *User) (*Message, []*Message, error) {
+	parent, err := GetThreadParent(room, parentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messages, err := History.List(RoomHistoryKey(room), time.Time{}, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replies := []*Message{}
+	for _, message := range FilterMuted(messages, for_user) {
+		if message.ParentID == parent.ID {
+			StripMissingAttachments(message)
+			replies = append(replies, message)
+		}
+	}
+
+	return parent, replies, nil
+}
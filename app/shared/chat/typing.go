@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// Typing indicator expires on server if client not repeat 'typing.start' in this interval
+var TYPING_TIMEOUT = 5 * time.Second
+
+// Restrict typing events count per FIXED_WINDOW_INTERVAL, separate from text messages window
+const TYPING_WINDOW_MAX = 30
+
+// Active typing indicators by subject + "/" + user.ID
+var TypingStore = struct {
+	Map map[string]*time.Timer
+	Mu  sync.Mutex
+}{
+	Map: map[string]*time.Timer{},
+	Mu:  sync.Mutex{},
+}
+
+// AllowTyping counts typing event in fixed window, returns false if user sends to fast
+func (u *User) AllowTyping() bool {
+	u.FixedWindowCounterMu.Lock()
+	defer u.FixedWindowCounterMu.Unlock()
+
+	if u.TypingWindowCounter > TYPING_WINDOW_MAX {
+		return false
+	}
+	u.TypingWindowCounter++
+	return true
+}
+
+// StartTyping publishes 'typing.start' to subject (room or user) and arms expiration timer.
+// Repeated start only prolongs indicator.
+func StartTyping(user *User, subject string, to MessageUser) {
+	key := subject + "/" + user.ID
+
+	TypingStore.Mu.Lock()
+	defer TypingStore.Mu.Unlock()
+
+	if timer := TypingStore.Map[key]; timer != nil {
+		if timer.Stop() {
+			timer.Reset(TYPING_TIMEOUT)
+			return
+		}
+	}
+
+	// Timer assigned under lock, callback reads it under the same lock
+	var timer *time.Timer
+	timer = time.AfterFunc(TYPING_TIMEOUT, func() {
+		TypingStore.Mu.Lock()
+		defer TypingStore.Mu.Unlock()
+		expireTyping(key, timer, user, subject, to)
+	})
+	TypingStore.Map[key] = timer
+	PublishMessage(subject, MessageTyping("typing.start", user, to))
+}
+
+// expireTyping stops indicator if it was not replaced by new one while timer fired, caller holds TypingStore.Mu
+func expireTyping(key string, timer *time.Timer, user *User, subject string, to MessageUser) {
+	if TypingStore.Map[key] != timer {
+		return
+	}
+	delete(TypingStore.Map, key)
+	PublishMessage(subject, MessageTyping("typing.stop", user, to))
+}
+
+// StopTyping publishes 'typing.stop' if indicator is active
+func StopTyping(user *User, subject string, to MessageUser) {
+	key := subject + "/" + user.ID
+
+	TypingStore.Mu.Lock()
+	defer TypingStore.Mu.Unlock()
+
+	timer := TypingStore.Map[key]
+	if timer == nil {
+		return
+	}
+	timer.Stop()
+	delete(TypingStore.Map, key)
+	PublishMessage(subject, MessageTyping("typing.stop", user, to))
+}
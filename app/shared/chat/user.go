@@ -1,6 +1,7 @@
 package chat
 
 import (
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"sync"
@@ -13,11 +14,18 @@ type User struct {
 	Sessions             map[string]*Session `json:"-"`
 	SessionsMu           sync.Mutex          `json:"-"`
 	FixedWindowCounter   int                 `json:"-"`
+	TypingWindowCounter  int                 `json:"-"`
 	FixedWindowCounterMu sync.Mutex          `json:"-"`
 	MuteList             map[*User]time.Time `json:"-"`
 	MuteListMu           sync.Mutex          `json:"-"`
 	UploadBytes          int64               `json:"-"`
 	UploadBytesMu        sync.Mutex          `json:"-"`
+	Presence             string              `json:"-"`
+	PresenceTimer        *time.Timer         `json:"-"`
+	PresenceRooms        map[string]bool     `json:"-"` // Rooms left by closed sessions, notified when user goes offline
+	PresenceMu           sync.Mutex          `json:"-"`
+	Peers                map[string]*User    `json:"-"` // Users in private conversation with this user
+	PeersMu              sync.Mutex          `json:"-"`
 }
 
 var UserStore = struct {
@@ -44,6 +52,11 @@ func GetUser(id string, name string) *User {
 			MuteListMu:           sync.Mutex{},
 			UploadBytes:          0,
 			UploadBytesMu:        sync.Mutex{},
+			Presence:             PRESENCE_OFFLINE,
+			PresenceRooms:        map[string]bool{},
+			PresenceMu:           sync.Mutex{},
+			Peers:                map[string]*User{},
+			PeersMu:              sync.Mutex{},
 		}
 
 		go func() {
@@ -51,6 +64,7 @@ func GetUser(id string, name string) *User {
 			for range ticker.C {
 				user.FixedWindowCounterMu.Lock()
 				user.FixedWindowCounter = 0
+				user.TypingWindowCounter = 0
 				user.FixedWindowCounterMu.Unlock()
 			}
 		}()
@@ -70,15 +84,17 @@ func GetUser(id string, name string) *User {
 	return UserStore.Map[id]
 }
 
+// UserExists returns true for users known by this node or connected to other node
 func UserExists(id string) bool {
 	UserStore.Mu.Lock()
-	defer UserStore.Mu.Unlock()
+	exists := UserStore.Map[id] != nil
+	UserStore.Mu.Unlock()
 
-	if UserStore.Map[id] != nil {
+	if exists {
 		return true
 	}
 
-	return false
+	return cluster.UserExists(id)
 }
 
 func (u *User) NewSession() *Session {
@@ -102,7 +118,9 @@ func (u *User) NewSession() *Session {
 	SessionStore.Mu.Unlock()
 
 	// HearBeat. Need to reset timer in GetSession
-	session.TimeToDie = time.AfterFunc(HEART_BEAT_TIMEOUT, func() { u.DeleteSession(session) })
+	session.TimeToDie = time.AfterFunc(HEART_BEAT_TIMEOUT, func() { u.SuspendSession(session) })
+
+	u.presenceSessionOpened()
 
 	return session
 }
@@ -113,37 +131,118 @@ func (u *User) GetSession(id string) (*Session, error) {
 
 	session := SessionStore.Map[id]
 
-	if session == nil {
-		return session, errors.New("Session not found")
+	// Suspended session can be got back only by ResumeSession with token
+	if session == nil || session.IsSuspended() {
+		return nil, errors.New("Session not found")
 	}
 
 	// HeartBeat.
 	// If session will be not touched while timeout duration then it will be destroyed and next attempt to access it must return error (404 in controller for example)
-	if !session.TimeToDie.Stop() {
-		<-session.TimeToDie.C
-	}
-	session.TimeToDie.Reset(HEART_BEAT_TIMEOUT)
+	session.Touch()
 
 	return session, nil
 }
 
 func (u *User) DeleteSession(s *Session) {
-	s.LeaveAllRooms()
-	s.UnsubscribeAll()
-
+	// Session can be deleted by client and by heartbeat timer at the same time, only first call proceed
 	SessionStore.Mu.Lock()
+	if SessionStore.Map[s.ID] != s {
+		SessionStore.Mu.Unlock()
+		return
+	}
 	delete(SessionStore.Map, s.ID)
 	SessionStore.Mu.Unlock()
+	s.StateMu.Lock()
+	s.TimeToDie.Stop()
+	s.StateMu.Unlock()
+
+	rooms := []string{}
+	s.RoomsMu.Lock()
+	for _, r := range s.Rooms {
+		rooms = append(rooms, r.ID)
+	}
+	s.RoomsMu.Unlock()
+
+	s.LeaveAllRooms()
+	s.UnsubscribeAll()
 
 	u.SessionsMu.Lock()
 	delete(u.Sessions, s.ID)
 	u.SessionsMu.Unlock()
 
+	u.presenceSessionClosed(rooms)
+
 	s.Closed <- true
 
 	s = nil
 }
 
+// SuspendSession is called when client lost session (heartbeat timeout or connection closed).
+// Session keeps rooms, subscriptions and buffer for SESSION_RESUME_GRACE, then it is deleted.
+func (u *User) SuspendSession(s *Session) {
+	if SESSION_RESUME_GRACE <= 0 {
+		u.DeleteSession(s)
+		return
+	}
+
+	s.StateMu.Lock()
+	defer s.StateMu.Unlock()
+	if s.Suspended {
+		return
+	}
+	s.Suspended = true
+	s.TimeToDie.Stop()
+	s.TimeToDie = time.AfterFunc(SESSION_RESUME_GRACE, func() { u.DeleteSession(s) })
+}
+
+// ResumeSession returns session by resume token, active or suspended in grace window.
+// Messages sent after ack are delivered again, client not acknowledged them.
+func (u *User) ResumeSession(token string, ack uint64) (*Session, error) {
+	var session *Session
+	u.SessionsMu.Lock()
+	for _, s := range u.Sessions {
+		if subtle.ConstantTimeCompare([]byte(s.Token), []byte(token)) == 1 {
+			session = s
+			break
+		}
+	}
+	u.SessionsMu.Unlock()
+
+	SessionStore.Mu.Lock()
+	defer SessionStore.Mu.Unlock()
+	if session == nil || SessionStore.Map[session.ID] != session {
+		return nil, errors.New("Session not found")
+	}
+
+	session.StateMu.Lock()
+	// Grace timer fired, session is deleting now
+	if !session.TimeToDie.Stop() {
+		session.StateMu.Unlock()
+		return nil, errors.New("Session not found")
+	}
+	session.Suspended = false
+	session.LastSeen = time.Now()
+	session.TimeToDie = time.AfterFunc(HEART_BEAT_TIMEOUT, func() { u.SuspendSession(session) })
+	session.StateMu.Unlock()
+
+	session.Ack(ack)
+	session.Requeue(ack)
+
+	return session, nil
+}
+
+// AllowMessage counts message in fixed window, returns false if user sends to fast
+func (u *User) AllowMessage() bool {
+	u.FixedWindowCounterMu.Lock()
+	defer u.FixedWindowCounterMu.Unlock()
+
+	if u.FixedWindowCounter > FIXED_WINDOW_MAX {
+		return false
+	}
+	u.FixedWindowCounter++
+	return true
+}
+
 func (u *User) AddToMute(target *User) {
 	u.MuteListMu.Lock()
 	u.MuteList[target] = time.Now()
@@ -0,0 +1,711 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Room events delivered to webhooks
+const WEBHOOK_EVENT_MESSAGE = "message"
+const WEBHOOK_EVENT_JOIN = "join"
+const WEBHOOK_EVENT_LEAVE = "leave"
+const WEBHOOK_EVENT_ROOM_CREATED = "room.created"
+const WEBHOOK_EVENT_ROOM_DELETED = "room.deleted"
+
+var WebhookEvents = []string{
+	WEBHOOK_EVENT_MESSAGE,
+	WEBHOOK_EVENT_JOIN,
+	WEBHOOK_EVENT_LEAVE,
+	WEBHOOK_EVENT_ROOM_CREATED,
+	WEBHOOK_EVENT_ROOM_DELETED,
+}
+
+// Room ID of webhook receiving events of all rooms, registered by admins only
+const WEBHOOK_ALL_ROOMS = "*"
+
+// Webhooks per room
+const WEBHOOK_ROOM_LIMIT = 10
+
+const WEBHOOK_MAX_URL_LENGTH = 2048
+
+// Last deliveries kept in log
+const WEBHOOK_LOG_SIZE = 200
+
+// Webhook changes are shared by nodes on this subject, each node stores its webhooks in State under WEBHOOK_STATE_KEY
+const WEBHOOK_SUBJECT = "chat.webhooks"
+const WEBHOOK_STATE_KEY = "webhooks"
+
+// Delivery settings, set from Config.Webhooks
+var WEBHOOK_WORKERS = 2
+var WEBHOOK_QUEUE_SIZE = 1000
+var WEBHOOK_TIMEOUT = 10 * time.Second
+var WEBHOOK_MAX_ATTEMPTS = 5
+
+// Delay before second attempt, doubled after each failed attempt
+var WEBHOOK_RETRY_BACKOFF = 2 * time.Second
+
+// Deliveries to loopback, private and link-local addresses are allowed (receivers in local network, tests)
+var WEBHOOK_ALLOW_PRIVATE = false
+
+// WebhookConfig sets delivery of room events to webhooks
+type WebhookConfig struct {
+	Workers      int  `json:"Workers"`      // Concurrent deliveries
+	QueueSize    int  `json:"QueueSize"`    // Pending deliveries, events over it are dropped
+	Timeout      int  `json:"Timeout"`      // Seconds to wait for response
+	MaxAttempts  int  `json:"MaxAttempts"`  // Attempts per event, 1 - no retries
+	RetryBackoff int  `json:"RetryBackoff"` // Seconds before first retry, doubled after each one
+	AllowPrivate bool `json:"AllowPrivate"` // Deliver to loopback, private and link-local addresses
+}
+
+// Validate checks that delivery settings are usable
+func (c WebhookConfig) Validate() error {
+	if c.Workers <= 0 || c.QueueSize <= 0 || c.Timeout <= 0 || c.MaxAttempts <= 0 {
+		return errors.New("Chat: Webhooks Workers, QueueSize, Timeout and MaxAttempts must be positive")
+	}
+	if c.RetryBackoff < 0 {
+		return errors.New("Chat: Webhooks RetryBackoff can't be negative")
+	}
+	return nil
+}
+
+var ErrWebhookBadURL = errors.New("Webhook URL must be absolute http or https URL.")
+var ErrWebhookPrivateAddress = errors.New("Webhook URL must not point to local or private network.")
+var ErrWebhookBadEvent = errors.New("Unknown webhook event.")
+var ErrWebhookLimit = errors.New("Too many webhooks in room.")
+var ErrWebhookNotFound = errors.New("Webhook not found.")
+
+// Webhook receives POST with WebhookPayload for selected events of room.
+// Body is signed by Secret, see WebhookSignature. Secret is shown once, in response to creation.
+type Webhook struct {
+	ID        string    `json:"id"`
+	RoomID    string    `json:"room_id"` // WEBHOOK_ALL_ROOMS for all rooms
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+}
+
+// Wants returns true if webhook is subscribed to event
+func (h *Webhook) Wants(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Public returns copy of webhook without secret
+func (h *Webhook) Public() *Webhook {
+	c := *h
+	c.Secret = ""
+	c.Events = append([]string{}, h.Events...)
+	return &c
+}
+
+// WebhookPayload is JSON body of webhook request
+type WebhookPayload struct {
+	ID        string       `json:"id"` // Delivery ID, the same for retries
+	Event     string       `json:"event"`
+	Timestamp time.Time    `json:"timestamp"`
+	Room      MessageUser  `json:"room"`
+	User      *MessageUser `json:"user,omitempty"`    // Not set for room.deleted
+	Message   *Message     `json:"message,omitempty"` // Set for message only
+}
+
+// WebhookDelivery is attempt of delivery in log. Status is HTTP status, 0 if request failed
+type WebhookDelivery struct {
+	ID        string        `json:"id"`
+	WebhookID string        `json:"webhook_id"`
+	RoomID    string        `json:"room_id"`
+	URL       string        `json:"url"`
+	Event     string        `json:"event"`
+	Attempt   int           `json:"attempt"` // 0 - webhook removed with room
+	Status    int           `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	Time      time.Time     `json:"time"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Success returns true for 2xx response
+func (d WebhookDelivery) Success() bool {
+	return d.Status >= 200 && d.Status < 300
+}
+
+// WebhookSignature returns value of X-Chat-Signature header: "sha256=" and hex HMAC-SHA256 of body with secret
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookStoreType struct {
+	Map map[string]*Webhook // by ID
+	Mu  sync.Mutex
+}
+
+// Registered webhooks of all nodes, loaded from State in Init
+var WebhookStore = WebhookStoreType{
+	Map: map[string]*Webhook{},
+	Mu:  sync.Mutex{},
+}
+
+// ValidateWebhookURL checks that URL is absolute http(s) URL and its host is not private IP address.
+// Host names are checked on each delivery, after resolving.
+func ValidateWebhookURL(raw string) error {
+	if len(raw) > WEBHOOK_MAX_URL_LENGTH {
+		return ErrWebhookBadURL
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrWebhookBadURL
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !WebhookAddressAllowed(ip) {
+		return ErrWebhookPrivateAddress
+	}
+	return nil
+}
+
+// Private networks not covered by net.IP methods: RFC 1918, shared address space, unique local IPv6
+var webhookPrivateNets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// WebhookAddressAllowed returns false for loopback, private, link-local, multicast and unspecified
+// addresses, unless WEBHOOK_ALLOW_PRIVATE is set. Webhook URL is set by room owner, so it can't reach internal services.
+func WebhookAddressAllowed(ip net.IP) bool {
+	if WEBHOOK_ALLOW_PRIVATE {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range webhookPrivateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialContext resolves host and connects to the first allowed address.
+// Connection is made to checked address, so host can't be resolved again to other one.
+func webhookDialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: WEBHOOK_TIMEOUT}
+	for _, ip := range ips {
+		if WebhookAddressAllowed(ip.IP) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	return nil, ErrWebhookPrivateAddress
+}
+
+// AddWebhook registers webhook of room, empty events - all events.
+// Returned webhook has Secret, listed ones have not.
+func AddWebhook(roomID string, rawurl string, events []string, createdBy string) (*Webhook, error) {
+	if err := ValidateWebhookURL(rawurl); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		events = WebhookEvents
+	}
+	known := map[string]bool{}
+	for _, e := range WebhookEvents {
+		known[e] = true
+	}
+	selected := []string{}
+	seen := map[string]bool{}
+	for _, e := range events {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !known[e] {
+			return nil, ErrWebhookBadEvent
+		}
+		if !seen[e] {
+			seen[e] = true
+			selected = append(selected, e)
+		}
+	}
+
+	hook := &Webhook{
+		ID:        RandomString(16),
+		RoomID:    roomID,
+		URL:       rawurl,
+		Events:    selected,
+		Secret:    RandomString(32),
+		CreatedBy: createdBy,
+		Created:   time.Now(),
+	}
+
+	WebhookStore.Mu.Lock()
+	count := 0
+	for _, h := range WebhookStore.Map {
+		if h.RoomID == roomID {
+			count++
+		}
+	}
+	if count >= WEBHOOK_ROOM_LIMIT {
+		WebhookStore.Mu.Unlock()
+		return nil, ErrWebhookLimit
+	}
+	WebhookStore.Map[hook.ID] = hook
+	WebhookStore.Mu.Unlock()
+
+	saveWebhooks()
+	publishWebhook(WEBHOOK_OP_ADD, hook)
+	c := *hook
+	return &c, nil
+}
+
+// GetWebhook returns webhook without secret
+func GetWebhook(id string) (*Webhook, error) {
+	WebhookStore.Mu.Lock()
+	defer WebhookStore.Mu.Unlock()
+
+	if h := WebhookStore.Map[id]; h != nil {
+		return h.Public(), nil
+	}
+	return nil, ErrWebhookNotFound
+}
+
+// RemoveWebhook unregisters webhook, pending retries are dropped
+func RemoveWebhook(id string) error {
+	WebhookStore.Mu.Lock()
+	hook := WebhookStore.Map[id]
+	if hook == nil {
+		WebhookStore.Mu.Unlock()
+		return ErrWebhookNotFound
+	}
+	delete(WebhookStore.Map, id)
+	WebhookStore.Mu.Unlock()
+
+	saveWebhooks()
+	publishWebhook(WEBHOOK_OP_REMOVE, hook)
+	return nil
+}
+
+// removeRoomWebhooks unregisters webhooks of deleted room, room with the same name may have other owner.
+// Queued room.deleted event is still delivered with retries, removal is shown in delivery log.
+func removeRoomWebhooks(room *Room) {
+	removed := []*Webhook{}
+	WebhookStore.Mu.Lock()
+	for id, h := range WebhookStore.Map {
+		if h.RoomID == room.ID {
+			delete(WebhookStore.Map, id)
+			removed = append(removed, h)
+		}
+	}
+	WebhookStore.Mu.Unlock()
+
+	if len(removed) == 0 {
+		return
+	}
+	saveWebhooks()
+	for _, h := range removed {
+		publishWebhook(WEBHOOK_OP_REMOVE, h)
+	}
+	if webhooks == nil {
+		return
+	}
+	for _, h := range removed {
+		job := &webhookJob{Hook: h, Payload: &WebhookPayload{
+			ID:        NewMessageID(),
+			Event:     WEBHOOK_EVENT_ROOM_DELETED,
+			Timestamp: time.Now(),
+			Room:      MessageUser{ID: room.ID, Name: room.Name},
+		}}
+		webhooks.record(job, &WebhookDelivery{Time: time.Now(), Error: "Webhook removed with room"})
+	}
+}
+
+// Webhooks returns webhooks of room without secrets ordered by creation, empty roomID - all webhooks
+func Webhooks(roomID string) []*Webhook {
+	WebhookStore.Mu.Lock()
+	list := []*Webhook{}
+	for _, h := range WebhookStore.Map {
+		if roomID == "" || h.RoomID == roomID {
+			list = append(list, h.Public())
+		}
+	}
+	WebhookStore.Mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Webhook changes sent to other nodes. Started node sends 'sync', running nodes answer with 'snapshot' of all webhooks.
+const WEBHOOK_OP_ADD = "add"
+const WEBHOOK_OP_REMOVE = "remove"
+const WEBHOOK_OP_SYNC = "sync"
+const WEBHOOK_OP_SNAPSHOT = "snapshot"
+
+// webhookSync is change of one webhook sent to other nodes, concurrent changes of other webhooks are kept.
+// Snapshot has all webhooks and node it answers in To.
+type webhookSync struct {
+	Node     string     `json:"node"`
+	Op       string     `json:"op"`
+	To       string     `json:"to,omitempty"`
+	Webhook  *Webhook   `json:"webhook,omitempty"`
+	Webhooks []*Webhook `json:"webhooks,omitempty"`
+}
+
+// saveWebhooks stores webhooks known to this node
+func saveWebhooks() {
+	WebhookStore.Mu.Lock()
+	list := make([]*Webhook, 0, len(WebhookStore.Map))
+	for _, h := range WebhookStore.Map {
+		list = append(list, h)
+	}
+	WebhookStore.Mu.Unlock()
+
+	if err := State.Save(WEBHOOK_STATE_KEY, list); err != nil {
+		log.Println("Chat: failed to save webhooks.", err)
+	}
+}
+
+// publishWebhook sends added or removed webhook to other nodes
+func publishWebhook(op string, hook *Webhook) {
+	sendWebhookSync(&webhookSync{Op: op, Webhook: hook})
+}
+
+func sendWebhookSync(update *webhookSync) {
+	if cluster == nil {
+		return
+	}
+	update.Node = cluster.NodeID
+	data, _ := json.Marshal(update)
+	if err := bus.Publish(WEBHOOK_SUBJECT, data); err != nil {
+		log.Println("Chat: failed to send webhook.", err)
+	}
+}
+
+// applyWebhook adds or removes webhook changed by other node, applying it again changes nothing.
+// Snapshot of running node replaces webhooks of started node, they could be changed while it was stopped.
+// Returns false if nothing changed.
+func applyWebhook(update *webhookSync) bool {
+	WebhookStore.Mu.Lock()
+	defer WebhookStore.Mu.Unlock()
+
+	switch update.Op {
+	case WEBHOOK_OP_ADD:
+		if update.Webhook == nil {
+			return false
+		}
+		WebhookStore.Map[update.Webhook.ID] = update.Webhook
+	case WEBHOOK_OP_REMOVE:
+		if update.Webhook == nil {
+			return false
+		}
+		delete(WebhookStore.Map, update.Webhook.ID)
+	case WEBHOOK_OP_SNAPSHOT:
+		if update.To != cluster.NodeID {
+			return false
+		}
+		WebhookStore.Map = map[string]*Webhook{}
+		for _, h := range update.Webhooks {
+			WebhookStore.Map[h.ID] = h
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// answerWebhookSync sends all webhooks to started node
+func answerWebhookSync(node string) {
+	WebhookStore.Mu.Lock()
+	list := make([]*Webhook, 0, len(WebhookStore.Map))
+	for _, h := range WebhookStore.Map {
+		list = append(list, h)
+	}
+	WebhookStore.Mu.Unlock()
+
+	sendWebhookSync(&webhookSync{Op: WEBHOOK_OP_SNAPSHOT, To: node, Webhooks: list})
+}
+
+// LoadWebhooks restores stored webhooks, asks running nodes for their webhooks and applies webhooks changed by other nodes
+func LoadWebhooks(b Bus) (Subscription, error) {
+	list := []*Webhook{}
+	if err := State.Load(WEBHOOK_STATE_KEY, &list); err != nil && err != ErrStateNotFound {
+		return nil, err
+	}
+	WebhookStore.Mu.Lock()
+	WebhookStore.Map = map[string]*Webhook{}
+	for _, h := range list {
+		WebhookStore.Map[h.ID] = h
+	}
+	WebhookStore.Mu.Unlock()
+
+	sub, err := b.Subscribe(WEBHOOK_SUBJECT, func(data []byte) {
+		update := &webhookSync{}
+		if err := json.Unmarshal(data, update); err != nil || update.Node == cluster.NodeID {
+			return
+		}
+		if update.Op == WEBHOOK_OP_SYNC {
+			answerWebhookSync(update.Node)
+			return
+		}
+		if applyWebhook(update) {
+			saveWebhooks()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sendWebhookSync(&webhookSync{Op: WEBHOOK_OP_SYNC})
+	return sub, nil
+}
+
+// Delivery dispatcher of this node, set in Init
+var webhooks *WebhookDispatcher
+
+// EmitWebhook queues event of room for webhooks of room and webhooks of all rooms.
+// Event is emitted by node where it happened, user and msg can be nil.
+func EmitWebhook(event string, room *Room, user *User, msg *Message) {
+	if webhooks == nil {
+		return
+	}
+
+	hooks := []*Webhook{}
+	WebhookStore.Mu.Lock()
+	for _, h := range WebhookStore.Map {
+		if (h.RoomID == room.ID || h.RoomID == WEBHOOK_ALL_ROOMS) && h.Wants(event) {
+			hooks = append(hooks, h)
+		}
+	}
+	WebhookStore.Mu.Unlock()
+
+	for _, h := range hooks {
+		payload := &WebhookPayload{
+			ID:        NewMessageID(),
+			Event:     event,
+			Timestamp: time.Now(),
+			Room:      MessageUser{ID: room.ID, Name: room.Name},
+			Message:   msg,
+		}
+		if user != nil {
+			payload.User = &MessageUser{ID: user.ID, Name: user.Name}
+		}
+		// Encoded now, message can be changed later
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("Chat: failed to encode webhook payload.", err)
+			continue
+		}
+		webhooks.Enqueue(&webhookJob{Hook: h, Payload: payload, Body: body, Attempt: 1})
+	}
+}
+
+// WebhookDeliveries returns logged deliveries of room, newest first. Empty roomID - all deliveries.
+func WebhookDeliveries(roomID string) []WebhookDelivery {
+	if webhooks == nil {
+		return []WebhookDelivery{}
+	}
+	return webhooks.Deliveries(roomID)
+}
+
+type webhookJob struct {
+	Hook    *Webhook
+	Payload *WebhookPayload
+	Body    []byte
+	Attempt int
+}
+
+// WebhookDispatcher delivers queued events by background workers.
+// Failed delivery is queued again after backoff until WEBHOOK_MAX_ATTEMPTS.
+type WebhookDispatcher struct {
+	Client *http.Client
+	Queue  chan *webhookJob
+
+	log   []WebhookDelivery // Ring of WEBHOOK_LOG_SIZE
+	next  int
+	logMu sync.Mutex
+	stop  chan bool
+	wg    sync.WaitGroup
+}
+
+// NewWebhookDispatcher returns dispatcher with client which connects to allowed addresses only
+// and doesn't follow redirects, redirect response is failed delivery.
+func NewWebhookDispatcher() *WebhookDispatcher {
+	client := &http.Client{
+		Timeout: WEBHOOK_TIMEOUT,
+		Transport: &http.Transport{
+			DialContext:         webhookDialContext,
+			TLSHandshakeTimeout: WEBHOOK_TIMEOUT,
+			MaxIdleConnsPerHost: WEBHOOK_WORKERS,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &WebhookDispatcher{
+		Client: client,
+		Queue:  make(chan *webhookJob, WEBHOOK_QUEUE_SIZE),
+		log:    make([]WebhookDelivery, 0, WEBHOOK_LOG_SIZE),
+		stop:   make(chan bool),
+	}
+}
+
+// Start runs workers
+func (d *WebhookDispatcher) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case <-d.stop:
+					return
+				case job := <-d.Queue:
+					d.deliver(job)
+				}
+			}
+		}()
+	}
+}
+
+// Stop waits for running deliveries, queued ones and retries are dropped
+func (d *WebhookDispatcher) Stop() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// Enqueue adds job to queue, job is logged and dropped if queue is full
+func (d *WebhookDispatcher) Enqueue(job *webhookJob) {
+	select {
+	case <-d.stop:
+		return
+	default:
+	}
+
+	select {
+	case d.Queue <- job:
+	default:
+		d.record(job, &WebhookDelivery{Time: time.Now(), Error: "Queue is full, event dropped"})
+	}
+}
+
+// deliver posts job and schedules retry on failure
+func (d *WebhookDispatcher) deliver(job *webhookJob) {
+	// Retry is dropped if webhook removed meanwhile. room.deleted is queued
+	// just before webhooks of room are removed, so it is delivered anyway.
+	if job.Attempt > 1 && job.Payload.Event != WEBHOOK_EVENT_ROOM_DELETED {
+		WebhookStore.Mu.Lock()
+		registered := WebhookStore.Map[job.Hook.ID] != nil
+		WebhookStore.Mu.Unlock()
+		if !registered {
+			return
+		}
+	}
+
+	entry := &WebhookDelivery{Time: time.Now()}
+	entry.Status, entry.Error = d.post(job)
+	entry.Duration = time.Since(entry.Time)
+	d.record(job, entry)
+
+	if entry.Success() || job.Attempt >= WEBHOOK_MAX_ATTEMPTS {
+		return
+	}
+	backoff := WEBHOOK_RETRY_BACKOFF << uint(job.Attempt-1)
+	retry := &webhookJob{Hook: job.Hook, Payload: job.Payload, Body: job.Body, Attempt: job.Attempt + 1}
+	time.AfterFunc(backoff, func() { d.Enqueue(retry) })
+}
+
+// post sends signed payload, returns response status and error text
+func (d *WebhookDispatcher) post(job *webhookJob) (int, string) {
+	req, err := http.NewRequest("POST", job.Hook.URL, bytes.NewReader(job.Body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gowebapp-chat-webhook")
+	req.Header.Set("X-Chat-Event", job.Payload.Event)
+	req.Header.Set("X-Chat-Delivery", job.Payload.ID)
+	req.Header.Set("X-Chat-Signature", WebhookSignature(job.Hook.Secret, job.Body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	// Read some body to reuse connection
+	io.CopyN(ioutil.Discard, resp.Body, 4096)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, resp.Status
+	}
+	return resp.StatusCode, ""
+}
+
+// record adds delivery of job to log
+func (d *WebhookDispatcher) record(job *webhookJob, entry *WebhookDelivery) {
+	entry.ID = job.Payload.ID
+	entry.WebhookID = job.Hook.ID
+	entry.RoomID = job.Payload.Room.ID
+	entry.URL = job.Hook.URL
+	entry.Event = job.Payload.Event
+	entry.Attempt = job.Attempt
+	if entry.Error != "" && entry.Attempt > 0 {
+		log.Printf("Chat: webhook %s delivery %s attempt %d failed. %s\n", entry.WebhookID, entry.ID, entry.Attempt, entry.Error)
+	}
+
+	d.logMu.Lock()
+	if len(d.log) < WEBHOOK_LOG_SIZE {
+		d.log = append(d.log, *entry)
+	} else {
+		d.log[d.next] = *entry
+	}
+	d.next = (d.next + 1) % WEBHOOK_LOG_SIZE
+	d.logMu.Unlock()
+}
+
+// Deliveries returns logged deliveries of room, newest first. Empty roomID - all deliveries.
+func (d *WebhookDispatcher) Deliveries(roomID string) []WebhookDelivery {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+
+	list := []WebhookDelivery{}
+	for i := 1; i <= len(d.log); i++ {
+		entry := d.log[(d.next-i+len(d.log))%len(d.log)]
+		if roomID == "" || entry.RoomID == roomID {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
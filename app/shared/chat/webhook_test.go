@@ -0,0 +1,270 @@
+package chat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	backoff := WEBHOOK_RETRY_BACKOFF
+	WEBHOOK_RETRY_BACKOFF = 10 * time.Millisecond
+	WEBHOOK_ALLOW_PRIVATE = true
+	defer func() {
+		WEBHOOK_RETRY_BACKOFF = backoff
+		WEBHOOK_ALLOW_PRIVATE = false
+	}()
+
+	// Receiver fails first request to check retry
+	var requests int32
+	var secret atomic.Value
+	received := make(chan *WebhookPayload, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Chat-Signature") != WebhookSignature(secret.Load().(string), body) {
+			t.Errorf("Bad signature of %s", body)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		payload := &WebhookPayload{}
+		if err := json.Unmarshal(body, payload); err != nil || payload.Event != r.Header.Get("X-Chat-Event") {
+			t.Errorf("Bad payload %s. %v", body, err)
+		}
+		received <- payload
+	}))
+	defer receiver.Close()
+
+	wait := func(event string) *WebhookPayload {
+		t.Helper()
+		select {
+		case p := <-received:
+			if p.Event != event {
+				t.Fatalf("Expected %s event, got %+v", event, p)
+			}
+			return p
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Event %s not delivered", event)
+			return nil
+		}
+	}
+
+	owner := GetUser("webhook-owner", "Owner")
+	member := GetUser("webhook-member", "Member")
+	so := owner.NewSession()
+	sm := member.NewSession()
+	defer owner.DeleteSession(so)
+	defer member.DeleteSession(sm)
+
+	ProcessMessage(&Message{Type: "room.create", To: MessageUser{Name: "webhook-room"}}, so)
+	to := MessageUser{ID: RoomID("webhook-room"), Name: "webhook-room"}
+	eventually(t, func() bool { return RoomExistsByID(to.ID) }, "room created")
+	ProcessMessage(&Message{Type: "room.join", To: to}, so)
+	waitMessage(t, so, "room.join")
+
+	// Owner only, valid URL and events
+	body, _ := json.Marshal(map[string]interface{}{"url": receiver.URL, "events": []string{"join", "message", "leave", "room.deleted"}})
+	ProcessMessage(&Message{Type: "webhook.add", To: to, Body: string(body)}, sm)
+	waitMessage(t, sm, "room.forbidden")
+	ProcessMessage(&Message{Type: "webhook.add", To: to, Body: `{"url": "ftp://example.com"}`}, so)
+	waitMessage(t, so, "webhook.error")
+	ProcessMessage(&Message{Type: "webhook.add", To: to, Body: `{"url": "http://example.com", "events": ["typing"]}`}, so)
+	waitMessage(t, so, "webhook.error")
+
+	ProcessMessage(&Message{Type: "webhook.add", To: to, Body: string(body)}, so)
+	hook := &Webhook{}
+	if err := json.Unmarshal([]byte(waitMessage(t, so, "webhook.added").Body), hook); err != nil || hook.Secret == "" {
+		t.Fatalf("Expected webhook with secret, got %+v. %v", hook, err)
+	}
+	secret.Store(hook.Secret)
+
+	// Join delivered by retry
+	ProcessMessage(&Message{Type: "room.join", To: to}, sm)
+	if p := wait("join"); p.User == nil || p.User.ID != member.ID || p.Room.ID != to.ID {
+		t.Errorf("Unexpected join payload %+v", p)
+	}
+	ProcessMessage(&Message{Type: "room.message", To: to, Body: "build is green"}, sm)
+	if p := wait("message"); p.Message == nil || p.Message.Body != "build is green" || p.Message.From.ID != member.ID {
+		t.Errorf("Unexpected message payload %+v", p)
+	}
+
+	// Secret not listed, failed attempt logged. Delivery is logged after response.
+	logged := func() []WebhookDelivery {
+		list := []WebhookDelivery{}
+		for _, d := range WebhookDeliveries(to.ID) {
+			if d.WebhookID == hook.ID {
+				list = append(list, d)
+			}
+		}
+		return list
+	}
+	eventually(t, func() bool { return len(logged()) == 3 }, "deliveries logged")
+	if d := logged()[2]; d.Event != "join" || d.Attempt != 1 || d.Status != http.StatusInternalServerError || d.Success() {
+		t.Errorf("Expected failed first join attempt, got %+v", d)
+	}
+
+	ProcessMessage(&Message{Type: "webhook.list", To: to}, so)
+	list := struct {
+		Webhooks   []*Webhook        `json:"webhooks"`
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}{}
+	json.Unmarshal([]byte(waitMessage(t, so, "webhook.list").Body), &list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].ID != hook.ID || list.Webhooks[0].Secret != "" || len(list.Deliveries) < 3 {
+		t.Errorf("Unexpected webhook list %+v", list)
+	}
+
+	// Webhooks of deleted room removed after room.deleted
+	ProcessMessage(&Message{Type: "room.leave", To: to}, sm)
+	wait("leave")
+	ProcessMessage(&Message{Type: "room.leave", To: to}, so)
+	wait("leave")
+	wait("room.deleted")
+	if hooks := Webhooks(to.ID); len(hooks) != 0 {
+		t.Errorf("Webhooks of deleted room not removed, got %+v", hooks)
+	}
+	eventually(t, func() bool {
+		for _, d := range logged() {
+			if d.Attempt == 0 && d.Event == "room.deleted" && d.Error != "" {
+				return true
+			}
+		}
+		return false
+	}, "webhook removal logged")
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+	var requests int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer receiver.Close()
+
+	for _, u := range []string{"http://127.0.0.1/hook", "http://10.1.2.3/", "http://169.254.169.254/latest/meta-data", "http://[::1]:8080/", "http://0.0.0.0/"} {
+		if _, err := AddWebhook(WEBHOOK_ALL_ROOMS, u, nil, "admin@example.com"); err != ErrWebhookPrivateAddress {
+			t.Errorf("Expected private address error for %s, got %v", u, err)
+		}
+	}
+
+	// Host name resolved to loopback is rejected on delivery
+	d := NewWebhookDispatcher()
+	local := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+	job := &webhookJob{Hook: &Webhook{ID: "private", URL: local}, Payload: &WebhookPayload{Event: "join"}, Body: []byte("{}"), Attempt: 1}
+	if status, text := d.post(job); status != 0 || !strings.Contains(text, ErrWebhookPrivateAddress.Error()) {
+		t.Errorf("Expected private address error, got %d %s", status, text)
+	}
+	if atomic.LoadInt32(&requests) != 0 {
+		t.Error("Request sent to private address")
+	}
+
+	// Redirects are not followed
+	WEBHOOK_ALLOW_PRIVATE = true
+	defer func() { WEBHOOK_ALLOW_PRIVATE = false }()
+	redirect := httptest.NewServer(http.RedirectHandler(receiver.URL, http.StatusFound))
+	defer redirect.Close()
+	job.Hook.URL = redirect.URL
+	if status, _ := d.post(job); status != http.StatusFound || atomic.LoadInt32(&requests) != 0 {
+		t.Errorf("Expected not followed redirect, got %d", status)
+	}
+}
+
+func TestWebhookRegistry(t *testing.T) {
+	hook, err := AddWebhook(WEBHOOK_ALL_ROOMS, "https://example.com/hook", []string{"JOIN", "join"}, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.Events) != 1 || hook.Events[0] != WEBHOOK_EVENT_JOIN {
+		t.Errorf("Expected join event only, got %v", hook.Events)
+	}
+
+	// Saved in state, shared with other nodes
+	stored := []*Webhook{}
+	if err = State.Load(WEBHOOK_STATE_KEY, &stored); err != nil || len(stored) == 0 {
+		t.Fatalf("Webhooks not stored. %v", err)
+	}
+	if err = RemoveWebhook(hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = RemoveWebhook(hook.ID); err != ErrWebhookNotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	if _, err = AdminAddWebhook("no-such-room", "https://example.com", "", ""); err == nil {
+		t.Error("Webhook of unknown room added")
+	}
+
+	// Webhook added by other node is applied as change, local webhooks kept
+	local, err := AddWebhook(WEBHOOK_ALL_ROOMS, "https://example.com/local", nil, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveWebhook(local.ID)
+	remote := &Webhook{ID: "remote-hook", RoomID: WEBHOOK_ALL_ROOMS, URL: "https://example.com/remote", Events: WebhookEvents}
+	for _, op := range []string{WEBHOOK_OP_ADD, WEBHOOK_OP_ADD, WEBHOOK_OP_REMOVE} {
+		data, _ := json.Marshal(&webhookSync{Node: "other-node", Op: op, Webhook: remote})
+		bus.Publish(WEBHOOK_SUBJECT, data)
+		if op == WEBHOOK_OP_ADD {
+			eventually(t, func() bool { _, err := GetWebhook(remote.ID); return err == nil }, "remote webhook added")
+		}
+	}
+	eventually(t, func() bool { _, err := GetWebhook(remote.ID); return err == ErrWebhookNotFound }, "remote webhook removed")
+	if _, err = GetWebhook(local.ID); err != nil {
+		t.Error("Local webhook lost after remote changes")
+	}
+
+	// Node started after webhook was added receives all webhooks
+	snapshots := make(chan *webhookSync, 10)
+	sub, err := bus.Subscribe(WEBHOOK_SUBJECT, func(data []byte) {
+		update := &webhookSync{}
+		if json.Unmarshal(data, update) == nil && update.Op == WEBHOOK_OP_SNAPSHOT && update.To == "late-node" {
+			snapshots <- update
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	data, _ := json.Marshal(&webhookSync{Node: "late-node", Op: WEBHOOK_OP_SYNC})
+	bus.Publish(WEBHOOK_SUBJECT, data)
+	select {
+	case snapshot := <-snapshots:
+		found := false
+		for _, h := range snapshot.Webhooks {
+			found = found || (h.ID == local.ID && h.Secret != "")
+		}
+		if !found {
+			t.Errorf("Webhook missed in snapshot %+v", snapshot.Webhooks)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Snapshot not sent to started node")
+	}
+
+	// Snapshot for this node replaces webhooks, snapshot for other node ignored
+	WebhookStore.Mu.Lock()
+	list := []*Webhook{remote}
+	for _, h := range WebhookStore.Map {
+		list = append(list, h)
+	}
+	WebhookStore.Mu.Unlock()
+	for _, to := range []string{"late-node", cluster.NodeID} {
+		data, _ = json.Marshal(&webhookSync{Node: "other-node", Op: WEBHOOK_OP_SNAPSHOT, To: to, Webhooks: list})
+		bus.Publish(WEBHOOK_SUBJECT, data)
+		if to == "late-node" {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := GetWebhook(remote.ID); err != ErrWebhookNotFound {
+				t.Error("Snapshot of other node applied")
+			}
+		}
+	}
+	eventually(t, func() bool { _, err := GetWebhook(remote.ID); return err == nil }, "webhook from snapshot")
+	defer RemoveWebhook(remote.ID)
+	if _, err = GetWebhook(local.ID); err != nil {
+		t.Error("Webhook from snapshot lost")
+	}
+}
@@ -72,4 +72,30 @@ CREATE TABLE note (
     CONSTRAINT `f_note_user` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
     
     PRIMARY KEY (id)
-);
\ No newline at end of file
+);
+
+CREATE TABLE chat_history (
+    id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT,
+    
+    conversation VARCHAR(255) NOT NULL,
+    message_id VARCHAR(32) NOT NULL,
+    timestamp BIGINT(20) NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    
+    KEY (conversation, id),
+    KEY (conversation, message_id),
+    
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE chat_state (
+    name VARCHAR(255) NOT NULL,
+    
+    data MEDIUMTEXT NOT NULL,
+    
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    
+    PRIMARY KEY (name)
+);
@@ -3,7 +3,10 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/josephspurrier/gowebapp/app/route"
 	"github.com/josephspurrier/gowebapp/app/shared/chat"
@@ -49,7 +52,24 @@ func main() {
 		recaptcha.Plugin())
 
 	// Chat
-	chat.Init()
+	bus, err := chat.NewBus(config.Chat)
+	if err != nil {
+		log.Fatalf("NATS: failed connect, %v\n", err)
+	}
+	if err := chat.Init(config.Chat, bus); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Leave chat cluster and stop embedded NATS server on exit
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		if err := chat.Close(); err != nil {
+			log.Println(err)
+		}
+		os.Exit(0)
+	}()
 
 	// Start the listener
 	server.Run(route.LoadHTTP(), route.LoadHTTPS(), config.Server)
@@ -59,11 +79,12 @@ func main() {
 // Application Settings
 // *****************************************************************************
 
-// config the settings variable
-var config = &configuration{}
+// config the settings variable, chat starts from defaults overridden by config.json
+var config = &configuration{Chat: chat.DefaultConfig()}
 
 // configuration contains the application settings
 type configuration struct {
+	Chat      chat.Config     `json:"Chat"`
 	Database  database.Info   `json:"Database"`
 	Email     email.SMTPInfo  `json:"Email"`
 	Recaptcha recaptcha.Info  `json:"Recaptcha"`
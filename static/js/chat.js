@@ -8,6 +8,9 @@ const MAX_RECONNECT_ATTEMPTS = 3
 
 const DEFAULT_ROOM_NAME = 'default'
 
+// Messages of conversations, after 'session.resync' they come with reloaded history
+const CONVERSATION_MESSAGE_TYPES = ['room.message', 'private.message', 'private.delivered']
+
 const DEBUG = true //show all messages in console
 
 //const MAX_CHAT_HISTORY_LENGTH = 1000 //Limit length of tab history (not requrired)
@@ -54,7 +57,8 @@ class Chat {
             if (this.api.reconnect_attempts <= MAX_RECONNECT_ATTEMPTS) {
                 setTimeout(async () => {
                     try {
-                        let user = await this.api.join()
+                        // Same session with rooms and missed messages if server still keeps it, new one otherwise
+                        let user = await this.api.resume() || await this.api.join()
                         this.user.session = user.session
                         this.api.update(this.user.session)
                         this.api.getRooms()
@@ -137,6 +141,19 @@ class Chat {
             this.gui.tab.chat.add_system_message(room, `${m.from.name} leave`)
         }
 
+        // Server dropped messages not acknowledged in time, reload rooms and history of opened conversations
+        this.api.onResync = () => {
+            this.api.getRooms()
+            this.gui.tab.chat.opened().forEach(room => {
+                this.gui.tab.chat.clear(room)
+                if (room.type == 'public') {
+                    this.api.joinRoom(room)
+                } else if (room.type == 'private') {
+                    this.api.requestPrivateHistory(room)
+                }
+            })
+        }
+
         this.api.onRoomUsers = (m) => {
             let users = m.body
             this.gui.tab.chat.refresh_users(m.from, users)
@@ -201,7 +218,7 @@ class Chat {
 
         this.api.onPrivateHistory = (m) => {
             let room = m.from
-            m.body.forEach(message => {
+            m.body.history.forEach(message => {
                 this.gui.tab.chat.add_message(room, message)
             })
         }
@@ -301,6 +318,16 @@ class Chat {
             this.gui.tab.chat.add_system_message(m.from, m.body)
         }
 
+        this.api.onCommandError = (m) => {
+            this.gui.tab.chat.add_system_message(m.from, m.body)
+        }
+
+        this.api.onCommandHelp = (m) => {
+            m.body.forEach(c => {
+                this.gui.tab.chat.add_system_message(m.from, `${c.usage} - ${c.help}`)
+            })
+        }
+
         this.api.onRoomFull = (m) => {
             this.gui.popup.show(m.body)
         }
@@ -330,6 +357,8 @@ class ChatApi {
         close: '/chat/close'
     };
     session;
+    resume_token; // returns same session after disconnect
+    last_seq = 0; // seq of last received message, acknowledged with next update
     status = {
         disconnected: 599 // 599 http code when server kill session
     }
@@ -352,6 +381,8 @@ class ChatApi {
     onPrivateMessage; //new private message
     onPrivateHistory; //return history for private chat
     onThrottling; // to fast sending - bad
+    onCommandError; // unknown, forbidden or bad usage of slash command
+    onCommandHelp; // list of slash commands
     onRoomFull; // no free space - show error, can't join
     onRoomMaxCount; // can't create more rooms
     onRoomBadName; // room name depricated
@@ -360,6 +391,8 @@ class ChatApi {
     onUnmuted; //user unmuted
     onMutedBy; //other user mute you
     onUnmutedBy; //other user unmute you
+    onSearchResults; //found messages, body {query, messages}
+    onResync; //messages were lost, rooms and history must be reloaded
 
 
     async join() {
@@ -379,6 +412,8 @@ class ChatApi {
             )
 
             this.session = user_response.session
+            this.resume_token = user_response.resume
+            this.last_seq = 0
 
             // register unload call
             // send request to /close and no wait response
@@ -394,12 +429,31 @@ class ChatApi {
         }
     }
 
+    // Resume session after disconnect. Returns undefined if session expired
+    async resume() {
+        if (!this.resume_token) return
+        try {
+            let response = await fetch(`${this.endpoint.join}?resume=${this.resume_token}&ack=${this.last_seq}`)
+            if (response.status != 200) return
+
+            let user_response = await response.json()
+            this.session = user_response.session
+            return new User(
+                user_response.id,
+                user_response.name,
+                user_response.session
+            )
+        } catch (err) {
+            console.log(err)
+        }
+    }
+
     async update() {
         if (this.timeout) clearTimeout(this.timeout)
         this.abort = new AbortController()
 
         try {
-            let response = await fetch(`${this.endpoint.update}?session=${this.session}`)
+            let response = await fetch(`${this.endpoint.update}?session=${this.session}&ack=${this.last_seq}`)
 
             if (response.status == 200) {
                 this.reconnect_attempts = 0
@@ -412,6 +466,14 @@ class ChatApi {
             }
 
             let messages = await response.json()
+            // Resumed session can repeat messages which were sent but not acknowledged
+            messages = messages.filter(m => !m.seq || m.seq > this.last_seq)
+            messages.forEach(m => { if (m.seq) this.last_seq = m.seq })
+            // Reloaded history contains conversation messages replayed after resync
+            let resync = messages.findIndex(m => m.type == 'session.resync')
+            if (resync !== -1) {
+                messages = messages.filter((m, i) => i <= resync || !CONVERSATION_MESSAGE_TYPES.includes(m.type))
+            }
             if (this.onmessages) this.onmessages(messages)
 
             messages.forEach(m => this.process(m))
@@ -493,6 +555,14 @@ class ChatApi {
             case 'to_many_requests':
                 if (this.onThrottling) this.onThrottling(message)
                 break
+            case 'command.unknown':
+            case 'command.forbidden':
+            case 'command.usage':
+                if (this.onCommandError) this.onCommandError(message)
+                break
+            case 'command.help':
+                if (this.onCommandHelp) this.onCommandHelp(message)
+                break
             case 'room.full':
                 if (this.onRoomFull) this.onRoomFull(message)
                 break
@@ -522,6 +592,12 @@ class ChatApi {
                 break
             case 'private.history':
                 if (this.onPrivateHistory) this.onPrivateHistory(message)
+                break
+            case 'search.results':
+                if (this.onSearchResults) this.onSearchResults(message)
+                break
+            case 'session.resync':
+                if (this.onResync) this.onResync(message)
         }
     }
 
@@ -607,6 +683,14 @@ class ChatApi {
         })
     }
 
+    // filter: {room: room id, with: user id, from: author id, since, until, limit}
+    search(text, filter = {}) {
+        this.send({
+            type: 'search',
+            body: JSON.stringify(Object.assign({}, filter, { text: text }))
+        })
+    }
+
     muteUser(user) {
         this.send({
             type: 'mute',
@@ -1187,6 +1271,12 @@ class ChatGUI {
                 from.innerText = message && message.from && message.from.name ? message.from.name : ''
                 text.innerText = message && message.body ? message.body : ''
 
+                // '/me' action
+                if (message && message.action) {
+                    from.innerText = `* ${from.innerText} `
+                    text.style.fontStyle = 'italic'
+                }
+
                 if (this.tab.USE_COLORS == true) {
                     let name = message && message.from && message.from.name ? message.from.name : null
                     if (this.tab.user_color_map[name] === undefined) {
@@ -1372,6 +1462,18 @@ class ChatGUI {
                     }
                 })
             },
+            opened() {
+                return [...this.tab.container.querySelectorAll('.' + this.container_class)].map(i => {
+                    return { id: i.dataset.id, name: i.dataset.name, type: i.dataset.type }
+                })
+            },
+            clear(room) {
+                let target = this.tab.container.querySelector(`.${this.container_class}[data-id='${room.id}']`)
+                let inner = target ? target.querySelector('.' + this.inner_class) : undefined
+                if (inner) {
+                    inner.querySelectorAll('.chat-message, .chat-system-message').forEach(m => inner.removeChild(m))
+                }
+            },
             is_opened(room) {
                 let opened = false;
                 this.tab.container.querySelectorAll('.' + this.container_class).forEach(i => {